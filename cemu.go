@@ -0,0 +1,141 @@
+package wiiudownloader
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var ErrTitleAlreadyInstalled = errors.New("same or newer version already installed")
+
+// GetMLCTitlePath returns where Cemu expects a title inside an MLC root:
+// usr/title/<high>/<low>. Games, demos, updates (0005000E) and DLC
+// (0005000C, the "aoc" titles) each live under their own high ID.
+func GetMLCTitlePath(mlcPath string, titleID uint64) (string, error) {
+	switch titleID >> 32 {
+	case TID_HIGH_GAME, TID_HIGH_DEMO, TID_HIGH_UPDATE, TID_HIGH_DLC:
+	default:
+		return "", fmt.Errorf("title %016x can't be installed to an MLC", titleID)
+	}
+	return filepath.Join(mlcPath, "usr", "title", fmt.Sprintf("%08x", titleID>>32), fmt.Sprintf("%08x", titleID&0xFFFFFFFF)), nil
+}
+
+// GetInstalledMLCVersion returns the version of an installed title, read
+// from its code/app.xml.
+func GetInstalledMLCVersion(titlePath string) (uint16, error) {
+	app, err := readAppXML(titlePath)
+	if err != nil {
+		return 0, err
+	}
+	version, err := parseHexField(app.TitleVersion, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid title_version in app.xml: %w", err)
+	}
+	return uint16(version), nil
+}
+
+// CheckMLCUpToDate returns ErrTitleAlreadyInstalled when the MLC root holds
+// the latest version of a title on the CDN or a newer one, so downloading it
+// again can be skipped. Only the TMD is fetched, and only when the title is
+// installed.
+func CheckMLCUpToDate(titleID uint64, mlcPath string, client *http.Client) error {
+	titlePath, err := GetMLCTitlePath(mlcPath, titleID)
+	if err != nil {
+		return err
+	}
+	installedVersion, err := GetInstalledMLCVersion(titlePath)
+	if err != nil {
+		// not installed, or too broken to tell
+		return nil
+	}
+
+	tmdData, err := fetchTitleFile(client, fmt.Sprintf("%s/%016x/tmd", cdnDownloadURL, titleID))
+	if err != nil {
+		return err
+	}
+	tmd, err := ParseTMD(tmdData)
+	if err != nil {
+		return err
+	}
+	if installedVersion >= tmd.TitleVersion {
+		return fmt.Errorf("%016x v%d: %w (v%d)", titleID, tmd.TitleVersion, ErrTitleAlreadyInstalled, installedVersion)
+	}
+	return nil
+}
+
+// InstallToMLC decrypts the downloaded title in path straight into the Cemu
+// MLC root, replacing an older installed version once decryption succeeded.
+func InstallToMLC(path, mlcPath string, progressReporter ProgressReporter, deleteEncryptedContents bool) error {
+	tmdData, err := os.ReadFile(filepath.Join(path, "title.tmd"))
+	if err != nil {
+		return err
+	}
+	tmd, err := ParseTMD(tmdData)
+	if err != nil {
+		return err
+	}
+
+	titlePath, err := GetMLCTitlePath(mlcPath, tmd.TitleID)
+	if err != nil {
+		return err
+	}
+
+	installed := false
+	if _, err := os.Stat(titlePath); err == nil {
+		installed = true
+		if installedVersion, err := GetInstalledMLCVersion(titlePath); err == nil && installedVersion >= tmd.TitleVersion {
+			return fmt.Errorf("%016x v%d: %w (v%d)", tmd.TitleID, tmd.TitleVersion, ErrTitleAlreadyInstalled, installedVersion)
+		}
+	}
+
+	parentPath := filepath.Dir(titlePath)
+	if err := os.MkdirAll(parentPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	// Stage next to the final location so the swap is a rename on the same filesystem
+	stagingPath := filepath.Join(parentPath, "."+filepath.Base(titlePath)+".installing")
+	if err := os.RemoveAll(stagingPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stagingPath, os.ModePerm); err != nil {
+		return err
+	}
+	if err := decryptContentsToSink(path, directorySink(stagingPath), progressReporter, false); err != nil {
+		os.RemoveAll(stagingPath)
+		return err
+	}
+	if progressReporter.Cancelled() {
+		return os.RemoveAll(stagingPath)
+	}
+
+	oldPath := filepath.Join(parentPath, "."+filepath.Base(titlePath)+".old")
+	if installed {
+		if err := os.RemoveAll(oldPath); err != nil {
+			return err
+		}
+		if err := os.Rename(titlePath, oldPath); err != nil {
+			os.RemoveAll(stagingPath)
+			return err
+		}
+	}
+	if err := os.Rename(stagingPath, titlePath); err != nil {
+		if installed {
+			os.Rename(oldPath, titlePath)
+		}
+		os.RemoveAll(stagingPath)
+		return err
+	}
+	if installed {
+		if err := os.RemoveAll(oldPath); err != nil {
+			return err
+		}
+	}
+
+	if deleteEncryptedContents {
+		return doDeleteEncryptedContents(path)
+	}
+	return nil
+}
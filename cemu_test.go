@@ -0,0 +1,65 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInstallToMLC(t *testing.T) {
+	inputDir := t.TempDir()
+	downloadDir := t.TempDir()
+	mlcDir := t.TempDir()
+	files := testDecryptedTree()
+	writeTestTree(t, inputDir, files)
+
+	options := PackOptions{Certificate: make([]byte, TITLE_CERT_SIZE)}
+	if err := PackContents(inputDir, downloadDir, options, testProgressReporter{}, nil); err != nil {
+		t.Fatalf("PackContents failed: %v", err)
+	}
+
+	if err := InstallToMLC(downloadDir, mlcDir, testProgressReporter{}, false); err != nil {
+		t.Fatalf("InstallToMLC failed: %v", err)
+	}
+	titlePath := filepath.Join(mlcDir, "usr", "title", "00050000", "10ffff00")
+	actual, err := os.ReadFile(filepath.Join(titlePath, "content", "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, files["content/big.bin"]) {
+		t.Error("installed contents differ")
+	}
+	if _, err := os.Stat(filepath.Join(downloadDir, "title.tmd")); err != nil {
+		t.Errorf("encrypted contents should be kept: %v", err)
+	}
+
+	if err := InstallToMLC(downloadDir, mlcDir, testProgressReporter{}, false); !errors.Is(err, ErrTitleAlreadyInstalled) {
+		t.Errorf("expected ErrTitleAlreadyInstalled, got %v", err)
+	}
+}
+
+func TestCheckMLCUpToDate(t *testing.T) {
+	const tid = 0x0005000010FFFF00
+	mlcDir := t.TempDir()
+	serveTestCDN(t, map[string][]byte{"tmd": testTMD(tid, 0x20)})
+	if err := CheckMLCUpToDate(tid, mlcDir, http.DefaultClient); err != nil {
+		t.Errorf("expected a title that isn't installed to be downloaded, got %v", err)
+	}
+
+	titlePath, err := GetMLCTitlePath(mlcDir, tid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestTree(t, titlePath, testDecryptedTree())
+	if err := CheckMLCUpToDate(tid, mlcDir, http.DefaultClient); !errors.Is(err, ErrTitleAlreadyInstalled) {
+		t.Errorf("expected ErrTitleAlreadyInstalled, got %v", err)
+	}
+
+	serveTestCDN(t, map[string][]byte{"tmd": testTMD(tid, 0x30)})
+	if err := CheckMLCUpToDate(tid, mlcDir, http.DefaultClient); err != nil {
+		t.Errorf("expected the update to be downloaded, got %v", err)
+	}
+}
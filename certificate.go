@@ -10,12 +10,16 @@ import (
 
 var cetkData []byte
 
+// osv10TitleID is the title whose TMD and ticket carry the certificates every
+// title shares.
+const osv10TitleID = "000500101000400a"
+
 func getDefaultCert(progressReporter ProgressReporter, client *http.Client) ([]byte, error) {
 	if len(cetkData) >= 0x350+0x300 {
 		return cetkData[0x350 : 0x350+0x300], nil
 	}
 	cetkDir := path.Join(os.TempDir(), "cetk")
-	if err := downloadFile(progressReporter, client, "http://ccs.cdn.c.shop.nintendowifi.net/ccs/download/000500101000400a/cetk", cetkDir, true); err != nil {
+	if err := downloadFile(progressReporter, client, fmt.Sprintf("%s/%s/cetk", cdnDownloadURL, osv10TitleID), cetkDir, true); err != nil {
 		return nil, err
 	}
 	cetkData, err := os.ReadFile(cetkDir)
@@ -33,6 +37,20 @@ func getDefaultCert(progressReporter ProgressReporter, client *http.Client) ([]b
 	return nil, fmt.Errorf("failed to download OSv10 cetk, length: %d", len(cetkData))
 }
 
+// getDefaultTMDCert returns the CA and CP certificates of a TMD, taken from
+// the OSv10 one, for TMDs built without a certificate chain.
+func getDefaultTMDCert(client *http.Client) ([]byte, error) {
+	tmdData, err := fetchTitleFile(client, fmt.Sprintf("%s/%s/tmd", cdnDownloadURL, osv10TitleID))
+	if err != nil {
+		return nil, err
+	}
+	// the certificates end every TMD
+	if len(tmdData) < TMD_CONTENT_RECORDS_OFFSET+TMD_CERTIFICATES_SIZE {
+		return nil, fmt.Errorf("failed to download OSv10 tmd, length: %d", len(tmdData))
+	}
+	return tmdData[len(tmdData)-TMD_CERTIFICATES_SIZE:], nil
+}
+
 func GenerateCert(tmd *TMD, outputPath string, progressReporter ProgressReporter, client *http.Client) error {
 	cert, err := os.Create(outputPath)
 	if err != nil {
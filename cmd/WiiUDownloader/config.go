@@ -14,13 +14,16 @@ import (
 )
 
 type Config struct {
-	DarkMode                bool   `koanf:"darkMode"`
-	DecryptContents         bool   `koanf:"decryptContents"`
-	DeleteEncryptedContents bool   `koanf:"deleteEncryptedContents"`
-	SelectedRegion          uint8  `koanf:"selectedRegion"`
-	DidInitialSetup         bool   `koanf:"didInitialSetup"`
-	LastSelectedPath        string `koanf:"lastSelectedPath"`
-	RememberLastPath        bool   `koanf:"rememberLastPath"`
+	DarkMode                bool                  `koanf:"darkMode"`
+	DecryptContents         bool                  `koanf:"decryptContents"`
+	DeleteEncryptedContents bool                  `koanf:"deleteEncryptedContents"`
+	SelectedRegion          wiiudownloader.Region `koanf:"selectedRegion"`
+	DidInitialSetup         bool                  `koanf:"didInitialSetup"`
+	LastSelectedPath        string                `koanf:"lastSelectedPath"`
+	RememberLastPath        bool                  `koanf:"rememberLastPath"`
+	InstallToMLC            bool                  `koanf:"installToMLC"`
+	MLCPath                 string                `koanf:"mlcPath"`
+	TitleDBPath             string                `koanf:"titleDBPath"`
 	saveConfigCallback      func()
 	saveMutex               *sync.Mutex
 }
@@ -40,10 +43,13 @@ func getDefaultConfig() *Config {
 		DarkMode:                isDarkMode(),
 		DecryptContents:         false,
 		DeleteEncryptedContents: false,
-		SelectedRegion:          wiiudownloader.MCP_REGION_EUROPE | wiiudownloader.MCP_REGION_USA | wiiudownloader.MCP_REGION_JAPAN,
+		SelectedRegion:          wiiudownloader.REGION_ALL,
 		DidInitialSetup:         false,
 		LastSelectedPath:        "",
 		RememberLastPath:        false,
+		InstallToMLC:            false,
+		MLCPath:                 "",
+		TitleDBPath:             "",
 		saveConfigCallback:      nil,
 		saveMutex:               &sync.Mutex{},
 	}
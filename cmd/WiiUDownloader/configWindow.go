@@ -74,12 +74,52 @@ func NewConfigWindow(config *Config) (*ConfigWindow, error) {
 	rememberPathCheck.SetMarginTop(10)
 	grid.AttachNextTo(rememberPathCheck, downloadPathEntry, gtk.POS_BOTTOM, 1, 1)
 
+	installToMLCCheck, err := gtk.CheckButtonNewWithLabel("Install downloaded titles to Cemu")
+	if err != nil {
+		return nil, err
+	}
+	installToMLCCheck.SetActive(config.InstallToMLC)
+	installToMLCCheck.SetMarginTop(10)
+	grid.AttachNextTo(installToMLCCheck, rememberPathCheck, gtk.POS_BOTTOM, 1, 1)
+
+	mlcPathLabel, err := gtk.LabelNew("Cemu MLC Path:")
+	if err != nil {
+		return nil, err
+	}
+	mlcPathLabel.SetHAlign(gtk.ALIGN_START)
+	mlcPathLabel.SetMarginTop(10)
+	grid.AttachNextTo(mlcPathLabel, installToMLCCheck, gtk.POS_BOTTOM, 1, 1)
+
+	mlcPathEntry, err := gtk.EntryNew()
+	if err != nil {
+		return nil, err
+	}
+	mlcPathEntry.SetText(config.MLCPath)
+	mlcPathEntry.SetWidthChars(40)
+	mlcPathEntry.SetMarginEnd(10)
+	grid.AttachNextTo(mlcPathEntry, mlcPathLabel, gtk.POS_BOTTOM, 1, 1)
+
+	mlcPathButton, err := gtk.ButtonNewWithLabel("Browse")
+	if err != nil {
+		return nil, err
+	}
+	mlcPathButton.Connect("clicked", func() {
+		selectedPath, err := dialog.Directory().Title("Select Cemu MLC Path").Browse()
+		if err != nil {
+			return
+		}
+		if selectedPath != "" {
+			mlcPathEntry.SetText(selectedPath)
+		}
+	})
+	grid.AttachNextTo(mlcPathButton, mlcPathEntry, gtk.POS_RIGHT, 1, 1)
+
 	saveButton, err := gtk.ButtonNewWithLabel("Save and Apply")
 	if err != nil {
 		return nil, err
 	}
 	saveButton.SetMarginTop(10)
-	grid.AttachNextTo(saveButton, rememberPathCheck, gtk.POS_BOTTOM, 1, 1)
+	grid.AttachNextTo(saveButton, mlcPathEntry, gtk.POS_BOTTOM, 1, 1)
 
 	saveButton.Connect("clicked", func() {
 		config.DarkMode = darkModeCheck.GetActive()
@@ -92,8 +132,18 @@ func NewConfigWindow(config *Config) (*ConfigWindow, error) {
 			return
 		}
 
+		var newMLCPath = mlcPathEntry.GetLayout().GetText()
+		if installToMLCCheck.GetActive() && (newMLCPath == "" || !isValidPath(newMLCPath)) {
+			errorDialog := gtk.MessageDialogNew(win, gtk.DIALOG_MODAL, gtk.MESSAGE_ERROR, gtk.BUTTONS_OK, "Invalid Cemu MLC path. Please select a valid directory.")
+			defer errorDialog.Destroy()
+			errorDialog.Run()
+			return
+		}
+
 		config.LastSelectedPath = newPath
 		config.RememberLastPath = rememberPathCheck.GetActive()
+		config.InstallToMLC = installToMLCCheck.GetActive()
+		config.MLCPath = newMLCPath
 
 		if err := config.Save(); err != nil {
 			log.Println(err)
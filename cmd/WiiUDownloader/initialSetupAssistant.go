@@ -76,47 +76,23 @@ func NewInitialSetupAssistantWindow(config *Config) (*InitialSetupAssistantWindo
 
 	selectedRegionCheckboxes := uint8(0)
 
-	europeCheck, err := gtk.CheckButtonNewWithLabel("Europe")
-	if err != nil {
-		return nil, err
-	}
-	europeCheck.Connect("toggled", func() {
-		if europeCheck.GetActive() {
-			selectedRegionCheckboxes++
-		} else {
-			selectedRegionCheckboxes--
+	regionChecks := make(map[wiiudownloader.Region]*gtk.CheckButton, len(wiiudownloader.REGIONS))
+	for _, region := range wiiudownloader.REGIONS {
+		regionCheck, err := gtk.CheckButtonNewWithLabel(region.String())
+		if err != nil {
+			return nil, err
 		}
-		assistant.SetPageComplete(page2, selectedRegionCheckboxes > 0)
-	})
-	regionBox.PackStart(europeCheck, true, true, 0)
-
-	usaCheck, err := gtk.CheckButtonNewWithLabel("USA")
-	if err != nil {
-		return nil, err
+		regionCheck.Connect("toggled", func() {
+			if regionCheck.GetActive() {
+				selectedRegionCheckboxes++
+			} else {
+				selectedRegionCheckboxes--
+			}
+			assistant.SetPageComplete(page2, selectedRegionCheckboxes > 0)
+		})
+		regionBox.PackStart(regionCheck, true, true, 0)
+		regionChecks[region] = regionCheck
 	}
-	usaCheck.Connect("toggled", func() {
-		if usaCheck.GetActive() {
-			selectedRegionCheckboxes++
-		} else {
-			selectedRegionCheckboxes--
-		}
-		assistant.SetPageComplete(page2, selectedRegionCheckboxes > 0)
-	})
-	regionBox.PackStart(usaCheck, true, true, 0)
-
-	japanCheck, err := gtk.CheckButtonNewWithLabel("Japan")
-	if err != nil {
-		return nil, err
-	}
-	japanCheck.Connect("toggled", func() {
-		if japanCheck.GetActive() {
-			selectedRegionCheckboxes++
-		} else {
-			selectedRegionCheckboxes--
-		}
-		assistant.SetPageComplete(page2, selectedRegionCheckboxes > 0)
-	})
-	regionBox.PackStart(japanCheck, true, true, 0)
 
 	page3, err := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 0)
 	if err != nil {
@@ -181,15 +157,11 @@ func NewInitialSetupAssistantWindow(config *Config) (*InitialSetupAssistantWindo
 
 	assistant.Connect("apply", func() {
 		config.DidInitialSetup = true
-		selectedRegions := uint8(0)
-		if europeCheck.GetActive() {
-			selectedRegions |= wiiudownloader.MCP_REGION_EUROPE
-		}
-		if usaCheck.GetActive() {
-			selectedRegions |= wiiudownloader.MCP_REGION_USA
-		}
-		if japanCheck.GetActive() {
-			selectedRegions |= wiiudownloader.MCP_REGION_JAPAN
+		selectedRegions := wiiudownloader.Region(0)
+		for region, regionCheck := range regionChecks {
+			if regionCheck.GetActive() {
+				selectedRegions |= region
+			}
 		}
 		config.SelectedRegion = selectedRegions
 		config.DecryptContents = cemuCheck.GetActive()
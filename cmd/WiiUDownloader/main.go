@@ -64,6 +64,12 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if config.TitleDBPath != "" {
+		if err := wiiudownloader.DefaultTitleDB().Load(config.TitleDBPath); err != nil {
+			log.Printf("error loading title database %s: %v, using the built-in one", config.TitleDBPath, err)
+		}
+	}
+
 	win := NewMainWindow(wiiudownloader.GetTitleEntries(wiiudownloader.TITLE_CATEGORY_GAME), client, config)
 	config.saveConfigCallback = func() {
 		win.applyConfig(config)
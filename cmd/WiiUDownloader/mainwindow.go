@@ -2,13 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
-	"strings"
 
 	wiiudownloader "github.com/Xpl0itU/WiiUDownloader"
 	"github.com/Xpl0itU/dialog"
@@ -40,7 +40,9 @@ type MainWindow struct {
 	categoryButtons                 []*gtk.ToggleButton
 	titles                          []wiiudownloader.TitleEntry
 	decryptContents                 bool
-	currentRegion                   uint8
+	currentRegion                   wiiudownloader.Region
+	installToMLC                    bool
+	mlcPath                         string
 	client                          *http.Client
 }
 
@@ -73,7 +75,7 @@ func NewMainWindow(entries []wiiudownloader.TitleEntry, client *http.Client, con
 		queuePane:      queuePane,
 		titles:         entries,
 		searchEntry:    searchEntry,
-		currentRegion:  wiiudownloader.MCP_REGION_EUROPE | wiiudownloader.MCP_REGION_JAPAN | wiiudownloader.MCP_REGION_USA,
+		currentRegion:  wiiudownloader.REGION_ALL,
 		lastSearchText: "",
 		client:         client,
 	}
@@ -98,7 +100,7 @@ func (mw *MainWindow) updateTitles(titles []wiiudownloader.TitleEntry) {
 	}
 
 	for _, entry := range titles {
-		if (mw.currentRegion & entry.Region) == 0 {
+		if !mw.currentRegion.Overlaps(wiiudownloader.Region(entry.Region)) {
 			continue
 		}
 		iter := store.Append()
@@ -126,6 +128,8 @@ func (mw *MainWindow) applyConfig(config *Config) {
 	mw.decryptContents = config.DecryptContents
 	mw.deleteEncryptedContents = config.DeleteEncryptedContents
 	mw.currentRegion = config.SelectedRegion
+	mw.installToMLC = config.InstallToMLC && config.MLCPath != ""
+	mw.mlcPath = config.MLCPath
 }
 
 func (mw *MainWindow) ShowAll() {
@@ -135,7 +139,7 @@ func (mw *MainWindow) ShowAll() {
 	}
 
 	for _, entry := range mw.titles {
-		if (mw.currentRegion & entry.Region) == 0 {
+		if !mw.currentRegion.Overlaps(wiiudownloader.Region(entry.Region)) {
 			continue
 		}
 		iter := store.Append()
@@ -318,6 +322,163 @@ func (mw *MainWindow) ShowAll() {
 	})
 	toolsSubMenu.Append(generateFakeTicketCert)
 
+	packContentsMenuItem, err := gtk.MenuItemNewWithLabel("Pack decrypted contents")
+	if err != nil {
+		log.Fatalln("Unable to create menu item:", err)
+	}
+	packContentsMenuItem.Connect("activate", func() {
+		inputPath, err := dialog.Directory().Title("Select the decrypted game path").Browse()
+		if err != nil {
+			return
+		}
+		outputPath, err := dialog.Directory().Title("Select a path to save the packed game to").Browse()
+		if err != nil {
+			return
+		}
+		mw.progressWindow, err = createProgressWindow(mw.window)
+		if err != nil {
+			return
+		}
+		mw.progressWindow.SetGameTitle("Packing...")
+		mw.progressWindow.Window.ShowAll()
+		go func() {
+			err := wiiudownloader.PackContents(inputPath, outputPath, wiiudownloader.PackOptions{}, mw.progressWindow, mw.client)
+			glib.IdleAdd(func() {
+				mw.progressWindow.Window.Hide()
+			})
+			if err != nil && err != context.Canceled {
+				glib.IdleAdd(func() {
+					mw.showError(err)
+				})
+			}
+		}()
+	})
+	toolsSubMenu.Append(packContentsMenuItem)
+
+	exportWUAMenuItem, err := gtk.MenuItemNewWithLabel("Export to WUA")
+	if err != nil {
+		log.Fatalln("Unable to create menu item:", err)
+	}
+	exportWUAMenuItem.Connect("activate", func() {
+		inputPath, err := dialog.Directory().Title("Select a game, or a folder with the game, update and DLC").Browse()
+		if err != nil {
+			return
+		}
+		titlePaths, err := findWUATitlePaths(inputPath)
+		if err != nil {
+			mw.showError(err)
+			return
+		}
+		outputPath, err := dialog.File().Title("Save WUA as").Filter("Cemu archive", "wua").Save()
+		if err != nil {
+			return
+		}
+		if filepath.Ext(outputPath) != ".wua" {
+			outputPath += ".wua"
+		}
+		mw.progressWindow, err = createProgressWindow(mw.window)
+		if err != nil {
+			return
+		}
+		mw.progressWindow.SetGameTitle("Exporting...")
+		mw.progressWindow.Window.ShowAll()
+		go func() {
+			err := wiiudownloader.ExportWUA(outputPath, titlePaths, mw.progressWindow)
+			glib.IdleAdd(func() {
+				mw.progressWindow.Window.Hide()
+			})
+			if err != nil && err != context.Canceled {
+				glib.IdleAdd(func() {
+					mw.showError(err)
+				})
+			}
+		}()
+	})
+	toolsSubMenu.Append(exportWUAMenuItem)
+
+	extractDiscMenuItem, err := gtk.MenuItemNewWithLabel("Extract disc image")
+	if err != nil {
+		log.Fatalln("Unable to create menu item:", err)
+	}
+	extractDiscMenuItem.Connect("activate", func() {
+		imagePath, err := dialog.File().Title("Select the disc image").Filter("Disc image", "wud", "wux").Load()
+		if err != nil {
+			return
+		}
+		keyPath := filepath.Join(filepath.Dir(imagePath), "game.key")
+		if _, err := os.Stat(keyPath); err != nil {
+			keyPath, err = dialog.File().Title("Select the disc key").Filter("Disc key", "key", "txt").Load()
+			if err != nil {
+				return
+			}
+		}
+		discKey, err := wiiudownloader.ReadDiscKey(keyPath)
+		if err != nil {
+			mw.showError(err)
+			return
+		}
+		outputPath, err := dialog.Directory().Title("Select a path to extract the disc to").Browse()
+		if err != nil {
+			return
+		}
+		mw.progressWindow, err = createProgressWindow(mw.window)
+		if err != nil {
+			return
+		}
+		mw.progressWindow.SetGameTitle("Extracting...")
+		mw.progressWindow.Window.ShowAll()
+		go func() {
+			err := wiiudownloader.ExtractDiscImage(imagePath, discKey, outputPath, mw.decryptContents, mw.progressWindow)
+			glib.IdleAdd(func() {
+				mw.progressWindow.Window.Hide()
+			})
+			if err != nil {
+				glib.IdleAdd(func() {
+					mw.showError(err)
+				})
+			}
+		}()
+	})
+	toolsSubMenu.Append(extractDiscMenuItem)
+
+	loadTitleDBMenuItem, err := gtk.MenuItemNewWithLabel("Load title database")
+	if err != nil {
+		log.Fatalln("Unable to create menu item:", err)
+	}
+	loadTitleDBMenuItem.Connect("activate", func() {
+		titleDBPath, err := dialog.File().Title("Select the title database").Filter("Title database", "json", "csv").Load()
+		if err != nil {
+			return
+		}
+		if err := wiiudownloader.DefaultTitleDB().Load(titleDBPath); err != nil {
+			mw.showError(err)
+			return
+		}
+		config, err := loadConfig()
+		if err == nil {
+			config.TitleDBPath = titleDBPath
+			err = config.Save()
+		}
+		if err != nil {
+			mw.showError(err)
+		}
+		mw.reloadTitles()
+	})
+	toolsSubMenu.Append(loadTitleDBMenuItem)
+
+	reloadTitleDBMenuItem, err := gtk.MenuItemNewWithLabel("Reload title database")
+	if err != nil {
+		log.Fatalln("Unable to create menu item:", err)
+	}
+	reloadTitleDBMenuItem.Connect("activate", func() {
+		if err := wiiudownloader.DefaultTitleDB().Reload(); err != nil {
+			mw.showError(err)
+			return
+		}
+		mw.reloadTitles()
+	})
+	toolsSubMenu.Append(reloadTitleDBMenuItem)
+
 	toolsMenu.SetSubmenu(toolsSubMenu)
 	menuBar.Append(toolsMenu)
 	configSubMenu, err := gtk.MenuNew()
@@ -391,6 +552,13 @@ func (mw *MainWindow) ShowAll() {
 		log.Fatalln("Unable to create button:", err)
 	}
 
+	addRelatedButton, err := gtk.ButtonNewWithLabel("Add with Update and DLC")
+	if err != nil {
+		log.Fatalln("Unable to create button:", err)
+	}
+	addRelatedButton.SetTooltipText("Add the selected titles to the queue along with their game, update, DLC and demo")
+	addRelatedButton.Connect("clicked", mw.onAddRelatedClicked)
+
 	mw.decryptContentsCheckbox, err = gtk.CheckButtonNewWithLabel("Decrypt contents")
 	if err != nil {
 		log.Fatalln("Unable to create button:", err)
@@ -483,6 +651,7 @@ func (mw *MainWindow) ShowAll() {
 	})
 	mw.decryptContentsCheckbox.Connect("clicked", mw.onDecryptContentsClicked)
 	bottomhBox.PackStart(mw.downloadQueueButton, false, false, 0)
+	bottomhBox.PackStart(addRelatedButton, false, false, 0)
 
 	checkboxvBox, err := gtk.BoxNew(gtk.ORIENTATION_VERTICAL, 0)
 	if err != nil {
@@ -493,35 +662,19 @@ func (mw *MainWindow) ShowAll() {
 
 	bottomhBox.PackStart(checkboxvBox, false, false, 0)
 
-	japanButton, err := gtk.CheckButtonNewWithLabel("Japan")
-	japanButton.SetActive(mw.currentRegion&wiiudownloader.MCP_REGION_JAPAN != 0)
-	if err != nil {
-		log.Fatalln("Unable to create button:", err)
-	}
-	japanButton.Connect("clicked", func() {
-		mw.onRegionChange(japanButton, wiiudownloader.MCP_REGION_JAPAN)
-	})
-	bottomhBox.PackEnd(japanButton, false, false, 0)
-
-	usaButton, err := gtk.CheckButtonNewWithLabel("USA")
-	usaButton.SetActive(mw.currentRegion&wiiudownloader.MCP_REGION_USA != 0)
-	if err != nil {
-		log.Fatalln("Unable to create button:", err)
-	}
-	usaButton.Connect("clicked", func() {
-		mw.onRegionChange(usaButton, wiiudownloader.MCP_REGION_USA)
-	})
-	bottomhBox.PackEnd(usaButton, false, false, 0)
-
-	europeButton, err := gtk.CheckButtonNewWithLabel("Europe")
-	europeButton.SetActive(mw.currentRegion&wiiudownloader.MCP_REGION_EUROPE != 0)
-	if err != nil {
-		log.Fatalln("Unable to create button:", err)
+	// packed from the end, so go backwards to show them in REGIONS order
+	for i := len(wiiudownloader.REGIONS) - 1; i >= 0; i-- {
+		region := wiiudownloader.REGIONS[i]
+		regionButton, err := gtk.CheckButtonNewWithLabel(region.String())
+		if err != nil {
+			log.Fatalln("Unable to create button:", err)
+		}
+		regionButton.SetActive(mw.currentRegion.Overlaps(region))
+		regionButton.Connect("clicked", func() {
+			mw.onRegionChange(regionButton, region)
+		})
+		bottomhBox.PackEnd(regionButton, false, false, 0)
 	}
-	europeButton.Connect("clicked", func() {
-		mw.onRegionChange(europeButton, wiiudownloader.MCP_REGION_EUROPE)
-	})
-	bottomhBox.PackEnd(europeButton, false, false, 0)
 
 	mainvBox.PackEnd(bottomhBox, false, false, 0)
 
@@ -542,11 +695,11 @@ func (mw *MainWindow) ShowAll() {
 	splitPane.ShowAll()
 }
 
-func (mw *MainWindow) onRegionChange(button *gtk.CheckButton, region uint8) {
+func (mw *MainWindow) onRegionChange(button *gtk.CheckButton, region wiiudownloader.Region) {
 	if button.GetActive() {
 		mw.currentRegion = region | mw.currentRegion
 	} else {
-		mw.currentRegion = region ^ mw.currentRegion
+		mw.currentRegion = mw.currentRegion &^ region
 	}
 	mw.updateTitles(mw.titles)
 	mw.filterTitles(mw.lastSearchText)
@@ -578,19 +731,20 @@ func (mw *MainWindow) filterTitles(filterText string) {
 	storeRef := store.(*gtk.ListStore)
 	storeRef.Clear()
 
+	regionTitles := make([]wiiudownloader.TitleEntry, 0, len(mw.titles))
 	for _, entry := range mw.titles {
-		if strings.Contains(strings.ToLower(entry.Name), strings.ToLower(filterText)) ||
-			strings.Contains(strings.ToLower(fmt.Sprintf("%016x", entry.TitleID)), strings.ToLower(filterText)) {
-			if (mw.currentRegion & entry.Region) == 0 {
-				continue
-			}
-			iter := storeRef.Append()
-			if err := storeRef.Set(iter,
-				[]int{IN_QUEUE_COLUMN, KIND_COLUMN, TITLE_ID_COLUMN, REGION_COLUMN, NAME_COLUMN},
-				[]interface{}{mw.queuePane.IsTitleInQueue(entry), wiiudownloader.GetFormattedKind(entry.TitleID), fmt.Sprintf("%016x", entry.TitleID), wiiudownloader.GetFormattedRegion(entry.Region), entry.Name},
-			); err != nil {
-				log.Fatalln("Unable to set values:", err)
-			}
+		if mw.currentRegion.Overlaps(wiiudownloader.Region(entry.Region)) {
+			regionTitles = append(regionTitles, entry)
+		}
+	}
+
+	for _, entry := range wiiudownloader.SearchTitles(regionTitles, filterText) {
+		iter := storeRef.Append()
+		if err := storeRef.Set(iter,
+			[]int{IN_QUEUE_COLUMN, KIND_COLUMN, TITLE_ID_COLUMN, REGION_COLUMN, NAME_COLUMN},
+			[]interface{}{mw.queuePane.IsTitleInQueue(entry), wiiudownloader.GetFormattedKind(entry.TitleID), fmt.Sprintf("%016x", entry.TitleID), wiiudownloader.GetFormattedRegion(entry.Region), entry.Name},
+		); err != nil {
+			log.Fatalln("Unable to set values:", err)
 		}
 	}
 }
@@ -609,6 +763,55 @@ func (mw *MainWindow) onCategoryToggled(button *gtk.ToggleButton) {
 	button.Activate()
 }
 
+// reloadTitles lists the titles of the selected category again after the
+// title database changed.
+func (mw *MainWindow) reloadTitles() {
+	category := uint8(wiiudownloader.TITLE_CATEGORY_GAME)
+	for _, button := range mw.categoryButtons {
+		if button.GetActive() {
+			label, err := button.GetLabel()
+			if err != nil {
+				log.Fatalln("Unable to get label:", err)
+			}
+			category = wiiudownloader.GetCategoryFromFormattedCategory(label)
+		}
+	}
+	mw.titles = wiiudownloader.GetTitleEntries(category)
+	mw.updateTitles(mw.titles)
+	mw.filterTitles(mw.lastSearchText)
+}
+
+// findWUATitlePaths returns path itself when it holds a title, otherwise every
+// title found in its subdirectories so a game can be bundled with its update and DLC.
+func findWUATitlePaths(path string) ([]string, error) {
+	isTitle := func(path string) bool {
+		for _, name := range []string{"title.tmd", filepath.Join("code", "app.xml")} {
+			if _, err := os.Stat(filepath.Join(path, name)); err == nil {
+				return true
+			}
+		}
+		return false
+	}
+	if isTitle(path) {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	titlePaths := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() && isTitle(filepath.Join(path, entry.Name())) {
+			titlePaths = append(titlePaths, filepath.Join(path, entry.Name()))
+		}
+	}
+	if len(titlePaths) == 0 {
+		return nil, fmt.Errorf("no titles found in '%s'", path)
+	}
+	return titlePaths, nil
+}
+
 func (mw *MainWindow) onDecryptContentsMenuItemClicked(selectedPath string) error {
 	err := wiiudownloader.DecryptContents(selectedPath, mw.progressWindow, false)
 
@@ -673,6 +876,43 @@ func (mw *MainWindow) updateTitlesInQueue() {
 	mw.queuePane.Update(false)
 }
 
+// onAddRelatedClicked queues the selected titles and every title related to
+// them, so a game can be downloaded with its update and DLC in one go.
+func (mw *MainWindow) onAddRelatedClicked() {
+	selection, err := mw.treeView.GetSelection()
+	if err != nil {
+		return
+	}
+	store, err := mw.treeView.GetModel()
+	if err != nil {
+		return
+	}
+	storeRef := store.(*gtk.ListStore)
+
+	iter, ok := storeRef.GetIterFirst()
+	for ok && iter != nil {
+		if selection.IterIsSelected(iter) {
+			if tid, err := storeRef.GetValue(iter, TITLE_ID_COLUMN); err == nil {
+				if tidStr, err := tid.GetString(); err == nil {
+					if tidNum, err := strconv.ParseUint(tidStr, 16, 64); err == nil {
+						titles := append([]wiiudownloader.TitleEntry{wiiudownloader.GetTitleEntryFromTid(tidNum)}, wiiudownloader.RelatedTitles(tidNum)...)
+						for _, title := range titles {
+							if title.TitleID != 0 && !mw.queuePane.IsTitleInQueue(title) {
+								mw.queuePane.AddTitle(title)
+							}
+						}
+					}
+				}
+				tid.Unset()
+			}
+		}
+		if !storeRef.IterNext(iter) {
+			break
+		}
+	}
+	mw.updateTitlesInQueue()
+}
+
 func (mw *MainWindow) showError(err error) {
 	glib.IdleAdd(func() {
 		mw.progressWindow.Window.Hide()
@@ -701,7 +941,28 @@ func (mw *MainWindow) onDownloadQueueClicked(selectedPath string) error {
 			}
 			tidStr := fmt.Sprintf("%016x", title.TitleID)
 			titlePath := filepath.Join(selectedPath, fmt.Sprintf("%s [%s] [%s]", normalizeFilename(title.Name), wiiudownloader.GetFormattedKind(title.TitleID), tidStr))
-			if err := wiiudownloader.DownloadTitle(tidStr, titlePath, mw.decryptContents, mw.progressWindow, mw.getDeleteEncryptedContents(), mw.client); err != nil && err != context.Canceled {
+			if mw.installToMLC {
+				// an up to date title isn't downloaded again just to be refused
+				if err := wiiudownloader.CheckMLCUpToDate(title.TitleID, mw.mlcPath, mw.client); err != nil {
+					if !errors.Is(err, wiiudownloader.ErrTitleAlreadyInstalled) {
+						return err
+					}
+					log.Println(err)
+					queueStatusChan <- true
+					return nil
+				}
+				if err := wiiudownloader.DownloadTitle(tidStr, titlePath, false, mw.progressWindow, false, mw.client); err != nil && err != context.Canceled {
+					return err
+				}
+				if !mw.progressWindow.cancelled {
+					if err := wiiudownloader.InstallToMLC(titlePath, mw.mlcPath, mw.progressWindow, mw.getDeleteEncryptedContents()); err != nil {
+						if !errors.Is(err, wiiudownloader.ErrTitleAlreadyInstalled) {
+							return err
+						}
+						log.Println(err)
+					}
+				}
+			} else if err := wiiudownloader.DownloadTitle(tidStr, titlePath, mw.decryptContents, mw.progressWindow, mw.getDeleteEncryptedContents(), mw.client); err != nil && err != context.Canceled {
 				return err
 			}
 
@@ -0,0 +1,745 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// zipUint32Max is the largest size or offset a zip entry holds without the
+// zip64 extension. A variable so tests don't need 4 GiB of files.
+var zipUint32Max int64 = 0xFFFFFFFF
+
+// tarBlockSize is the size of tar headers, file contents are padded to it
+const tarBlockSize = 512
+
+// crcCacheSize is how many file checksums the server remembers for zip archives
+const crcCacheSize = 10000
+
+// Zip record signatures and lengths, see APPNOTE.TXT
+const (
+	zipLocalHeaderSignature   = 0x04034b50
+	zipCentralHeaderSignature = 0x02014b50
+	zipDescriptorSignature    = 0x08074b50
+	zip64EndSignature         = 0x06064b50
+	zip64LocatorSignature     = 0x07064b50
+	zipEndSignature           = 0x06054b50
+
+	zipCentralHeaderLen    = 46
+	zipLocalZip64ExtraLen  = 20 // both sizes, left at 0 for the data descriptor
+	zipCentralZip64Len     = 28 // both sizes and the offset
+	zipDescriptorLen       = 16
+	zipDescriptorZip64Len  = 24
+	zipFlagDataDescriptor  = 0x8
+	zipFlagUTF8            = 0x800
+	zipVersion20           = 20
+	zipVersion45           = 45 // zip64
+	zipCreatorUnix         = 3 << 8
+	zipUnixRegular         = 0100644 << 16
+	zipUnixDirectory       = 040755<<16 | 0x10 // with the MS-DOS directory bit
+	zipMaxRecords          = 0xFFFF
+	zip64EndRecordLen      = 56
+	zip64EndRecordRestSize = zip64EndRecordLen - 12 // the record size field leaves out itself and the signature
+)
+
+// archiveEntry is a file or directory of an archived output directory.
+type archiveEntry struct {
+	name    string // slash separated path inside the output directory
+	dir     bool
+	size    int64
+	modTime time.Time
+	zip64   bool  // the zip entry needs zip64 fields
+	offset  int64 // of the zip local header
+}
+
+// archiveSegment is a piece of an archive: bytes known up front, the
+// contents of a file, or bytes built when first read because they hold the
+// checksums of files.
+type archiveSegment struct {
+	offset int64
+	size   int64
+	data   []byte
+	entry  *archiveEntry
+	build  func() ([]byte, error)
+}
+
+// Archive is a zip or tar archive of a directory, laid out up front so its
+// size is known and any part of it can be read without writing it anywhere.
+// Zip archives need the CRC-32 of every file, which is worked out while the
+// file is read from start to end or, when a part of the archive that holds
+// it is read first, by reading the file.
+type Archive struct {
+	dir      string
+	root     *os.Root
+	segments []archiveSegment
+	size     int64
+	modTime  time.Time
+	etag     string
+	crcs     *crcCache // nil for tar archives
+
+	offset    int64
+	file      *os.File
+	fileEntry *archiveEntry
+	crcEntry  *archiveEntry // file being checksummed on the way
+	crcHash   hash.Hash32
+	crcPos    int64
+}
+
+// NewArchive lays out a zip or tar archive of dir, with every path below
+// prefix. Symbolic links and other files that aren't regular are left out.
+func NewArchive(dir, prefix, format string, crcs *crcCache) (*Archive, error) {
+	entries, err := listOutputDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Archive{dir: dir, root: root}
+	// the ETag changes with the layout, so If-Range doesn't mix two layouts
+	tag := sha256.New()
+	fmt.Fprintf(tag, "%s\n%s\n", format, prefix)
+	for _, entry := range entries {
+		fmt.Fprintf(tag, "%s\n%t\n%d\n%d\n", entry.name, entry.dir, entry.size, entry.modTime.UnixNano())
+		if entry.modTime.After(a.modTime) {
+			a.modTime = entry.modTime
+		}
+	}
+	a.etag = `"` + hex.EncodeToString(tag.Sum(nil)[:16]) + `"`
+
+	switch format {
+	case "zip":
+		a.crcs = crcs
+		a.layoutZip(prefix, entries)
+	case "tar":
+		err = a.layoutTar(prefix, entries)
+	default:
+		err = fmt.Errorf("unknown archive format %q", format)
+	}
+	if err != nil {
+		root.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// listOutputDir returns the regular files and directories below dir, in
+// lexical order.
+func listOutputDir(dir string) ([]*archiveEntry, error) {
+	entries := make([]*archiveEntry, 0)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir || (!d.IsDir() && !d.Type().IsRegular()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		entry := &archiveEntry{name: filepath.ToSlash(rel), dir: d.IsDir(), modTime: info.ModTime()}
+		if !entry.dir {
+			entry.size = info.Size()
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+// archiveName is the path of an entry inside the archive, directories end
+// with a slash.
+func archiveName(prefix string, entry *archiveEntry) string {
+	name := path.Join(prefix, entry.name)
+	if entry.dir {
+		name += "/"
+	}
+	return name
+}
+
+func (a *Archive) add(segment archiveSegment) {
+	if segment.size == 0 {
+		return
+	}
+	segment.offset = a.size
+	a.segments = append(a.segments, segment)
+	a.size += segment.size
+}
+
+func (a *Archive) layoutTar(prefix string, entries []*archiveEntry) error {
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:     archiveName(prefix, entry),
+			Mode:     0644,
+			Size:     entry.size,
+			ModTime:  entry.modTime.Truncate(time.Second),
+			Typeflag: tar.TypeReg,
+		}
+		if entry.dir {
+			header.Mode = 0755
+			header.Typeflag = tar.TypeDir
+		}
+		// the tar writer writes the header right away, the contents are
+		// read from the file when the archive is
+		buf := &bytes.Buffer{}
+		if err := tar.NewWriter(buf).WriteHeader(header); err != nil {
+			return err
+		}
+		a.add(archiveSegment{size: int64(buf.Len()), data: buf.Bytes()})
+		a.add(archiveSegment{size: entry.size, entry: entry})
+		if padding := (tarBlockSize - entry.size%tarBlockSize) % tarBlockSize; padding > 0 {
+			a.add(archiveSegment{size: padding, data: make([]byte, padding)})
+		}
+	}
+	// two zero blocks end the archive
+	a.add(archiveSegment{size: 2 * tarBlockSize, data: make([]byte, 2*tarBlockSize)})
+	return nil
+}
+
+// layoutZip lays out a zip archive storing the files uncompressed, their
+// checksums in data descriptors after them so the first bytes don't wait on
+// reading every file.
+func (a *Archive) layoutZip(prefix string, entries []*archiveEntry) {
+	var centralSize int64
+	for _, entry := range entries {
+		name := archiveName(prefix, entry)
+		entry.offset = a.size
+		entry.zip64 = entry.size >= zipUint32Max || entry.offset >= zipUint32Max
+		header := zipLocalHeader(entry, name)
+		a.add(archiveSegment{size: int64(len(header)), data: header})
+		if !entry.dir {
+			a.add(archiveSegment{size: entry.size, entry: entry})
+			size := int64(zipDescriptorLen)
+			if entry.zip64 {
+				size = zipDescriptorZip64Len
+			}
+			a.add(archiveSegment{size: size, build: func() ([]byte, error) {
+				crc, err := a.crc(entry)
+				if err != nil {
+					return nil, err
+				}
+				return zipDescriptor(entry, crc), nil
+			}})
+		}
+		centralSize += zipCentralHeaderLen + int64(len(name))
+		if entry.zip64 {
+			centralSize += zipCentralZip64Len
+		}
+	}
+
+	centralOffset := a.size
+	a.add(archiveSegment{size: centralSize, build: func() ([]byte, error) {
+		central := make([]byte, 0, centralSize)
+		for _, entry := range entries {
+			var crc uint32
+			if !entry.dir {
+				var err error
+				if crc, err = a.crc(entry); err != nil {
+					return nil, err
+				}
+			}
+			central = append(central, zipCentralHeader(entry, archiveName(prefix, entry), crc)...)
+		}
+		return central, nil
+	}})
+	end := zipEnd(len(entries), centralOffset, centralSize)
+	a.add(archiveSegment{size: int64(len(end)), data: end})
+}
+
+func zipLocalHeader(entry *archiveEntry, name string) []byte {
+	le := binary.LittleEndian
+	zip64 := entry.zip64 && !entry.dir
+	date, clock := msDosTime(entry.modTime)
+	b := le.AppendUint32(nil, zipLocalHeaderSignature)
+	b = le.AppendUint16(b, zipVersion(entry))
+	b = le.AppendUint16(b, zipFlags(entry))
+	b = le.AppendUint16(b, 0) // stored
+	b = le.AppendUint16(b, clock)
+	b = le.AppendUint16(b, date)
+	b = le.AppendUint32(b, 0) // the checksum and sizes are in the data descriptor
+	if zip64 {
+		b = le.AppendUint32(b, 0xFFFFFFFF)
+		b = le.AppendUint32(b, 0xFFFFFFFF)
+	} else {
+		b = le.AppendUint32(b, 0)
+		b = le.AppendUint32(b, 0)
+	}
+	b = le.AppendUint16(b, uint16(len(name)))
+	if zip64 {
+		b = le.AppendUint16(b, zipLocalZip64ExtraLen)
+	} else {
+		b = le.AppendUint16(b, 0)
+	}
+	b = append(b, name...)
+	if zip64 {
+		b = le.AppendUint16(b, 1) // zip64 extra field
+		b = le.AppendUint16(b, zipLocalZip64ExtraLen-4)
+		b = le.AppendUint64(b, 0)
+		b = le.AppendUint64(b, 0)
+	}
+	return b
+}
+
+func zipDescriptor(entry *archiveEntry, crc uint32) []byte {
+	le := binary.LittleEndian
+	b := le.AppendUint32(nil, zipDescriptorSignature)
+	b = le.AppendUint32(b, crc)
+	if entry.zip64 {
+		b = le.AppendUint64(b, uint64(entry.size))
+		b = le.AppendUint64(b, uint64(entry.size))
+	} else {
+		b = le.AppendUint32(b, uint32(entry.size))
+		b = le.AppendUint32(b, uint32(entry.size))
+	}
+	return b
+}
+
+func zipCentralHeader(entry *archiveEntry, name string, crc uint32) []byte {
+	le := binary.LittleEndian
+	date, clock := msDosTime(entry.modTime)
+	b := le.AppendUint32(nil, zipCentralHeaderSignature)
+	b = le.AppendUint16(b, zipCreatorUnix|zipVersion(entry))
+	b = le.AppendUint16(b, zipVersion(entry))
+	b = le.AppendUint16(b, zipFlags(entry))
+	b = le.AppendUint16(b, 0) // stored
+	b = le.AppendUint16(b, clock)
+	b = le.AppendUint16(b, date)
+	b = le.AppendUint32(b, crc)
+	if entry.zip64 {
+		b = le.AppendUint32(b, 0xFFFFFFFF)
+		b = le.AppendUint32(b, 0xFFFFFFFF)
+	} else {
+		b = le.AppendUint32(b, uint32(entry.size))
+		b = le.AppendUint32(b, uint32(entry.size))
+	}
+	b = le.AppendUint16(b, uint16(len(name)))
+	if entry.zip64 {
+		b = le.AppendUint16(b, zipCentralZip64Len)
+	} else {
+		b = le.AppendUint16(b, 0)
+	}
+	b = le.AppendUint16(b, 0) // comment
+	b = le.AppendUint16(b, 0) // disk
+	b = le.AppendUint16(b, 0) // internal attributes
+	if entry.dir {
+		b = le.AppendUint32(b, zipUnixDirectory)
+	} else {
+		b = le.AppendUint32(b, zipUnixRegular)
+	}
+	if entry.zip64 {
+		b = le.AppendUint32(b, 0xFFFFFFFF)
+	} else {
+		b = le.AppendUint32(b, uint32(entry.offset))
+	}
+	b = append(b, name...)
+	if entry.zip64 {
+		b = le.AppendUint16(b, 1) // zip64 extra field
+		b = le.AppendUint16(b, zipCentralZip64Len-4)
+		b = le.AppendUint64(b, uint64(entry.size))
+		b = le.AppendUint64(b, uint64(entry.size))
+		b = le.AppendUint64(b, uint64(entry.offset))
+	}
+	return b
+}
+
+// zipEnd returns the end of central directory record, after the zip64 one
+// and its locator when the archive is too big for it.
+func zipEnd(records int, centralOffset, centralSize int64) []byte {
+	le := binary.LittleEndian
+	var b []byte
+	if records >= zipMaxRecords || centralSize >= zipUint32Max || centralOffset >= zipUint32Max {
+		b = le.AppendUint32(b, zip64EndSignature)
+		b = le.AppendUint64(b, zip64EndRecordRestSize)
+		b = le.AppendUint16(b, zipCreatorUnix|zipVersion45)
+		b = le.AppendUint16(b, zipVersion45)
+		b = le.AppendUint32(b, 0) // disk
+		b = le.AppendUint32(b, 0) // disk of the central directory
+		b = le.AppendUint64(b, uint64(records))
+		b = le.AppendUint64(b, uint64(records))
+		b = le.AppendUint64(b, uint64(centralSize))
+		b = le.AppendUint64(b, uint64(centralOffset))
+
+		b = le.AppendUint32(b, zip64LocatorSignature)
+		b = le.AppendUint32(b, 0) // disk of the zip64 record
+		b = le.AppendUint64(b, uint64(centralOffset+centralSize))
+		b = le.AppendUint32(b, 1) // disks
+
+		b = le.AppendUint32(b, zipEndSignature)
+		b = le.AppendUint16(b, 0)
+		b = le.AppendUint16(b, 0)
+		b = le.AppendUint16(b, zipMaxRecords)
+		b = le.AppendUint16(b, zipMaxRecords)
+		b = le.AppendUint32(b, 0xFFFFFFFF)
+		b = le.AppendUint32(b, 0xFFFFFFFF)
+		return le.AppendUint16(b, 0) // comment
+	}
+	b = le.AppendUint32(b, zipEndSignature)
+	b = le.AppendUint16(b, 0) // disk
+	b = le.AppendUint16(b, 0) // disk of the central directory
+	b = le.AppendUint16(b, uint16(records))
+	b = le.AppendUint16(b, uint16(records))
+	b = le.AppendUint32(b, uint32(centralSize))
+	b = le.AppendUint32(b, uint32(centralOffset))
+	return le.AppendUint16(b, 0) // comment
+}
+
+func zipVersion(entry *archiveEntry) uint16 {
+	if entry.zip64 {
+		return zipVersion45
+	}
+	return zipVersion20
+}
+
+func zipFlags(entry *archiveEntry) uint16 {
+	if entry.dir {
+		return zipFlagUTF8
+	}
+	return zipFlagUTF8 | zipFlagDataDescriptor
+}
+
+// msDosTime returns the MS-DOS date and time zip headers store, which
+// start in 1980.
+func msDosTime(t time.Time) (date, clock uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, t.Location())
+	}
+	date = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	clock = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+	return date, clock
+}
+
+// Size returns the length of the archive.
+func (a *Archive) Size() int64 {
+	return a.size
+}
+
+// ModTime returns the time the newest file was modified.
+func (a *Archive) ModTime() time.Time {
+	return a.modTime
+}
+
+// ETag returns a strong entity tag of the archive's layout.
+func (a *Archive) ETag() string {
+	return a.etag
+}
+
+// Read reads the archive at the current offset, stopping at the end of a
+// segment.
+func (a *Archive) Read(p []byte) (int, error) {
+	if a.offset >= a.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(a.segments), func(i int) bool {
+		return a.segments[i].offset+a.segments[i].size > a.offset
+	})
+	segment := &a.segments[i]
+	rel := a.offset - segment.offset
+	if int64(len(p)) > segment.size-rel {
+		p = p[:segment.size-rel]
+	}
+
+	var n int
+	var err error
+	switch {
+	case segment.entry != nil:
+		n, err = a.readFile(segment.entry, p, rel)
+	case segment.data == nil && segment.build != nil:
+		if segment.data, err = segment.build(); err != nil {
+			segment.data = nil
+			return 0, err
+		}
+		if int64(len(segment.data)) != segment.size {
+			return 0, fmt.Errorf("archive segment at %d is %d bytes instead of %d", segment.offset, len(segment.data), segment.size)
+		}
+		n = copy(p, segment.data[rel:])
+	default:
+		n = copy(p, segment.data[rel:])
+	}
+	a.offset += int64(n)
+	return n, err
+}
+
+// readFile reads a file of the archive at off, checksumming it on the way
+// for zip archives while it is read from the start.
+func (a *Archive) readFile(entry *archiveEntry, p []byte, off int64) (int, error) {
+	if a.fileEntry != entry {
+		a.closeFile()
+		file, err := a.root.Open(filepath.FromSlash(entry.name))
+		if err != nil {
+			return 0, err
+		}
+		a.file, a.fileEntry = file, entry
+	}
+
+	n, err := a.file.ReadAt(p, off)
+	if err == io.EOF {
+		if n < len(p) {
+			return n, fmt.Errorf("%s got shorter while it was archived", entry.name)
+		}
+		err = nil
+	}
+
+	if a.crcs != nil {
+		if off == 0 {
+			a.crcEntry, a.crcHash, a.crcPos = entry, crc32.NewIEEE(), 0
+		}
+		if a.crcEntry == entry && a.crcPos == off {
+			a.crcHash.Write(p[:n])
+			a.crcPos += int64(n)
+			if a.crcPos == entry.size {
+				a.crcs.put(a.crcKey(entry), a.crcHash.Sum32())
+				a.crcEntry = nil
+			}
+		}
+	}
+	return n, err
+}
+
+// crc returns the CRC-32 of a file, reading it unless it was checksummed
+// before.
+func (a *Archive) crc(entry *archiveEntry) (uint32, error) {
+	key := a.crcKey(entry)
+	if crc, ok := a.crcs.get(key); ok {
+		return crc, nil
+	}
+
+	file, err := a.root.Open(filepath.FromSlash(entry.name))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	hash := crc32.NewIEEE()
+	if n, err := io.Copy(hash, io.LimitReader(file, entry.size)); err != nil {
+		return 0, err
+	} else if n != entry.size {
+		return 0, fmt.Errorf("%s got shorter while it was archived", entry.name)
+	}
+	crc := hash.Sum32()
+	a.crcs.put(key, crc)
+	return crc, nil
+}
+
+func (a *Archive) crcKey(entry *archiveEntry) crcKey {
+	return crcKey{path: filepath.Join(a.dir, filepath.FromSlash(entry.name)), size: entry.size, modTime: entry.modTime.UnixNano()}
+}
+
+// Seek moves the offset the next Read starts at.
+func (a *Archive) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += a.offset
+	case io.SeekEnd:
+		offset += a.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	a.offset = offset
+	return offset, nil
+}
+
+func (a *Archive) closeFile() {
+	if a.file != nil {
+		a.file.Close()
+		a.file, a.fileEntry = nil, nil
+	}
+}
+
+// Close closes the files the archive has open.
+func (a *Archive) Close() error {
+	a.closeFile()
+	return a.root.Close()
+}
+
+// crcKey identifies a version of a file.
+type crcKey struct {
+	path    string
+	size    int64
+	modTime int64
+}
+
+// crcCache remembers the CRC-32 of files, so resuming a zip archive doesn't
+// read again the files before the part asked for.
+type crcCache struct {
+	mu   sync.Mutex
+	crcs map[crcKey]uint32
+}
+
+func newCRCCache() *crcCache {
+	return &crcCache{crcs: make(map[crcKey]uint32)}
+}
+
+func (c *crcCache) get(key crcKey) (uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	crc, ok := c.crcs[key]
+	return crc, ok
+}
+
+func (c *crcCache) put(key crcKey, crc uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.crcs) >= crcCacheSize {
+		c.crcs = make(map[crcKey]uint32)
+	}
+	c.crcs[key] = crc
+}
+
+// completedJob returns a completed job, whose files can be downloaded.
+func (s *Server) completedJob(jobID string) (*DownloadJob, error) {
+	job, err := s.findJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	if job.state() != statusCompleted {
+		return nil, &apiError{http.StatusBadRequest, "Only completed jobs can be downloaded"}
+	}
+	return job, nil
+}
+
+// outputDirError is the error of a job's output directory that can't be read.
+func outputDirError(job *DownloadJob, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return &apiError{http.StatusNotFound, "The job's files were deleted"}
+	}
+	log.Printf("Failed to read the files of job %s: %v", job.ID, err)
+	return &apiError{http.StatusInternalServerError, "Failed to read the job's files"}
+}
+
+// handleDownloadArchive streams the output directory of a completed job as
+// a zip or tar archive, with Range requests for resuming.
+func (s *Server) handleDownloadArchive(w http.ResponseWriter, r *http.Request) {
+	job, err := s.completedJob(mux.Vars(r)["id"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "zip"
+	}
+	contentType := map[string]string{"zip": "application/zip", "tar": "application/x-tar"}[format]
+	if contentType == "" {
+		writeJSONError(w, &apiError{http.StatusBadRequest, "Invalid format. Supported: zip, tar"})
+		return
+	}
+
+	archive, err := NewArchive(job.OutputDir, job.ID, format, s.crcs)
+	if err != nil {
+		writeJSONError(w, outputDirError(job, err))
+		return
+	}
+	defer archive.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(job.ID+"."+format))
+	w.Header().Set("ETag", archive.ETag())
+	// keep nginx from copying the archive to a temporary file first
+	w.Header().Set("X-Accel-Buffering", "no")
+	http.ServeContent(w, r, "", archive.ModTime(), archive)
+}
+
+// handleListJobFiles lists the files in the output directory of a completed job.
+func (s *Server) handleListJobFiles(w http.ResponseWriter, r *http.Request) {
+	job, err := s.completedJob(mux.Vars(r)["id"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	entries, err := listOutputDir(job.OutputDir)
+	if err != nil {
+		writeJSONError(w, outputDirError(job, err))
+		return
+	}
+
+	files := make([]map[string]interface{}, 0, len(entries))
+	var totalSize int64
+	for _, entry := range entries {
+		if entry.dir {
+			continue
+		}
+		files = append(files, map[string]interface{}{
+			"path":     entry.name,
+			"size":     entry.size,
+			"modified": entry.modTime.UTC().Format(time.RFC3339),
+		})
+		totalSize += entry.size
+	}
+
+	response := map[string]interface{}{
+		"job_id":     job.ID,
+		"count":      len(files),
+		"total_size": totalSize,
+		"files":      files,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleGetJobFile serves a file from the output directory of a completed
+// job. Paths leaving the directory are refused by os.Root.
+func (s *Server) handleGetJobFile(w http.ResponseWriter, r *http.Request) {
+	job, err := s.completedJob(mux.Vars(r)["id"])
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	root, err := os.OpenRoot(job.OutputDir)
+	if err != nil {
+		writeJSONError(w, outputDirError(job, err))
+		return
+	}
+	defer root.Close()
+
+	name := mux.Vars(r)["path"]
+	file, err := root.Open(filepath.FromSlash(name))
+	if err != nil {
+		writeJSONError(w, &apiError{http.StatusNotFound, "File not found"})
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		writeJSONError(w, &apiError{http.StatusNotFound, "File not found"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(path.Base(name)))
+	w.Header().Set("X-Accel-Buffering", "no")
+	http.ServeContent(w, r, "", info.ModTime(), file)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API token scopes, admin grants every other one
+const (
+	scopeTitlesRead      = "titles:read"
+	scopeDownloadsRead   = "downloads:read"
+	scopeDownloadsStart  = "downloads:start"
+	scopeDownloadsCancel = "downloads:cancel"
+	scopeAdmin           = "admin"
+)
+
+var apiScopes = []string{scopeTitlesRead, scopeDownloadsRead, scopeDownloadsStart, scopeDownloadsCancel, scopeAdmin}
+
+// APIToken is a client allowed to use the API, as configured in the tokens file.
+type APIToken struct {
+	Name       string   `json:"name"`
+	Token      string   `json:"token"`
+	Scopes     []string `json:"scopes"`
+	RateLimit  int      `json:"rate_limit,omitempty"`  // requests per minute, 0 for no limit
+	DailyQuota int      `json:"daily_quota,omitempty"` // downloads started per UTC day, 0 for no limit
+
+	mu         sync.Mutex
+	allowance  float64 // requests left in the rate limit bucket
+	lastRefill time.Time
+	quotaDay   string
+	quotaUsed  int
+}
+
+// HasScope reports whether the token grants a scope.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// allowRequest takes a request from the rate limit bucket, which refills
+// continuously and holds at most a minute of requests. When it is empty it
+// returns how long until the next request is allowed.
+func (t *APIToken) allowRequest(now time.Time) (bool, time.Duration) {
+	if t.RateLimit <= 0 {
+		return true, 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	perSecond := float64(t.RateLimit) / 60
+	if t.lastRefill.IsZero() {
+		t.allowance = float64(t.RateLimit)
+	} else {
+		t.allowance = math.Min(float64(t.RateLimit), t.allowance+now.Sub(t.lastRefill).Seconds()*perSecond)
+	}
+	t.lastRefill = now
+	if t.allowance < 1 {
+		return false, time.Duration((1 - t.allowance) / perSecond * float64(time.Second))
+	}
+	t.allowance--
+	return true, 0
+}
+
+// reserveDownload counts a download against the daily quota, reporting
+// whether the quota allowed it.
+func (t *APIToken) reserveDownload(now time.Time) bool {
+	if t.DailyQuota <= 0 {
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if day := now.UTC().Format("2006-01-02"); day != t.quotaDay {
+		t.quotaDay, t.quotaUsed = day, 0
+	}
+	if t.quotaUsed >= t.DailyQuota {
+		return false
+	}
+	t.quotaUsed++
+	return true
+}
+
+// releaseDownload gives back a download reserved for a job that didn't start.
+func (t *APIToken) releaseDownload() {
+	if t.DailyQuota <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.quotaUsed > 0 {
+		t.quotaUsed--
+	}
+}
+
+// TokenStore holds the API tokens, looked up by the SHA-256 of the token so
+// the comparison doesn't depend on how much of a guess was right.
+type TokenStore struct {
+	tokens map[[sha256.Size]byte]*APIToken
+}
+
+// tokensConfig is the format of the tokens file and WIIU_API_TOKENS.
+type tokensConfig struct {
+	Tokens []*APIToken `json:"tokens"`
+}
+
+// ParseTokenStore reads tokens in the tokensConfig format.
+func ParseTokenStore(data []byte) (*TokenStore, error) {
+	var config tokensConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid tokens configuration: %w", err)
+	}
+	store := &TokenStore{tokens: make(map[[sha256.Size]byte]*APIToken)}
+	for i, token := range config.Tokens {
+		if token.Name == "" {
+			token.Name = fmt.Sprintf("token %d", i+1)
+		}
+		if len(token.Token) < 16 {
+			return nil, fmt.Errorf("%s: tokens must be at least 16 characters long", token.Name)
+		}
+		if len(token.Scopes) == 0 {
+			return nil, fmt.Errorf("%s: no scopes, expected some of %s", token.Name, strings.Join(apiScopes, ", "))
+		}
+		for _, scope := range token.Scopes {
+			if !isAPIScope(scope) {
+				return nil, fmt.Errorf("%s: unknown scope %q, expected %s", token.Name, scope, strings.Join(apiScopes, ", "))
+			}
+		}
+		if token.RateLimit < 0 || token.DailyQuota < 0 {
+			return nil, fmt.Errorf("%s: rate_limit and daily_quota can't be negative", token.Name)
+		}
+		hash := sha256.Sum256([]byte(token.Token))
+		if _, ok := store.tokens[hash]; ok {
+			return nil, fmt.Errorf("%s: the same token is configured twice", token.Name)
+		}
+		store.tokens[hash] = token
+	}
+	return store, nil
+}
+
+// LoadTokenStore reads the tokens of a file, see ParseTokenStore.
+func LoadTokenStore(path string) (*TokenStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseTokenStore(data)
+}
+
+// Lookup returns the token with a value, or nil.
+func (ts *TokenStore) Lookup(value string) *APIToken {
+	return ts.tokens[sha256.Sum256([]byte(value))]
+}
+
+// Len returns the number of tokens.
+func (ts *TokenStore) Len() int {
+	return len(ts.tokens)
+}
+
+func isAPIScope(scope string) bool {
+	for _, s := range apiScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenContextKey struct{}
+
+// requestToken returns the token a request was authorized with, or nil when
+// authentication is disabled.
+func requestToken(r *http.Request) *APIToken {
+	token, _ := r.Context().Value(tokenContextKey{}).(*APIToken)
+	return token
+}
+
+// credentials returns the token sent with a request: a bearer token, an
+// X-API-Key header, or for EventSource and WebSocket clients, which can't
+// set headers, the access_token query parameter.
+func credentials(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return token
+	}
+	if token := r.Header.Get("X-API-Key"); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// require wraps a handler so it only runs for requests allowed the scope.
+func (s *Server) require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := s.authorize(w, r, scope)
+		if !ok {
+			return
+		}
+		if token != nil {
+			r = r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, token))
+		}
+		next(w, r)
+	}
+}
+
+// authorize checks the credentials of a request for a scope, writing the
+// error response when they aren't enough. Without a tokens configuration
+// everything but the admin scope is open, the admin scope then needs the
+// -admin-token.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, scope string) (*APIToken, bool) {
+	value := credentials(r)
+	if scope == scopeAdmin && s.adminToken != "" && subtle.ConstantTimeCompare([]byte(value), []byte(s.adminToken)) == 1 {
+		return nil, true
+	}
+	if s.tokens == nil {
+		switch {
+		case scope != scopeAdmin:
+			return nil, true
+		case s.adminToken == "":
+			writeAuthError(w, http.StatusForbidden, "Admin endpoints are disabled, start the server with -admin-token")
+		default:
+			writeAuthError(w, http.StatusUnauthorized, "Invalid admin token")
+		}
+		return nil, false
+	}
+
+	if value == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="wiiu-api"`)
+		writeAuthError(w, http.StatusUnauthorized, "Missing API token")
+		return nil, false
+	}
+	token := s.tokens.Lookup(value)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="wiiu-api", error="invalid_token"`)
+		writeAuthError(w, http.StatusUnauthorized, "Invalid API token")
+		return nil, false
+	}
+	if !token.HasScope(scope) {
+		writeAuthError(w, http.StatusForbidden, fmt.Sprintf("The token lacks the %s scope", scope))
+		return nil, false
+	}
+	if ok, wait := token.allowRequest(time.Now()); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		writeAuthError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+		return nil, false
+	}
+	return token, true
+}
+
+// isAdmin reports whether a request was sent with admin credentials, a token
+// with the admin scope or the -admin-token.
+func (s *Server) isAdmin(r *http.Request) bool {
+	if token := requestToken(r); token != nil {
+		return token.HasScope(scopeAdmin)
+	}
+	return s.adminToken != "" && subtle.ConstantTimeCompare([]byte(credentials(r)), []byte(s.adminToken)) == 1
+}
+
+// startDownloadAs starts a download counted against the daily quota of the
+// token that asked for it. Only admins may queue jobs ahead of the others.
+func (s *Server) startDownloadAs(token *APIToken, admin bool, req downloadRequest) (*DownloadJob, error) {
+	// priorities out of range are refused by startDownload
+	if req.Priority > 0 && req.Priority <= maxPriority && !admin {
+		return nil, &apiError{http.StatusForbidden, "Priorities above 0 need the admin scope"}
+	}
+	if token != nil && !token.reserveDownload(time.Now()) {
+		return nil, &apiError{http.StatusTooManyRequests, "Daily download quota exceeded"}
+	}
+	job, err := s.startDownload(req)
+	if err != nil && token != nil {
+		token.releaseDownload()
+	}
+	return job, err
+}
+
+func writeAuthError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": message,
+	})
+}
+
+// CORSPolicy decides which origins browsers may call the API from.
+type CORSPolicy struct {
+	any     bool
+	origins map[string]bool
+}
+
+// ParseCORSPolicy reads a comma separated list of origins, "*" allows any.
+func ParseCORSPolicy(list string) (*CORSPolicy, error) {
+	policy := &CORSPolicy{origins: make(map[string]bool)}
+	for _, origin := range strings.Split(list, ",") {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		switch {
+		case origin == "":
+		case origin == "*":
+			policy.any = true
+		case !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://"):
+			return nil, fmt.Errorf("invalid CORS origin %q, expected like https://example.com", origin)
+		default:
+			policy.origins[strings.ToLower(origin)] = true
+		}
+	}
+	return policy, nil
+}
+
+// isSameOrigin reports whether a request origin is the host the request was
+// sent to, pages served by the API itself.
+func isSameOrigin(origin string, r *http.Request) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, r.Host)
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for a request
+// origin, "" if it isn't allowed.
+func (p *CORSPolicy) allowOrigin(origin string) string {
+	if p.any {
+		return "*"
+	}
+	if origin != "" && p.origins[strings.ToLower(origin)] {
+		return origin
+	}
+	return ""
+}
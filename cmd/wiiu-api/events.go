@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// progressEventInterval is the shortest time between two progress events of a job
+	progressEventInterval = 250 * time.Millisecond
+	// eventsKeepAlive is how often an idle event stream gets a comment, so
+	// proxies don't close it
+	eventsKeepAlive = 15 * time.Second
+	// eventsBuffer is how many events a subscriber can fall behind before it
+	// is disconnected
+	eventsBuffer = 64
+)
+
+// Job event types, the status events carry the same fields as GET /api/download/{id}
+const (
+	eventStatus     = "status"
+	eventProgress   = "progress"
+	eventFileDone   = "file_done"
+	eventDecryption = "decryption"
+)
+
+// JobEvent is something that happened to a download job.
+type JobEvent struct {
+	Type  string
+	JobID string
+	Data  map[string]interface{}
+}
+
+// EventBroker passes job events to the subscribers interested in them.
+type EventBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan JobEvent]string // the job ID to send events of, "" for all jobs
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: make(map[chan JobEvent]string)}
+}
+
+// Subscribe returns a channel receiving the events of a job, or of every job
+// if jobID is empty. The channel is closed by Unsubscribe, or when the
+// subscriber falls too far behind.
+func (b *EventBroker) Subscribe(jobID string) chan JobEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	events := make(chan JobEvent, eventsBuffer)
+	b.subscribers[events] = jobID
+	return events
+}
+
+// Unsubscribe stops sending events to a channel returned by Subscribe.
+func (b *EventBroker) Unsubscribe(events chan JobEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[events]; ok {
+		delete(b.subscribers, events)
+		close(events)
+	}
+}
+
+// Publish sends an event without waiting on any subscriber. A nil broker
+// drops every event.
+func (b *EventBroker) Publish(event JobEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for events, jobID := range b.subscribers {
+		if jobID != "" && jobID != event.JobID {
+			continue
+		}
+		select {
+		case events <- event:
+		default:
+			delete(b.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// jobStatusChanged saves a job and tells the subscribers about its new
+// status, and the webhook once it finished.
+func (s *Server) jobStatusChanged(job *DownloadJob) {
+	s.saveJob(job)
+	s.events.Publish(JobEvent{Type: eventStatus, JobID: job.ID, Data: s.jobStatus(job)})
+	s.queueWebhook(job)
+}
+
+func (s *Server) handleJobEvents(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+
+	s.jobsMutex.RLock()
+	job, exists := s.jobs[jobID]
+	s.jobsMutex.RUnlock()
+
+	if !exists {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	// subscribe before taking the snapshot so no change is missed in between
+	events := s.events.Subscribe(jobID)
+	defer s.events.Unsubscribe(events)
+	s.streamEvents(w, r, events, []JobEvent{{Type: eventStatus, JobID: jobID, Data: s.jobStatus(job)}}, true)
+}
+
+func (s *Server) handleAllJobEvents(w http.ResponseWriter, r *http.Request) {
+	events := s.events.Subscribe("")
+	defer s.events.Unsubscribe(events)
+	s.streamEvents(w, r, events, nil, false)
+}
+
+// streamEvents writes events as Server-Sent Events until the client goes
+// away, or for a single job once it reached a final status.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, events chan JobEvent, initial []JobEvent, untilFinal bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+
+	// write sends an event, reporting whether the stream should go on
+	write := func(event JobEvent) bool {
+		data, err := json.Marshal(event.Data)
+		if err != nil {
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return !(untilFinal && event.Type == eventStatus && isFinalStatus(fmt.Sprint(event.Data["status"])))
+	}
+
+	for _, event := range initial {
+		if !write(event) {
+			return
+		}
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				// fell too far behind, the client can reconnect and start over
+				return
+			}
+			if !write(event) {
+				return
+			}
+		}
+	}
+}
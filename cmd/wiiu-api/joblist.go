@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// defaultJobsLimit is how many jobs GET /api/downloads returns without a limit
+	defaultJobsLimit = 50
+	// maxJobsLimit is the most jobs GET /api/downloads returns at once
+	maxJobsLimit = 500
+)
+
+// jobFilter picks the jobs listed or removed by the query parameters of
+// /api/downloads.
+type jobFilter struct {
+	statuses map[string]bool // every status if empty
+	titleID  uint64          // every title if 0
+	since    time.Time       // started at or after, if set
+	until    time.Time       // started before, if set
+}
+
+// jobSnapshot is the state of a job a filter and sort look at, taken at once.
+type jobSnapshot struct {
+	job     *DownloadJob
+	status  string
+	endTime *time.Time
+}
+
+// jobSorts are the sort parameters of GET /api/downloads, ordering jobs
+// ascending. Ties keep the start time order.
+var jobSorts = map[string]func(a, b jobSnapshot) bool{
+	"start_time": func(a, b jobSnapshot) bool {
+		return a.job.StartTime.Before(b.job.StartTime)
+	},
+	"end_time": func(a, b jobSnapshot) bool {
+		// unfinished jobs come after the finished ones
+		switch {
+		case a.endTime == nil || b.endTime == nil:
+			return a.endTime != nil && b.endTime == nil
+		default:
+			return a.endTime.Before(*b.endTime)
+		}
+	},
+	"priority": func(a, b jobSnapshot) bool {
+		return a.job.Priority < b.job.Priority
+	},
+	"title_id": func(a, b jobSnapshot) bool {
+		return strings.ToUpper(a.job.TitleID) < strings.ToUpper(b.job.TitleID)
+	},
+	"status": func(a, b jobSnapshot) bool {
+		return a.status < b.status
+	},
+}
+
+// parseJobFilter reads the status, title_id, since and until parameters.
+// status is a comma separated list, since and until are RFC 3339 times.
+func parseJobFilter(r *http.Request) (*jobFilter, error) {
+	query := r.URL.Query()
+	filter := &jobFilter{statuses: make(map[string]bool)}
+
+	if statuses := query.Get("status"); statuses != "" {
+		for _, status := range strings.Split(statuses, ",") {
+			status = strings.TrimSpace(status)
+			if _, ok := jobTransitions[status]; !ok && !isFinalStatus(status) {
+				return nil, &apiError{http.StatusBadRequest, "Invalid status. Supported: pending, downloading, paused, completed, failed, cancelled, or a comma separated list"}
+			}
+			filter.statuses[status] = true
+		}
+	}
+
+	if titleID := query.Get("title_id"); titleID != "" {
+		tid, err := strconv.ParseUint(titleID, 16, 64)
+		if err != nil || len(titleID) != 16 {
+			return nil, &apiError{http.StatusBadRequest, "Invalid title ID format. Must be 16-digit hexadecimal."}
+		}
+		filter.titleID = tid
+	}
+
+	for _, param := range []struct {
+		name string
+		time *time.Time
+	}{{"since", &filter.since}, {"until", &filter.until}} {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, &apiError{http.StatusBadRequest, fmt.Sprintf("Invalid %s time. Must be RFC 3339, like 2025-11-26T19:30:00Z", param.name)}
+		}
+		*param.time = t
+	}
+	return filter, nil
+}
+
+// matches reports whether a job passes the filter.
+func (f *jobFilter) matches(snapshot jobSnapshot) bool {
+	if len(f.statuses) > 0 && !f.statuses[snapshot.status] {
+		return false
+	}
+	if f.titleID != 0 {
+		if tid, err := strconv.ParseUint(snapshot.job.TitleID, 16, 64); err != nil || tid != f.titleID {
+			return false
+		}
+	}
+	if !f.since.IsZero() && snapshot.job.StartTime.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !snapshot.job.StartTime.Before(f.until) {
+		return false
+	}
+	return true
+}
+
+// filterJobs returns the jobs passing a filter, oldest first.
+func (s *Server) filterJobs(filter *jobFilter) []jobSnapshot {
+	s.jobsMutex.RLock()
+	jobs := make([]*DownloadJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	s.jobsMutex.RUnlock()
+
+	matched := make([]jobSnapshot, 0, len(jobs))
+	for _, job := range jobs {
+		job.mu.RLock()
+		snapshot := jobSnapshot{job: job, status: job.Status, endTime: job.EndTime}
+		job.mu.RUnlock()
+		if filter.matches(snapshot) {
+			matched = append(matched, snapshot)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return jobSorts["start_time"](matched[i], matched[j])
+	})
+	return matched
+}
+
+// handleListJobs lists the jobs passing the filter of parseJobFilter, sorted
+// by the sort parameter in the order parameter, newest first by default, a
+// page of limit jobs after offset at a time.
+func (s *Server) handleListJobs(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseJobFilter(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "start_time"
+	}
+	less, ok := jobSorts[sortBy]
+	if !ok {
+		writeJSONError(w, &apiError{http.StatusBadRequest, "Invalid sort. Supported: start_time, end_time, priority, title_id, status"})
+		return
+	}
+	order := query.Get("order")
+	if order == "" {
+		order = "desc"
+	}
+	if order != "asc" && order != "desc" {
+		writeJSONError(w, &apiError{http.StatusBadRequest, "Invalid order. Supported: asc, desc"})
+		return
+	}
+
+	limit := defaultJobsLimit
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxJobsLimit {
+			writeJSONError(w, &apiError{http.StatusBadRequest, fmt.Sprintf("Invalid limit. Must be between 1 and %d", maxJobsLimit)})
+			return
+		}
+	}
+	offset := 0
+	if value := query.Get("offset"); value != "" {
+		if offset, err = strconv.Atoi(value); err != nil || offset < 0 {
+			writeJSONError(w, &apiError{http.StatusBadRequest, "Invalid offset. Must be 0 or more"})
+			return
+		}
+	}
+
+	matched := s.filterJobs(filter)
+	sort.SliceStable(matched, func(i, j int) bool {
+		return less(matched[i], matched[j])
+	})
+	if order == "desc" {
+		slices.Reverse(matched)
+	}
+
+	page := matched[min(offset, len(matched)):min(offset+limit, len(matched))]
+	jobs := make([]map[string]interface{}, len(page))
+	for i, snapshot := range page {
+		jobs[i] = s.jobStatus(snapshot.job)
+	}
+
+	response := map[string]interface{}{
+		"count":  len(jobs),
+		"total":  len(matched),
+		"offset": offset,
+		"limit":  limit,
+		"jobs":   jobs,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// errDeleteFilesForbidden is returned when delete_files is asked for without
+// admin credentials, removing the jobs only needs downloads:cancel.
+var errDeleteFilesForbidden = &apiError{http.StatusForbidden, "Deleting the files of jobs needs the admin scope"}
+
+func (s *Server) handleRemoveJob(w http.ResponseWriter, r *http.Request) {
+	jobID := mux.Vars(r)["id"]
+	deleteFiles := r.URL.Query().Get("delete_files") == "true"
+	if deleteFiles && !s.isAdmin(r) {
+		writeJSONError(w, errDeleteFilesForbidden)
+		return
+	}
+
+	job, err := s.findJob(jobID)
+	if err == nil {
+		err = s.removeJob(job, deleteFiles)
+	}
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"status":        "removed",
+		"job_id":        jobID,
+		"files_deleted": deleteFiles,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleRemoveJobs removes the finished jobs passing the filter of
+// parseJobFilter, every finished job without one. Jobs that can't be removed
+// are left out of the response.
+func (s *Server) handleRemoveJobs(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseJobFilter(r)
+	if err != nil {
+		writeJSONError(w, err)
+		return
+	}
+	for status := range filter.statuses {
+		if !isFinalStatus(status) {
+			writeJSONError(w, &apiError{http.StatusBadRequest, "Only completed, failed or cancelled jobs can be removed"})
+			return
+		}
+	}
+	if len(filter.statuses) == 0 {
+		filter.statuses = map[string]bool{statusCompleted: true, statusFailed: true, statusCancelled: true}
+	}
+	deleteFiles := r.URL.Query().Get("delete_files") == "true"
+	if deleteFiles && !s.isAdmin(r) {
+		writeJSONError(w, errDeleteFilesForbidden)
+		return
+	}
+
+	removed := make([]string, 0)
+	for _, snapshot := range s.filterJobs(filter) {
+		if err := s.removeJob(snapshot.job, deleteFiles); err != nil {
+			log.Printf("Not removing job %s: %v", snapshot.job.ID, err)
+			continue
+		}
+		removed = append(removed, snapshot.job.ID)
+	}
+
+	response := map[string]interface{}{
+		"count":         len(removed),
+		"removed":       removed,
+		"files_deleted": deleteFiles,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// removeJob takes a finished job off the server and its journal, deleting
+// its output directory too if deleteFiles is set.
+func (s *Server) removeJob(job *DownloadJob, deleteFiles bool) error {
+	if !isFinalStatus(job.state()) {
+		return &apiError{http.StatusBadRequest, "Only completed, failed or cancelled jobs can be removed"}
+	}
+	// a cancelled download may still be winding down
+	if !job.running.TryLock() {
+		return &apiError{http.StatusConflict, "The job is still stopping, try again"}
+	}
+	defer job.running.Unlock()
+
+	if deleteFiles {
+		if err := s.removeJobFiles(job); err != nil {
+			log.Printf("Failed to delete the files of job %s: %v", job.ID, err)
+			return &apiError{http.StatusInternalServerError, fmt.Sprintf("Failed to delete the job's files: %v", err)}
+		}
+	}
+
+	s.jobsMutex.Lock()
+	if s.jobs[job.ID] != job {
+		// removed by another request in the meantime
+		s.jobsMutex.Unlock()
+		return &apiError{http.StatusNotFound, "Job not found"}
+	}
+	delete(s.jobs, job.ID)
+	store := s.store
+	s.jobsMutex.Unlock()
+
+	// a webhook still being delivered would save the job again
+	job.mu.Lock()
+	job.removed = true
+	job.mu.Unlock()
+	if store != nil {
+		if err := store.Remove(job.ID); err != nil {
+			log.Printf("Failed to remove job %s from the journal: %v", job.ID, err)
+		}
+	}
+	return nil
+}
+
+// removeJobFiles deletes the output directory of a job, refusing to touch
+// anything outside the downloads directory.
+func (s *Server) removeJobFiles(job *DownloadJob) error {
+	downloadsDir, err := filepath.Abs(s.downloadsDir)
+	if err != nil {
+		return err
+	}
+	outputDir, err := filepath.Abs(job.OutputDir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(downloadsDir, outputDir)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside the downloads directory", job.OutputDir)
+	}
+	return os.RemoveAll(outputDir)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Job statuses, a job only moves between them along jobTransitions
+const (
+	statusPending     = "pending"
+	statusDownloading = "downloading"
+	statusPaused      = "paused"
+	statusCompleted   = "completed"
+	statusFailed      = "failed"
+	statusCancelled   = "cancelled"
+)
+
+// jobTransitions lists the statuses a job can move to from each status. The
+// final statuses, completed, failed and cancelled, lead nowhere.
+var jobTransitions = map[string][]string{
+	statusPending:     {statusDownloading, statusPaused, statusCancelled, statusFailed},
+	statusDownloading: {statusCompleted, statusFailed, statusPaused, statusCancelled},
+	statusPaused:      {statusPending, statusCancelled},
+}
+
+// transitionError is returned when a job can't move to a status from the one
+// it has.
+type transitionError struct {
+	from, to string
+}
+
+func (e *transitionError) Error() string {
+	return fmt.Sprintf("a %s job can't become %s", e.from, e.to)
+}
+
+// isFinalStatus reports whether a job with this status won't change anymore.
+func isFinalStatus(status string) bool {
+	return status == statusCompleted || status == statusFailed || status == statusCancelled
+}
+
+func canTransition(from, to string) bool {
+	for _, status := range jobTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+// state returns the status of a job.
+func (j *DownloadJob) state() string {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return j.Status
+}
+
+// transition moves a job to a status if jobTransitions allows it, setting
+// its end time once the status is final. update, if not nil, runs under the
+// same lock to change other fields along with the status.
+func (j *DownloadJob) transition(to string, update func()) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !canTransition(j.Status, to) {
+		return &transitionError{from: j.Status, to: to}
+	}
+	j.Status = to
+	if isFinalStatus(to) {
+		now := time.Now()
+		j.EndTime = &now
+	}
+	if update != nil {
+		update()
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// jobStoreFile is the default journal name, inside the downloads directory
+const jobStoreFile = ".jobs.jsonl"
+
+// JobStore keeps download jobs across restarts in a journal of JSON lines,
+// every change of a job appends its new state and removing it a
+// removedJob line. Opening the journal keeps the last state of each job and
+// rewrites the file with only those.
+type JobStore struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// removedJob is the journal line of a removed job.
+type removedJob struct {
+	ID      string `json:"id"`
+	Removed bool   `json:"removed"`
+}
+
+// OpenJobStore reads the jobs saved in path and opens it for more. Lines that
+// can't be parsed, like one cut short by a crash, are skipped.
+func OpenJobStore(path string) (*JobStore, map[string]*DownloadJob, error) {
+	jobs := make(map[string]*DownloadJob)
+	order := make([]string, 0)
+
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var removed removedJob
+		if err := json.Unmarshal(scanner.Bytes(), &removed); err == nil && removed.Removed {
+			delete(jobs, removed.ID)
+			continue
+		}
+		job := &DownloadJob{}
+		if err := json.Unmarshal(scanner.Bytes(), job); err != nil || job.ID == "" {
+			log.Printf("Skipping unreadable line %d of %s", line, path)
+			continue
+		}
+		if _, ok := jobs[job.ID]; !ok {
+			order = append(order, job.ID)
+		}
+		jobs[job.ID] = job
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	// Compact the journal down to the current state of every job
+	compacted := &bytes.Buffer{}
+	written := make(map[string]bool)
+	for _, id := range order {
+		// removed jobs are gone, and one added again is in order twice
+		if jobs[id] == nil || written[id] {
+			continue
+		}
+		written[id] = true
+		line, err := json.Marshal(jobs[id])
+		if err != nil {
+			return nil, nil, err
+		}
+		compacted.Write(line)
+		compacted.WriteByte('\n')
+	}
+	if err := writeFileAtomic(path, compacted.Bytes()); err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &JobStore{path: path, file: file}, jobs, nil
+}
+
+// Save appends the current state of job.
+func (js *JobStore) Save(job *DownloadJob) error {
+	line, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return js.append(line)
+}
+
+// Remove appends that a job was removed, it is left out when the journal is
+// opened again.
+func (js *JobStore) Remove(id string) error {
+	line, err := json.Marshal(removedJob{ID: id, Removed: true})
+	if err != nil {
+		return err
+	}
+	return js.append(line)
+}
+
+func (js *JobStore) append(line []byte) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if _, err := js.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return js.file.Sync()
+}
+
+// Close closes the journal, later saves fail.
+func (js *JobStore) Close() error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	return js.file.Close()
+}
+
+// interruptedJobError is the error of jobs that were running when the server stopped
+const interruptedJobError = "interrupted: the server stopped while the job was %s"
+
+// restoreJobs adds the jobs of a store to the server. Jobs that were pending
+// or downloading when the server stopped start over if resume is set, and are
+// marked failed otherwise.
+func (s *Server) restoreJobs(store *JobStore, jobs map[string]*DownloadJob, resume bool) {
+	s.jobsMutex.Lock()
+	s.store = store
+	s.jobsMutex.Unlock()
+
+	// queue resumed jobs in the order they were created
+	sorted := make([]*DownloadJob, 0, len(jobs))
+	for _, job := range jobs {
+		sorted = append(sorted, job)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].StartTime.Before(sorted[j].StartTime)
+	})
+
+	for _, job := range sorted {
+		job.ctx, job.cancel = context.WithCancel(context.Background())
+		job.progress = NewAPIProgressReporter(job)
+		job.progress.events = s.events
+
+		// nothing else sees the job until it is added to the server, so its
+		// fields are set directly up to then
+		interrupted := job.Status == statusPending || job.Status == statusDownloading
+		if interrupted && resume {
+			log.Printf("Resuming job %s", job.ID)
+			job.Status = statusPending
+			job.Error = ""
+			job.EndTime = nil
+		} else if interrupted {
+			job.Error = fmt.Sprintf(interruptedJobError, job.Status)
+			job.Status = statusFailed
+			now := time.Now()
+			job.EndTime = &now
+		}
+		webhookPending := job.Webhook != nil && job.Webhook.Status == "pending"
+
+		s.jobsMutex.Lock()
+		s.jobs[job.ID] = job
+		s.jobsMutex.Unlock()
+
+		if interrupted && resume {
+			if err := s.queue.Push(job); err != nil {
+				job.transition(statusFailed, func() {
+					job.Error = fmt.Sprintf(interruptedJobError, statusPending) + ", " + err.Error()
+				})
+			}
+		}
+		if interrupted {
+			s.saveJob(job)
+		}
+
+		switch {
+		case webhookPending:
+			// the delivery was cut short by the restart
+			go s.deliverWebhook(job)
+		case interrupted:
+			// only sent if the job failed
+			s.queueWebhook(job)
+		}
+	}
+}
+
+// saveJob writes the state of job to the store, if the server has one.
+func (s *Server) saveJob(job *DownloadJob) {
+	s.jobsMutex.RLock()
+	store := s.store
+	s.jobsMutex.RUnlock()
+	if store == nil {
+		return
+	}
+
+	// the progress reporter updates the job while the download runs
+	job.mu.RLock()
+	var err error
+	if !job.removed {
+		err = store.Save(job)
+	}
+	job.mu.RUnlock()
+	if err != nil {
+		log.Printf("Failed to save job %s: %v", job.ID, err)
+	}
+}
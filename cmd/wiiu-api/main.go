@@ -2,21 +2,26 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	wiiudownloader "github.com/Xpl0itU/WiiUDownloader"
 	"github.com/gorilla/mux"
+	"golang.org/x/net/websocket"
 )
 
 // DownloadJob represents a download task
@@ -24,8 +29,9 @@ type DownloadJob struct {
 	ID            string                 `json:"id"`
 	TitleID       string                 `json:"title_id"`
 	TitleName     string                 `json:"title_name"`
-	Status        string                 `json:"status"` // pending, downloading, completed, failed, cancelled
-	Progress      float64                `json:"progress"`
+	Status        string                 `json:"status"` // pending, downloading, paused, completed, failed, cancelled
+	Progress      float64                `json:"progress"` // 0 to 100, of the download or the decryption
+	Phase         string                 `json:"phase,omitempty"` // downloading or decrypting, empty until the download starts
 	DownloadSize  int64                  `json:"download_size"`
 	Downloaded    int64                  `json:"downloaded"`
 	Speed         string                 `json:"speed"`
@@ -36,86 +42,225 @@ type DownloadJob struct {
 	EndTime       *time.Time             `json:"end_time,omitempty"`
 	Decrypt       bool                   `json:"decrypt"`
 	DeleteEncrypted bool                 `json:"delete_encrypted"`
+	Version       int                    `json:"version"` // wiiudownloader.TITLE_VERSION_LATEST in jobs journaled before versions were resolved
+	Priority      int                    `json:"priority"` // higher priorities leave the queue first
+	CallbackURL   string                 `json:"callback_url,omitempty"`
+	Webhook       *WebhookDelivery       `json:"webhook,omitempty"`
 	ctx           context.Context        `json:"-"`
 	cancel        context.CancelFunc     `json:"-"`
 	progress      *APIProgressReporter   `json:"-"`
+	running       sync.Mutex             // held while a worker downloads the job
+	// mu guards the fields that change while the job runs, the status only
+	// changes through transition
+	mu      sync.RWMutex
+	removed bool // removed from the server, so it isn't saved anymore
 }
 
+// Download phases, the progress of a job is a percentage of its phase
+const (
+	phaseDownloading = "downloading"
+	phaseDecrypting  = "decrypting"
+)
+
+// APIProgressReporter updates a job as its download goes, under the job's
+// mutex. Like the GUI's progress window it is told how many bytes of a file
+// arrived since the last update, and adds them up per file.
 type APIProgressReporter struct {
 	job       *DownloadJob
 	startTime time.Time
-	mu        sync.RWMutex
+	events    *EventBroker // progress events are dropped while nil
+	lastEvent time.Time
+	files     map[string]*fileProgress // content files by name
+}
+
+// fileProgress is how much of a content file was downloaded.
+type fileProgress struct {
+	Downloaded int64
+	Done       bool
 }
 
 func NewAPIProgressReporter(job *DownloadJob) *APIProgressReporter {
 	return &APIProgressReporter{
 		job:       job,
 		startTime: time.Now(),
+		files:     make(map[string]*fileProgress),
 	}
 }
 
 func (a *APIProgressReporter) SetGameTitle(title string) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	a.job.mu.Lock()
+	defer a.job.mu.Unlock()
 	a.job.TitleName = title
 }
 
 func (a *APIProgressReporter) UpdateDownloadProgress(downloaded int64, filename string) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	a.job.Downloaded = downloaded
-
-	if a.job.DownloadSize > 0 {
-		a.job.Progress = float64(downloaded) / float64(a.job.DownloadSize) * 100
-
-		// Calculate speed and ETA
-		elapsed := time.Since(a.startTime).Seconds()
-		if elapsed > 0 {
-			speed := float64(downloaded) / elapsed
-			a.job.Speed = formatBytes(int64(speed)) + "/s"
-
-			if speed > 0 {
-				remaining := float64(a.job.DownloadSize-downloaded) / speed
-				a.job.ETA = formatDuration(time.Duration(remaining) * time.Second)
-			}
+	a.job.mu.Lock()
+	defer a.publishProgress(eventProgress, filename)
+	defer a.job.mu.Unlock()
+	a.file(filename).Downloaded += downloaded
+	a.updateTotals()
+}
+
+// file returns the progress of a file, adding it if it is new.
+func (a *APIProgressReporter) file(filename string) *fileProgress {
+	name := filepath.Base(filename)
+	file, ok := a.files[name]
+	if !ok {
+		file = &fileProgress{}
+		a.files[name] = file
+	}
+	return file
+}
+
+// updateTotals sums up the bytes of the .app files and works out the
+// progress, speed and ETA from them. The download size is only of the .app
+// files, the TMD, ticket, certificate and hash files aren't counted.
+func (a *APIProgressReporter) updateTotals() {
+	var total int64
+	for name, file := range a.files {
+		if strings.HasSuffix(name, ".app") {
+			total += file.Downloaded
+		}
+	}
+	a.job.Downloaded = total
+	a.job.Phase = phaseDownloading
+	if a.job.DownloadSize <= 0 {
+		return
+	}
+	a.job.Progress = math.Min(float64(total)/float64(a.job.DownloadSize)*100, 100)
+
+	elapsed := time.Since(a.startTime).Seconds()
+	if elapsed > 0 {
+		speed := float64(total) / elapsed
+		a.job.Speed = formatBytes(int64(speed)) + "/s"
+
+		if speed > 0 && total < a.job.DownloadSize {
+			remaining := float64(a.job.DownloadSize-total) / speed
+			a.job.ETA = formatDuration(time.Duration(remaining) * time.Second)
 		}
 	}
 }
 
+// UpdateDecryptionProgress takes a fraction from 0 to 1, reported like the
+// download progress from 0 to 100.
 func (a *APIProgressReporter) UpdateDecryptionProgress(progress float64) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	a.job.Progress = progress
+	a.job.mu.Lock()
+	defer a.publishProgress(eventDecryption, "")
+	defer a.job.mu.Unlock()
+	a.job.Phase = phaseDecrypting
+	a.job.Progress = math.Min(math.Max(progress*100, 0), 100)
+}
+
+// publishProgress sends a progress event, at most one every
+// progressEventInterval unless the event ends a file or the decryption.
+func (a *APIProgressReporter) publishProgress(eventType string, filename string) {
+	if a.events == nil {
+		return
+	}
+	a.job.mu.Lock()
+	final := eventType == eventFileDone || (eventType == eventDecryption && a.job.Progress >= 100)
+	if !final && time.Since(a.lastEvent) < progressEventInterval {
+		a.job.mu.Unlock()
+		return
+	}
+	a.lastEvent = time.Now()
+	data := map[string]interface{}{
+		"job_id":   a.job.ID,
+		"phase":    a.job.Phase,
+		"progress": a.job.Progress,
+	}
+	if eventType != eventDecryption {
+		data["download_size"] = a.job.DownloadSize
+		data["downloaded"] = a.job.Downloaded
+		data["speed"] = a.job.Speed
+		data["eta"] = a.job.ETA
+	}
+	if filename != "" {
+		name := filepath.Base(filename)
+		data["file"] = name
+		if file, ok := a.files[name]; ok {
+			data["file_downloaded"] = file.Downloaded
+		}
+	}
+	a.job.mu.Unlock()
+
+	a.events.Publish(JobEvent{Type: eventType, JobID: a.job.ID, Data: data})
 }
 
 func (a *APIProgressReporter) Cancelled() bool {
-	a.mu.RLock()
-	defer a.mu.RUnlock()
-	return a.job.Status == "cancelled"
+	status := a.job.state()
+	return status == statusCancelled || status == statusPaused
 }
 
 func (a *APIProgressReporter) SetCancelled() {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	a.job.Status = "cancelled"
+	a.job.transition(statusCancelled, nil)
 }
 
 func (a *APIProgressReporter) SetDownloadSize(size int64) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	a.job.mu.Lock()
+	defer a.job.mu.Unlock()
 	a.job.DownloadSize = size
 }
 
 func (a *APIProgressReporter) ResetTotals() {
-	a.mu.Lock()
-	defer a.mu.Unlock()
+	a.job.mu.Lock()
+	defer a.job.mu.Unlock()
+	a.files = make(map[string]*fileProgress)
+	a.job.DownloadSize = 0
 	a.job.Downloaded = 0
 	a.job.Progress = 0
+	a.job.Speed = ""
+	a.job.ETA = ""
+	a.job.Phase = ""
+}
+
+func (a *APIProgressReporter) MarkFileAsDone(filename string) {
+	a.job.mu.Lock()
+	a.file(filename).Done = true
+	a.job.mu.Unlock()
+	a.publishProgress(eventFileDone, filename)
+}
+
+// SetTotalDownloadedForFile sets how much of a file was downloaded, the
+// downloader starts files over at 0 when it retries them.
+func (a *APIProgressReporter) SetTotalDownloadedForFile(filename string, downloaded int64) {
+	a.job.mu.Lock()
+	defer a.job.mu.Unlock()
+	file := a.file(filename)
+	file.Downloaded = downloaded
+	file.Done = false
+	a.updateTotals()
+}
+
+// SetStartTime is called as the content files start downloading, the files
+// downloaded before then aren't listed.
+func (a *APIProgressReporter) SetStartTime(startTime time.Time) {
+	a.job.mu.Lock()
+	defer a.job.mu.Unlock()
+	a.startTime = startTime
+	a.files = make(map[string]*fileProgress)
 }
 
-func (a *APIProgressReporter) MarkFileAsDone(filename string) {}
-func (a *APIProgressReporter) SetTotalDownloadedForFile(filename string, downloaded int64) {}
-func (a *APIProgressReporter) SetStartTime(startTime time.Time) {}
+// fileList returns the progress of the content files, sorted by name.
+func (a *APIProgressReporter) fileList() []map[string]interface{} {
+	names := make([]string, 0, len(a.files))
+	for name := range a.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		files = append(files, map[string]interface{}{
+			"name":       name,
+			"downloaded": a.files[name].Downloaded,
+			"done":       a.files[name].Done,
+		})
+	}
+	return files
+}
+
+// iconCacheDir is where converted title icons are kept, below the downloads directory
+const iconCacheDir = ".icons"
 
 type Server struct {
 	router       *mux.Router
@@ -123,6 +268,23 @@ type Server struct {
 	jobsMutex    sync.RWMutex
 	downloadsDir string
 	client       *http.Client
+	adminToken   string      // admin endpoints are disabled while empty and tokens is nil
+	tokens       *TokenStore // everything but the admin endpoints is open while nil
+	cors         *CORSPolicy
+	store        *JobStore // jobs are only kept in memory while nil
+	queue        *JobQueue
+	events       *EventBroker
+	crcs         *crcCache // checksums of files served in zip archives
+
+	// latestVersion asks the CDN for the latest version of a title
+	latestVersion func(titleID string) (uint16, error)
+
+	webhookURL    string // default callback URL of jobs without one
+	webhookSecret string // webhooks are signed with it unless empty
+	webhookClient *http.Client
+	// callbackClient sends to the callback URLs of requests, refusing private
+	// addresses unless -webhook-allow-private is set
+	callbackClient *http.Client
 }
 
 func NewServer(downloadsDir string) *Server {
@@ -140,8 +302,21 @@ func NewServer(downloadsDir string) *Server {
 		jobs:         make(map[string]*DownloadJob),
 		downloadsDir: downloadsDir,
 		client:       client,
+		events:       NewEventBroker(),
+		crcs:         newCRCCache(),
+		cors:         &CORSPolicy{}, // same origin only
+		webhookClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		callbackClient: newCallbackClient(false),
+		latestVersion: func(titleID string) (uint16, error) {
+			return wiiudownloader.LatestTitleVersion(titleID, client)
+		},
 	}
 
+	server.queue = NewJobQueue(defaultQueueSize, server.processDownload)
+	server.queue.SetWorkers(defaultWorkers)
+
 	server.setupRoutes()
 	return server
 }
@@ -153,17 +328,39 @@ func (s *Server) setupRoutes() {
 	// API routes
 	api := s.router.PathPrefix("/api").Subrouter()
 
-	// OpenAPI spec
+	// OpenAPI and AsyncAPI specs
 	api.HandleFunc("/openapi.json", s.handleOpenAPISpec).Methods("GET")
+	api.HandleFunc("/asyncapi.json", s.handleAsyncAPISpec).Methods("GET")
 
 	// Titles
-	api.HandleFunc("/titles", s.handleListTitles).Methods("GET")
-	api.HandleFunc("/titles/{id}", s.handleGetTitle).Methods("GET")
+	api.HandleFunc("/titles", s.require(scopeTitlesRead, s.handleListTitles)).Methods("GET")
+	api.HandleFunc("/titles/{id}", s.require(scopeTitlesRead, s.handleGetTitle)).Methods("GET")
+	api.HandleFunc("/titles/{id}/icon", s.require(scopeTitlesRead, s.handleGetTitleIcon)).Methods("GET")
+	api.HandleFunc("/titles/{id}/related", s.require(scopeTitlesRead, s.handleGetRelatedTitles)).Methods("GET")
+	api.HandleFunc("/titles/{id}/versions", s.require(scopeTitlesRead, s.handleGetTitleVersions)).Methods("GET")
 
 	// Downloads
-	api.HandleFunc("/download", s.handleStartDownload).Methods("POST")
-	api.HandleFunc("/download/{id}", s.handleGetDownloadStatus).Methods("GET")
-	api.HandleFunc("/download/{id}", s.handleCancelDownload).Methods("DELETE")
+	api.HandleFunc("/download", s.require(scopeDownloadsStart, s.handleStartDownload)).Methods("POST")
+	api.HandleFunc("/download/events", s.require(scopeDownloadsRead, s.handleAllJobEvents)).Methods("GET")
+	api.HandleFunc("/download/{id}/events", s.require(scopeDownloadsRead, s.handleJobEvents)).Methods("GET")
+	api.HandleFunc("/download/{id}", s.require(scopeDownloadsRead, s.handleGetDownloadStatus)).Methods("GET")
+	api.HandleFunc("/download/{id}", s.require(scopeDownloadsCancel, s.handleCancelDownload)).Methods("DELETE")
+	api.HandleFunc("/download/{id}/pause", s.require(scopeDownloadsCancel, s.handlePauseDownload)).Methods("POST")
+	api.HandleFunc("/download/{id}/resume", s.require(scopeDownloadsCancel, s.handleResumeDownload)).Methods("POST")
+	api.HandleFunc("/download/{id}/archive", s.require(scopeDownloadsRead, s.handleDownloadArchive)).Methods("GET", "HEAD")
+	api.HandleFunc("/download/{id}/files", s.require(scopeDownloadsRead, s.handleListJobFiles)).Methods("GET")
+	api.HandleFunc("/download/{id}/files/{path:.+}", s.require(scopeDownloadsRead, s.handleGetJobFile)).Methods("GET", "HEAD")
+	api.HandleFunc("/downloads", s.require(scopeDownloadsRead, s.handleListJobs)).Methods("GET")
+	api.HandleFunc("/downloads", s.require(scopeDownloadsCancel, s.handleRemoveJobs)).Methods("DELETE")
+	api.HandleFunc("/downloads/{id}", s.require(scopeDownloadsCancel, s.handleRemoveJob)).Methods("DELETE")
+	ws := websocket.Server{Handler: s.handleWebSocket, Handshake: s.checkWebSocketOrigin}
+	api.HandleFunc("/ws", s.require(scopeDownloadsRead, ws.ServeHTTP)).Methods("GET")
+
+	// Admin
+	api.HandleFunc("/admin/titledb/reload", s.require(scopeAdmin, s.handleReloadTitleDB)).Methods("POST")
+
+	// Preflight requests match no other route, this one lets the CORS middleware answer them
+	s.router.Methods("OPTIONS").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
 
 	// CORS middleware
 	s.router.Use(s.corsMiddleware)
@@ -171,9 +368,12 @@ func (s *Server) setupRoutes() {
 
 func (s *Server) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Add("Vary", "Origin")
+		if origin := s.cors.allowOrigin(r.Header.Get("Origin")); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key")
+		}
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -262,7 +462,19 @@ func (s *Server) handleListTitles(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	entries := wiiudownloader.GetTitleEntries(categoryFlag)
+	regions, err := wiiudownloader.ParseRegion(region)
+	if err != nil {
+		response := map[string]interface{}{
+			"error": "Invalid region. Supported: japan, usa, europe, china, korea, taiwan, all, or a comma separated list",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Category and region come straight from the title database indexes
+	entries := wiiudownloader.DefaultTitleDB().Filter(categoryFlag, regions)
 
 	// Filter by platform if specified
 	if platform != "all" {
@@ -368,57 +580,13 @@ func (s *Server) handleListTitles(w http.ResponseWriter, r *http.Request) {
 		entries = filtered
 	}
 
-	// Filter by region if specified
-	if region != "" && region != "all" {
-		var regionMask uint8
-		switch region {
-		case "japan":
-			regionMask = wiiudownloader.MCP_REGION_JAPAN
-		case "usa":
-			regionMask = wiiudownloader.MCP_REGION_USA
-		case "europe":
-			regionMask = wiiudownloader.MCP_REGION_EUROPE
-		default:
-			response := map[string]interface{}{
-				"error": "Invalid region. Supported: japan, usa, europe, all",
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(response)
-			return
-		}
-
-		filtered := make([]wiiudownloader.TitleEntry, 0)
-		for _, entry := range entries {
-			if entry.Region&regionMask != 0 {
-				filtered = append(filtered, entry)
-			}
-		}
-		entries = filtered
-	}
-
-	// Filter by search term if specified
-	if search != "" {
-		filtered := make([]wiiudownloader.TitleEntry, 0)
-		for _, entry := range entries {
-			if containsIgnoreCase(entry.Name, search) {
-				filtered = append(filtered, entry)
-			}
-		}
-		entries = filtered
-	}
+	// Search by name or title ID, best matches first
+	entries = wiiudownloader.SearchTitles(entries, search)
 
 	// Convert to JSON response
 	titles := make([]map[string]interface{}, len(entries))
 	for i, entry := range entries {
-		titles[i] = map[string]interface{}{
-			"id":       fmt.Sprintf("%016X", entry.TitleID),
-			"name":     entry.Name,
-			"region":   wiiudownloader.GetFormattedRegion(entry.Region),
-			"type":     wiiudownloader.GetFormattedKind(entry.TitleID),
-			"platform": getPlatformFromTitleID(entry.TitleID),
-			"format":   getFormatFromTitleID(entry.TitleID),
-		}
+		titles[i] = titleSummary(entry)
 	}
 
 	response := map[string]interface{}{
@@ -461,53 +629,376 @@ func (s *Server) handleGetTitle(w http.ResponseWriter, r *http.Request) {
 		"id":       fmt.Sprintf("%016X", entry.TitleID),
 		"name":     entry.Name,
 		"region":   wiiudownloader.GetFormattedRegion(entry.Region),
+		"regions":  wiiudownloader.Region(entry.Region).Keys(),
 		"type":     wiiudownloader.GetFormattedKind(entry.TitleID),
 		"platform": getPlatformFromTitleID(entry.TitleID),
 		"format":   getFormatFromTitleID(entry.TitleID),
 	}
 
+	// Titles downloaded by the server also get the details from their meta.xml
+	if outputDir := s.findDownloadedTitle(entry.TitleID); outputDir != "" {
+		if metadata, err := wiiudownloader.ReadTitleMetadata(outputDir); err == nil {
+			response["metadata"] = metadata
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *Server) handleStartDownload(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		TitleID         string `json:"title_id"`
-		Decrypt         bool   `json:"decrypt,omitempty"`
-		DeleteEncrypted bool   `json:"delete_encrypted,omitempty"`
+// handleGetRelatedTitles lists the update, DLC and demo of a game, or the
+// game and other titles that go with an update, DLC or demo.
+func (s *Server) handleGetRelatedTitles(w http.ResponseWriter, r *http.Request) {
+	tid, err := strconv.ParseUint(mux.Vars(r)["id"], 16, 64)
+	if err != nil {
+		response := map[string]interface{}{
+			"error": "Invalid title ID format. Must be 16-digit hexadecimal.",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	entry := wiiudownloader.GetTitleEntryFromTid(tid)
+	if entry.TitleID == 0 {
+		response := map[string]interface{}{
+			"error": "Title not found",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	related := wiiudownloader.RelatedTitles(tid)
+	titles := make([]map[string]interface{}, len(related))
+	for i, relatedEntry := range related {
+		titles[i] = titleSummary(relatedEntry)
+	}
+
+	response := map[string]interface{}{
+		"id":     fmt.Sprintf("%016X", entry.TitleID),
+		"count":  len(titles),
+		"titles": titles,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleGetTitleVersions asks the CDN which versions of a title it still has
+func (s *Server) handleGetTitleVersions(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	tid, err := strconv.ParseUint(id, 16, 64)
+	if err != nil {
+		response := map[string]interface{}{
+			"error": "Invalid title ID format. Must be 16-digit hexadecimal.",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
 	}
 
+	entry := wiiudownloader.GetTitleEntryFromTid(tid)
+	if entry.TitleID == 0 {
+		response := map[string]interface{}{
+			"error": "Title not found",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	versions, err := wiiudownloader.ProbeTitleVersions(fmt.Sprintf("%016X", entry.TitleID), s.client)
+	if err != nil {
+		response := map[string]interface{}{
+			"error": fmt.Sprintf("Failed to probe versions: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	response := map[string]interface{}{
+		"id":       fmt.Sprintf("%016X", entry.TitleID),
+		"latest":   versions[len(versions)-1],
+		"versions": versions,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// titleSummary is how titles are listed by the API
+func titleSummary(entry wiiudownloader.TitleEntry) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       fmt.Sprintf("%016X", entry.TitleID),
+		"name":     entry.Name,
+		"region":   wiiudownloader.GetFormattedRegion(entry.Region),
+		"regions":  wiiudownloader.Region(entry.Region).Keys(),
+		"type":     wiiudownloader.GetFormattedKind(entry.TitleID),
+		"platform": getPlatformFromTitleID(entry.TitleID),
+		"format":   getFormatFromTitleID(entry.TitleID),
+	}
+}
+
+// handleGetTitleIcon serves the icon of a downloaded title as a PNG, converted
+// once and cached in the downloads directory.
+func (s *Server) handleGetTitleIcon(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	tid, err := strconv.ParseUint(vars["id"], 16, 64)
+	if err != nil {
+		response := map[string]interface{}{
+			"error": "Invalid title ID format. Must be 16-digit hexadecimal.",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	iconPath := filepath.Join(s.downloadsDir, iconCacheDir, fmt.Sprintf("%016X.png", tid))
+	if _, err := os.Stat(iconPath); err != nil {
+		outputDir := s.findDownloadedTitle(tid)
+		if outputDir == "" {
+			response := map[string]interface{}{
+				"error": "Title has not been downloaded",
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		iconPNG, err := wiiudownloader.ReadTitleIconPNG(outputDir)
+		if err != nil {
+			response := map[string]interface{}{
+				"error": fmt.Sprintf("Failed to read icon: %v", err),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		if err := writeFileAtomic(iconPath, iconPNG); err != nil {
+			log.Printf("Failed to cache icon of %016X: %v", tid, err)
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(iconPNG)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	http.ServeFile(w, r, iconPath)
+}
+
+// writeFileAtomic writes through a temporary file so concurrent requests never
+// serve a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// handleReloadTitleDB reads the title database file again, or goes back to the
+// built-in titles when the server wasn't started with -titledb.
+func (s *Server) handleReloadTitleDB(w http.ResponseWriter, r *http.Request) {
+	db := wiiudownloader.DefaultTitleDB()
+	if err := db.Reload(); err != nil {
+		response := map[string]interface{}{
+			"error": fmt.Sprintf("Failed to reload title database: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	source := db.Path()
+	if source == "" {
+		source = "built-in"
+	}
+	log.Printf("Reloaded title database from %s: %d titles", source, db.Len())
+	response := map[string]interface{}{
+		"status": "reloaded",
+		"source": source,
+		"count":  db.Len(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// findDownloadedTitle returns the output directory of the latest completed
+// download of a title, or "" if there is none.
+func (s *Server) findDownloadedTitle(titleID uint64) string {
+	s.jobsMutex.RLock()
+	defer s.jobsMutex.RUnlock()
+
+	var latest *DownloadJob
+	for _, job := range s.jobs {
+		if job.state() != statusCompleted {
+			continue
+		}
+		if tid, err := strconv.ParseUint(job.TitleID, 16, 64); err != nil || tid != titleID {
+			continue
+		}
+		if latest == nil || job.StartTime.After(latest.StartTime) {
+			latest = job
+		}
+	}
+	if latest == nil {
+		return ""
+	}
+	return latest.OutputDir
+}
+
+// maxPriority is the highest priority of a job, jobs are queued with 0 unless
+// an admin asks for more.
+const maxPriority = 10
+
+// downloadRequest is the body of POST /api/download and the start message
+// of the WebSocket channel.
+type downloadRequest struct {
+	TitleID         string `json:"title_id"`
+	Decrypt         bool   `json:"decrypt,omitempty"`
+	DeleteEncrypted bool   `json:"delete_encrypted,omitempty"`
+	Version         *int   `json:"version,omitempty"`
+	Priority        int    `json:"priority,omitempty"`
+	CallbackURL     string `json:"callback_url,omitempty"`
+}
+
+// apiError is an error with the HTTP status code to report it with.
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// apiErrorStatus returns the status code of err, errors that aren't
+// apiErrors are internal server errors.
+func apiErrorStatus(w http.ResponseWriter, err error) int {
+	status := http.StatusInternalServerError
+	if apiErr, ok := err.(*apiError); ok {
+		status = apiErr.status
+	}
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "60")
+	}
+	return status
+}
+
+// writeAPIError writes err as plain text with its status code.
+func writeAPIError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), apiErrorStatus(w, err))
+}
+
+// writeJSONError writes err with its status code as the JSON error object
+// of the job endpoints.
+func writeJSONError(w http.ResponseWriter, err error) {
+	writeAuthError(w, apiErrorStatus(w, err), err.Error())
+}
+
+func (s *Server) handleStartDownload(w http.ResponseWriter, r *http.Request) {
+	var req downloadRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	if req.TitleID == "" {
-		http.Error(w, "title_id is required", http.StatusBadRequest)
+	job, err := s.startDownloadAs(requestToken(r), s.isAdmin(r), req)
+	if err != nil {
+		writeAPIError(w, err)
 		return
 	}
 
+	response := map[string]interface{}{
+		"job_id":         job.ID,
+		"status":         job.state(),
+		"title":          job.TitleName,
+		"queue_position": s.queue.Position(job),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
+}
+
+// startDownload creates the job of a request and queues it.
+func (s *Server) startDownload(req downloadRequest) (*DownloadJob, error) {
+	if req.TitleID == "" {
+		return nil, &apiError{http.StatusBadRequest, "title_id is required"}
+	}
+
 	// Validate title ID exists
 	tid, err := strconv.ParseUint(req.TitleID, 16, 64)
 	if err != nil {
-		http.Error(w, "Invalid title ID format", http.StatusBadRequest)
-		return
+		return nil, &apiError{http.StatusBadRequest, "Invalid title ID format"}
 	}
 
 	entry := wiiudownloader.GetTitleEntryFromTid(tid)
 	if entry.TitleID == 0 {
-		http.Error(w, "Title not found", http.StatusNotFound)
-		return
+		return nil, &apiError{http.StatusNotFound, "Title not found"}
 	}
 
-	// Create job ID
-	jobID := fmt.Sprintf("%s_%d", req.TitleID, time.Now().Unix())
+	version := wiiudownloader.TITLE_VERSION_LATEST
+	if req.Version != nil {
+		if *req.Version < 0 || *req.Version > 0xFFFF {
+			return nil, &apiError{http.StatusBadRequest, "version must be between 0 and 65535"}
+		}
+		version = *req.Version
+	}
+
+	if req.Priority < 0 || req.Priority > maxPriority {
+		return nil, &apiError{http.StatusBadRequest, fmt.Sprintf("priority must be between 0 and %d", maxPriority)}
+	}
+
+	if req.CallbackURL != "" {
+		if err := validateCallbackURL(req.CallbackURL); err != nil {
+			return nil, err
+		}
+	}
+
+	// The latest version is resolved now, so it names the output directory
+	// like an explicit one
+	if version == wiiudownloader.TITLE_VERSION_LATEST {
+		latest, err := s.latestVersion(req.TitleID)
+		if err != nil {
+			log.Printf("Failed to get the latest version of %s: %v", req.TitleID, err)
+			return nil, &apiError{http.StatusBadGateway, "Failed to get the latest version from the CDN"}
+		}
+		version = int(latest)
+	}
+
+	// Create job ID, the version is part of it and so of the output directory.
+	// The random suffix keeps identical requests in the same second apart.
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	jobID := fmt.Sprintf("%s_%d_%x", wiiudownloader.TitleDirectoryName(req.TitleID, uint16(version)), time.Now().Unix(), suffix)
 
 	// Create output directory
 	outputDir := filepath.Join(s.downloadsDir, jobID)
 	if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
-		http.Error(w, "Failed to create output directory", http.StatusInternalServerError)
-		return
+		return nil, &apiError{http.StatusInternalServerError, "Failed to create output directory"}
 	}
 
 	// Create download job
@@ -516,37 +1007,38 @@ func (s *Server) handleStartDownload(w http.ResponseWriter, r *http.Request) {
 		ID:              jobID,
 		TitleID:         req.TitleID,
 		TitleName:       entry.Name,
-		Status:          "pending",
+		Status:          statusPending,
 		OutputDir:       outputDir,
 		StartTime:       time.Now(),
 		Decrypt:         req.Decrypt,
 		DeleteEncrypted: req.DeleteEncrypted,
+		Version:         version,
+		Priority:        req.Priority,
+		CallbackURL:     req.CallbackURL,
 		ctx:             ctx,
 		cancel:          cancel,
-		progress:        NewAPIProgressReporter(nil), // Will be set after job creation
 	}
 
 	job.progress = NewAPIProgressReporter(job)
+	job.progress.events = s.events
 
 	// Store job
 	s.jobsMutex.Lock()
 	s.jobs[jobID] = job
 	s.jobsMutex.Unlock()
 
-	// Start download in background
-	go s.processDownload(job)
-
-	response := map[string]interface{}{
-		"job_id": jobID,
-		"status": "started",
-		"title":  entry.Name,
+	// Queue the download, a worker starts it once the jobs before it are done
+	if err := s.queue.Push(job); err != nil {
+		s.jobsMutex.Lock()
+		delete(s.jobs, jobID)
+		s.jobsMutex.Unlock()
+		cancel()
+		os.Remove(outputDir)
+		return nil, &apiError{http.StatusServiceUnavailable, "Download queue is full"}
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusAccepted)
-	json.NewEncoder(w).Encode(response)
+	s.jobStatusChanged(job)
+	return job, nil
 }
-
 func (s *Server) handleGetDownloadStatus(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	jobID := vars["id"]
@@ -560,6 +1052,18 @@ func (s *Server) handleGetDownloadStatus(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.jobStatus(job))
+}
+
+// jobStatus returns the fields of a job reported by the status endpoint and
+// the status events.
+func (s *Server) jobStatus(job *DownloadJob) map[string]interface{} {
+	// the queue has its own lock, so the position is looked up first
+	position := s.queue.Position(job)
+
+	job.mu.RLock()
+	defer job.mu.RUnlock()
 	response := map[string]interface{}{
 		"id":               job.ID,
 		"title_id":         job.TitleID,
@@ -580,39 +1084,57 @@ func (s *Server) handleGetDownloadStatus(w http.ResponseWriter, r *http.Request)
 		response["error"] = job.Error
 	}
 
+	if job.Phase != "" {
+		response["phase"] = job.Phase
+	}
+	if job.progress != nil && len(job.progress.files) > 0 {
+		response["files"] = job.progress.fileList()
+	}
+
 	if job.EndTime != nil {
 		response["end_time"] = job.EndTime.Format(time.RFC3339)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
+	if job.Version != wiiudownloader.TITLE_VERSION_LATEST {
+		response["version"] = job.Version
+	}
 
-func (s *Server) handleCancelDownload(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	jobID := vars["id"]
+	response["priority"] = job.Priority
+	if job.CallbackURL != "" {
+		response["callback_url"] = job.CallbackURL
+	}
+	if job.Webhook != nil {
+		response["webhook"] = job.Webhook
+	}
+	if position > 0 {
+		response["queue_position"] = position
+	}
+	return response
+}
 
+// findJob returns the job with an ID.
+func (s *Server) findJob(jobID string) (*DownloadJob, error) {
 	s.jobsMutex.RLock()
 	job, exists := s.jobs[jobID]
 	s.jobsMutex.RUnlock()
 
 	if !exists {
-		http.Error(w, "Job not found", http.StatusNotFound)
-		return
+		return nil, &apiError{http.StatusNotFound, "Job not found"}
 	}
+	return job, nil
+}
 
-	if job.Status == "completed" || job.Status == "failed" {
-		http.Error(w, "Cannot cancel completed or failed job", http.StatusBadRequest)
+func (s *Server) handleCancelDownload(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobID := vars["id"]
+
+	if _, err := s.cancelDownload(jobID); err != nil {
+		writeAPIError(w, err)
 		return
 	}
 
-	job.cancel()
-	job.Status = "cancelled"
-	now := time.Now()
-	job.EndTime = &now
-
 	response := map[string]interface{}{
-		"status": "cancelled",
+		"status": statusCancelled,
 		"job_id": jobID,
 	}
 
@@ -620,11 +1142,103 @@ func (s *Server) handleCancelDownload(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// cancelDownload takes a job out of the queue or stops its download.
+func (s *Server) cancelDownload(jobID string) (*DownloadJob, error) {
+	job, err := s.findJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := job.transition(statusCancelled, nil); err != nil {
+		if job.state() == statusCancelled {
+			return job, nil
+		}
+		return nil, &apiError{http.StatusBadRequest, "Cannot cancel completed or failed job"}
+	}
+
+	s.queue.Remove(job)
+	job.cancel()
+	s.jobStatusChanged(job)
+	return job, nil
+}
+
+func (s *Server) handlePauseDownload(w http.ResponseWriter, r *http.Request) {
+	job, err := s.pauseDownload(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.jobStatus(job))
+}
+
+// pauseDownload holds a pending job back, or stops a running download. The
+// download of a paused job starts over when it is resumed.
+func (s *Server) pauseDownload(jobID string) (*DownloadJob, error) {
+	job, err := s.findJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := job.transition(statusPaused, nil); err != nil {
+		return nil, &apiError{http.StatusBadRequest, "Only pending or downloading jobs can be paused"}
+	}
+
+	s.queue.Remove(job)
+	s.jobStatusChanged(job)
+	return job, nil
+}
+
+func (s *Server) handleResumeDownload(w http.ResponseWriter, r *http.Request) {
+	job, err := s.resumeDownload(mux.Vars(r)["id"])
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.jobStatus(job))
+}
+
+// resumeDownload queues a paused job again.
+func (s *Server) resumeDownload(jobID string) (*DownloadJob, error) {
+	job, err := s.findJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	if job.state() != statusPaused {
+		return nil, &apiError{http.StatusBadRequest, "Only paused jobs can be resumed"}
+	}
+	// the download stopped by the pause may still be winding down
+	if !job.running.TryLock() {
+		return nil, &apiError{http.StatusConflict, "The job is still pausing, try again"}
+	}
+	job.running.Unlock()
+
+	if err := job.transition(statusPending, nil); err != nil {
+		// cancelled since
+		return nil, &apiError{http.StatusBadRequest, "Only paused jobs can be resumed"}
+	}
+	if err := s.queue.Push(job); err != nil {
+		job.transition(statusPaused, nil)
+		return nil, &apiError{http.StatusServiceUnavailable, "Download queue is full"}
+	}
+	s.jobStatusChanged(job)
+	return job, nil
+}
 func (s *Server) processDownload(job *DownloadJob) {
-	job.Status = "downloading"
+	job.running.Lock()
+	defer job.running.Unlock()
+
+	// fails if cancelled or paused while a worker was taking it from the queue
+	if err := job.transition(statusDownloading, nil); err != nil {
+		return
+	}
+	s.jobStatusChanged(job)
 
-	err := wiiudownloader.DownloadTitle(
+	err := wiiudownloader.DownloadTitleVersion(
 		job.TitleID,
+		job.Version,
 		job.OutputDir,
 		job.Decrypt,
 		job.progress,
@@ -632,27 +1246,53 @@ func (s *Server) processDownload(job *DownloadJob) {
 		s.client,
 	)
 
-	now := time.Now()
-	job.EndTime = &now
-
+	var finished error
 	if err != nil {
-		if job.Status == "cancelled" {
-			job.Status = "cancelled"
-		} else {
-			job.Status = "failed"
-			job.Error = err.Error()
-		}
+		finished = job.transition(statusFailed, func() { job.Error = err.Error() })
 	} else {
-		job.Status = "completed"
-		job.Progress = 100.0
+		finished = job.transition(statusCompleted, func() { job.Progress = 100.0 })
+	}
+	if finished != nil {
+		// paused or cancelled while downloading, the download returns without
+		// an error then and resuming queues the job again
+		return
 	}
+	s.jobStatusChanged(job)
 }
-
 func main() {
 	port := flag.String("port", "11235", "Port to run the server on")
 	downloadsDir := flag.String("downloads", "./downloads", "Directory to store downloads")
+	titleDBPath := flag.String("titledb", os.Getenv("WIIU_API_TITLEDB"), "JSON or CSV title database to use instead of the built-in one")
+	adminToken := flag.String("admin-token", os.Getenv("WIIU_API_ADMIN_TOKEN"), "Bearer token for the admin endpoints, which are disabled without one")
+	jobsPath := flag.String("jobs", os.Getenv("WIIU_API_JOBS"), "Journal the jobs are kept in across restarts, defaults to "+jobStoreFile+" in the downloads directory")
+	resume := flag.Bool("resume", false, "Start over the downloads a restart interrupted instead of marking them failed")
+	webhookURL := flag.String("webhook-url", os.Getenv("WIIU_API_WEBHOOK_URL"), "Callback URL notified when jobs without their own callback_url finish")
+	webhookSecret := flag.String("webhook-secret", os.Getenv("WIIU_API_WEBHOOK_SECRET"), "Key of the HMAC-SHA256 signature sent with webhooks")
+	webhookAllowPrivate := flag.Bool("webhook-allow-private", os.Getenv("WIIU_API_WEBHOOK_ALLOW_PRIVATE") == "true", "Let the callback_url of requests lead to loopback, private and link-local addresses")
+	tokensPath := flag.String("tokens", os.Getenv("WIIU_API_TOKENS_FILE"), "JSON file of the API tokens, the API is open without one")
+	corsOrigins := flag.String("cors-origins", os.Getenv("WIIU_API_CORS_ORIGINS"), "Comma separated origins browsers may call the API from, * for any, none but the API's own without one")
+	workers := flag.Int("workers", envInt("WIIU_API_WORKERS", defaultWorkers), "Number of downloads running at the same time")
+	queueSize := flag.Int("queue-size", envInt("WIIU_API_QUEUE_SIZE", defaultQueueSize), "Number of downloads that can wait for a worker, 0 for no limit")
 	flag.Parse()
 
+	if *workers < 1 {
+		log.Fatal("-workers must be at least 1")
+	}
+	if *queueSize < 0 {
+		log.Fatal("-queue-size can't be negative")
+	}
+	if *webhookURL != "" {
+		if err := validateCallbackURL(*webhookURL); err != nil {
+			log.Fatal("-webhook-url: ", err)
+		}
+	}
+
+	if *titleDBPath != "" {
+		if err := wiiudownloader.DefaultTitleDB().Load(*titleDBPath); err != nil {
+			log.Fatal("Failed to load title database:", err)
+		}
+	}
+
 	// Create downloads directory if it doesn't exist
 	if err := os.MkdirAll(*downloadsDir, os.ModePerm); err != nil {
 		log.Fatal("Failed to create downloads directory:", err)
@@ -660,6 +1300,41 @@ func main() {
 
 	// Create server
 	server := NewServer(*downloadsDir)
+	server.adminToken = *adminToken
+	var err error
+	switch {
+	case *tokensPath != "":
+		server.tokens, err = LoadTokenStore(*tokensPath)
+	case os.Getenv("WIIU_API_TOKENS") != "":
+		server.tokens, err = ParseTokenStore([]byte(os.Getenv("WIIU_API_TOKENS")))
+	}
+	if err != nil {
+		log.Fatal("Failed to load API tokens: ", err)
+	}
+	if server.tokens == nil {
+		log.Println("Warning: no API tokens are configured, anyone can start downloads")
+	}
+	if server.cors, err = ParseCORSPolicy(*corsOrigins); err != nil {
+		log.Fatal(err)
+	}
+
+	server.webhookURL = *webhookURL
+	server.webhookSecret = *webhookSecret
+	server.callbackClient = newCallbackClient(*webhookAllowPrivate)
+	if server.webhookSecret == "" {
+		log.Println("Warning: webhooks are sent unsigned, set -webhook-secret to sign them")
+	}
+	server.queue.SetSize(*queueSize)
+	server.queue.SetWorkers(*workers)
+
+	if *jobsPath == "" {
+		*jobsPath = filepath.Join(*downloadsDir, jobStoreFile)
+	}
+	store, jobs, err := OpenJobStore(*jobsPath)
+	if err != nil {
+		log.Fatal("Failed to open job store:", err)
+	}
+	server.restoreJobs(store, jobs, *resume)
 
 	// Setup graceful shutdown
 	c := make(chan os.Signal, 1)
@@ -668,15 +1343,29 @@ func main() {
 	go func() {
 		<-c
 		log.Println("Shutting down server...")
+		store.Close()
 		os.Exit(0)
 	}()
 
 	log.Printf("Starting WiiU API server on port %s", *port)
 	log.Printf("Downloads directory: %s", *downloadsDir)
+	log.Printf("Title database: %d titles", wiiudownloader.DefaultTitleDB().Len())
+	log.Printf("Jobs: %d restored from %s, %d workers", len(jobs), *jobsPath, *workers)
 	log.Fatal(http.ListenAndServe(":"+*port, server.router))
 }
 
 // Helper functions
+
+// envInt returns the integer in an environment variable, or fallback if it's
+// unset or not a number.
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
 func formatBytes(bytes int64) string {
 	const unit = 1024
 	if bytes < unit {
@@ -706,31 +1395,6 @@ func formatDuration(d time.Duration) string {
 	return fmt.Sprintf("%02d:%02d", m, s)
 }
 
-func containsIgnoreCase(s, substr string) bool {
-	return len(s) >= len(substr) && (s == substr || containsIgnoreCaseHelper(s, substr))
-}
-
-func containsIgnoreCaseHelper(s, substr string) bool {
-	for i := 0; i <= len(s)-len(substr); i++ {
-		if equalIgnoreCase(s[i:i+len(substr)], substr) {
-			return true
-		}
-	}
-	return false
-}
-
-func equalIgnoreCase(a, b string) bool {
-	if len(a) != len(b) {
-		return false
-	}
-	for i := 0; i < len(a); i++ {
-		if a[i] != b[i] && a[i] != b[i]+32 && a[i] != b[i]-32 {
-			return false
-		}
-	}
-	return true
-}
-
 func getPlatformFromTitleID(titleID uint64) string {
 	titleHigh := titleID >> 32
 	switch titleHigh & 0xFFFFFFF0 { // Mask to get the main platform identifier
@@ -1,11 +1,26 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"image/png"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
 )
 
 // TestHealthEndpoint tests the health check endpoint
@@ -98,6 +113,7 @@ func TestListTitlesEndpoint(t *testing.T) {
 		{"/api/titles?format=cia", http.StatusOK, "filter by format"},
 		{"/api/titles?category=game", http.StatusOK, "filter by category"},
 		{"/api/titles?region=usa", http.StatusOK, "filter by region"},
+		{"/api/titles?region=Korea,taiwan", http.StatusOK, "filter by several regions"},
 		{"/api/titles?search=mario", http.StatusOK, "search titles"},
 		{"/api/titles?platform=invalid", http.StatusBadRequest, "invalid platform"},
 		{"/api/titles?format=invalid", http.StatusBadRequest, "invalid format"},
@@ -141,6 +157,8 @@ func TestListTitlesEndpoint(t *testing.T) {
 // TestStartDownloadEndpoint tests the download endpoint
 func TestStartDownloadEndpoint(t *testing.T) {
 	server := NewServer("/tmp/downloads")
+	server.queue.SetWorkers(0)
+	server.latestVersion = func(string) (uint16, error) { return 0, nil }
 
 	// Test valid download request
 	downloadReq := map[string]interface{}{
@@ -163,6 +181,11 @@ func TestStartDownloadEndpoint(t *testing.T) {
 	if status := rr.Code; status != http.StatusAccepted {
 		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusAccepted)
 	}
+	var started map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &started)
+	if started["status"] != statusPending {
+		t.Errorf("Expected the queued job to be pending, got %v", started["status"])
+	}
 
 	// Test invalid requests
 	invalidTests := []struct {
@@ -172,6 +195,10 @@ func TestStartDownloadEndpoint(t *testing.T) {
 		{map[string]interface{}{}, "missing title_id"},
 		{map[string]interface{}{"title_id": "invalid"}, "invalid title_id format"},
 		{map[string]interface{}{"title_id": "1234567890123456"}, "non-existent title"},
+		{map[string]interface{}{"title_id": "00050000101C9500", "version": -1}, "negative version"},
+		{map[string]interface{}{"title_id": "00050000101C9500", "version": 65536}, "version out of range"},
+		{map[string]interface{}{"title_id": "00050000101C9500", "priority": -1}, "negative priority"},
+		{map[string]interface{}{"title_id": "00050000101C9500", "priority": 11}, "priority out of range"},
 	}
 
 	for _, test := range invalidTests {
@@ -253,6 +280,7 @@ func TestOpenAPIEndpoint(t *testing.T) {
 // TestCORSHeaders tests CORS headers are present
 func TestCORSHeaders(t *testing.T) {
 	server := NewServer("/tmp/downloads")
+	server.cors = &CORSPolicy{any: true}
 
 	req, err := http.NewRequest("OPTIONS", "/api/titles", nil)
 	if err != nil {
@@ -265,7 +293,7 @@ func TestCORSHeaders(t *testing.T) {
 	expectedHeaders := map[string]string{
 		"Access-Control-Allow-Origin":  "*",
 		"Access-Control-Allow-Methods": "GET, POST, PUT, DELETE, OPTIONS",
-		"Access-Control-Allow-Headers": "Content-Type, Authorization",
+		"Access-Control-Allow-Headers": "Content-Type, Authorization, X-API-Key",
 	}
 
 	for header, expectedValue := range expectedHeaders {
@@ -274,3 +302,1293 @@ func TestCORSHeaders(t *testing.T) {
 		}
 	}
 }
+
+// TestFindDownloadedTitle tests picking the latest completed download of a title
+func TestFindDownloadedTitle(t *testing.T) {
+	server := NewServer("/tmp/downloads")
+	now := time.Now()
+	server.jobs = map[string]*DownloadJob{
+		"old":       {TitleID: "00050000101C9500", Status: "completed", OutputDir: "old", StartTime: now.Add(-time.Hour)},
+		"new":       {TitleID: "00050000101c9500", Status: "completed", OutputDir: "new", StartTime: now},
+		"running":   {TitleID: "00050000101C9500", Status: "downloading", OutputDir: "running", StartTime: now.Add(time.Hour)},
+		"unrelated": {TitleID: "00050000101C9400", Status: "completed", OutputDir: "unrelated", StartTime: now},
+	}
+
+	if dir := server.findDownloadedTitle(0x00050000101C9500); dir != "new" {
+		t.Errorf("Expected the latest completed download, got %q", dir)
+	}
+	if dir := server.findDownloadedTitle(0x00050000101C9600); dir != "" {
+		t.Errorf("Expected no download, got %q", dir)
+	}
+}
+
+// TestGetTitleIconEndpoint tests serving and caching the icon of a downloaded title
+func TestGetTitleIconEndpoint(t *testing.T) {
+	downloadsDir := t.TempDir()
+	server := NewServer(downloadsDir)
+
+	// 2x1 bottom-up 32 bit TGA
+	titleDir := filepath.Join(downloadsDir, "00050000101C9500_1")
+	tga := []byte{0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 1, 0, 32, 8, 0x00, 0x00, 0xFF, 0xFF, 0xFF, 0x00, 0x00, 0x80}
+	if err := os.MkdirAll(filepath.Join(titleDir, "meta"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(titleDir, "meta", "iconTex.tga"), tga, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/titles/00050000101C9500/icon", nil)
+	rr := httptest.NewRecorder()
+	server.router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 before the title is downloaded, got %v", rr.Code)
+	}
+
+	server.jobs["job"] = &DownloadJob{TitleID: "00050000101C9500", Status: "completed", OutputDir: titleDir}
+	for i := 0; i < 2; i++ {
+		rr = httptest.NewRecorder()
+		server.router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "image/png" {
+			t.Fatalf("handler returned %v with content type %q", rr.Code, rr.Header().Get("Content-Type"))
+		}
+		icon, err := png.Decode(rr.Body)
+		if err != nil {
+			t.Fatalf("Invalid PNG: %v", err)
+		}
+		if r, _, b, _ := icon.At(0, 0).RGBA(); r != 0xFFFF || b != 0 {
+			t.Errorf("Unexpected first pixel %v", icon.At(0, 0))
+		}
+		// the second request is served from the cache
+		os.RemoveAll(filepath.Join(titleDir, "meta"))
+	}
+}
+
+// TestReloadTitleDBEndpoint tests the admin token checks of the title database reload
+func TestReloadTitleDBEndpoint(t *testing.T) {
+	server := NewServer("/tmp/downloads")
+
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		status        int
+	}{
+		{"disabled without a token", "", "Bearer secret", http.StatusForbidden},
+		{"missing token", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer wrong", http.StatusUnauthorized},
+		{"valid token", "secret", "Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server.adminToken = tt.adminToken
+			req := httptest.NewRequest("POST", "/api/admin/titledb/reload", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+			server.router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.status)
+			}
+			var response map[string]interface{}
+			if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to parse JSON response: %v", err)
+			}
+			if tt.status == http.StatusOK && (response["status"] != "reloaded" || response["source"] != "built-in") {
+				t.Errorf("Unexpected response %v", response)
+			}
+		})
+	}
+}
+
+// TestGetRelatedTitlesEndpoint tests finding the update of a game and the errors
+func TestGetRelatedTitlesEndpoint(t *testing.T) {
+	server := NewServer("/tmp/downloads")
+
+	req := httptest.NewRequest("GET", "/api/titles/00050000101C9500/related", nil)
+	rr := httptest.NewRecorder()
+	server.router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var response struct {
+		ID     string `json:"id"`
+		Titles []struct {
+			ID   string `json:"id"`
+			Type string `json:"type"`
+		} `json:"titles"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse JSON response: %v", err)
+	}
+	foundUpdate := false
+	for _, title := range response.Titles {
+		if title.ID == response.ID {
+			t.Errorf("The title itself was listed as related")
+		}
+		if title.ID == "0005000E101C9500" && title.Type == "Update" {
+			foundUpdate = true
+		}
+	}
+	if !foundUpdate {
+		t.Errorf("Expected the update in %+v", response.Titles)
+	}
+
+	for path, status := range map[string]int{
+		"/api/titles/invalid/related":          http.StatusBadRequest,
+		"/api/titles/0005000010FFFF00/related": http.StatusNotFound,
+	} {
+		rr = httptest.NewRecorder()
+		server.router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != status {
+			t.Errorf("%s returned %v, want %v", path, rr.Code, status)
+		}
+	}
+}
+
+// TestGetTitleVersionsEndpoint tests the errors returned before the CDN is probed
+func TestGetTitleVersionsEndpoint(t *testing.T) {
+	server := NewServer("/tmp/downloads")
+	for path, status := range map[string]int{
+		"/api/titles/invalid/versions":          http.StatusBadRequest,
+		"/api/titles/0005000010FFFF00/versions": http.StatusNotFound,
+	} {
+		rr := httptest.NewRecorder()
+		server.router.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != status {
+			t.Errorf("%s returned %v, want %v", path, rr.Code, status)
+		}
+	}
+}
+
+// TestJobStore tests that jobs survive a restart and interrupted ones fail
+func TestJobStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), jobStoreFile)
+
+	store, jobs, err := OpenJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("Expected no jobs in a new store, got %d", len(jobs))
+	}
+	server := NewServer(t.TempDir())
+	server.restoreJobs(store, jobs, false)
+
+	completed := &DownloadJob{ID: "completed", TitleID: "00050000101c9500", Status: "downloading", progress: NewAPIProgressReporter(nil)}
+	server.saveJob(completed)
+	completed.Status = "completed"
+	completed.Progress = 100
+	server.saveJob(completed)
+	running := &DownloadJob{ID: "running", TitleID: "00050000101c9500", Status: "downloading", progress: NewAPIProgressReporter(nil)}
+	server.saveJob(running)
+	store.Close()
+
+	// a line cut short by a crash is skipped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"id":"torn","sta`)
+	f.Close()
+
+	store, jobs, err = OpenJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if len(jobs) != 2 {
+		t.Fatalf("Expected 2 jobs after reopening, got %d", len(jobs))
+	}
+	if jobs["completed"].Status != "completed" || jobs["completed"].Progress != 100 {
+		t.Errorf("Expected the last state of the completed job, got %+v", jobs["completed"])
+	}
+
+	server = NewServer(t.TempDir())
+	server.restoreJobs(store, jobs, false)
+	job := server.jobs["running"]
+	if job == nil || job.Status != "failed" || job.Error == "" || job.EndTime == nil {
+		t.Fatalf("Expected the interrupted job to be failed with a reason, got %+v", job)
+	}
+	if job.cancel == nil || job.progress == nil {
+		t.Error("Expected restored jobs to be cancellable")
+	}
+
+	// the journal was compacted and the failure saved
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 3 {
+		t.Errorf("Expected 3 journal lines, got %d:\n%s", lines, data)
+	}
+	reopened, jobs, err := OpenJobStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+	if jobs["running"].Status != "failed" {
+		t.Errorf("Expected the failure to be saved, got %q", jobs["running"].Status)
+	}
+}
+
+// TestJobQueue tests the order jobs leave the queue in and its limit
+func TestJobQueue(t *testing.T) {
+	done := make(chan string, 10)
+	queue := NewJobQueue(4, func(job *DownloadJob) {
+		done <- job.ID
+	})
+
+	jobs := []*DownloadJob{
+		{ID: "first", Priority: 0},
+		{ID: "second", Priority: 0},
+		{ID: "urgent", Priority: 10},
+		{ID: "low", Priority: -1},
+	}
+	for _, job := range jobs {
+		if err := queue.Push(job); err != nil {
+			t.Fatalf("Push(%s) failed: %v", job.ID, err)
+		}
+	}
+	if err := queue.Push(&DownloadJob{ID: "overflow"}); err != errQueueFull {
+		t.Errorf("Expected errQueueFull, got %v", err)
+	}
+
+	positions := map[string]int{"urgent": 1, "first": 2, "second": 3, "low": 4}
+	for _, job := range jobs {
+		if position := queue.Position(job); position != positions[job.ID] {
+			t.Errorf("Position(%s) = %d, want %d", job.ID, position, positions[job.ID])
+		}
+	}
+
+	if !queue.Remove(jobs[1]) {
+		t.Error("Expected the second job to be removed")
+	}
+	if position := queue.Position(jobs[1]); position != 0 {
+		t.Errorf("Expected a removed job to have no position, got %d", position)
+	}
+
+	queue.SetWorkers(1)
+	for _, want := range []string{"urgent", "first", "low"} {
+		select {
+		case id := <-done:
+			if id != want {
+				t.Errorf("Expected %s to run, got %s", want, id)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for %s", want)
+		}
+	}
+	queue.SetWorkers(0)
+	if queue.Len() != 0 {
+		t.Errorf("Expected an empty queue, got %d jobs", queue.Len())
+	}
+}
+
+// TestJobEventsEndpoint tests the Server-Sent Events stream of a job
+func TestJobEventsEndpoint(t *testing.T) {
+	server := NewServer(t.TempDir())
+	job := &DownloadJob{ID: "00050000101c9500_1", TitleID: "00050000101c9500", Status: "downloading", Version: -1}
+	job.progress = NewAPIProgressReporter(job)
+	job.progress.events = server.events
+	server.jobs[job.ID] = job
+
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/api/download/missing/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown job, got %d", resp.StatusCode)
+	}
+
+	all, err := http.Get(ts.URL + "/api/download/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Body.Close()
+	resp, err = http.Get(ts.URL + "/api/download/" + job.ID + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %q", ct)
+	}
+
+	// readEvent returns the type and data of the next event of a stream
+	readEvent := func(reader *bufio.Reader) (string, map[string]interface{}) {
+		eventType := ""
+		data := map[string]interface{}{}
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Failed to read event: %v", err)
+			}
+			line = strings.TrimRight(line, "\n")
+			switch {
+			case line == "":
+				return eventType, data
+			case strings.HasPrefix(line, "event: "):
+				eventType = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data); err != nil {
+					t.Fatalf("Invalid event data %q: %v", line, err)
+				}
+			}
+		}
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	if eventType, data := readEvent(reader); eventType != "status" || data["status"] != "downloading" {
+		t.Errorf("Expected the current status first, got %s %v", eventType, data)
+	}
+
+	job.progress.SetDownloadSize(100)
+	job.progress.UpdateDownloadProgress(50, "/tmp/00000000.app")
+	job.progress.MarkFileAsDone("/tmp/00000000.app")
+	if err := job.transition(statusCompleted, nil); err != nil {
+		t.Fatal(err)
+	}
+	server.jobStatusChanged(job)
+
+	if eventType, data := readEvent(reader); eventType != "progress" || data["downloaded"] != float64(50) || data["file"] != "00000000.app" {
+		t.Errorf("Expected a progress event, got %s %v", eventType, data)
+	}
+	if eventType, _ := readEvent(reader); eventType != "file_done" {
+		t.Errorf("Expected a file_done event, got %s", eventType)
+	}
+	if eventType, data := readEvent(reader); eventType != "status" || data["status"] != "completed" {
+		t.Errorf("Expected the completed status, got %s %v", eventType, data)
+	}
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("Expected the stream to end with the job, got %v", err)
+	}
+
+	allReader := bufio.NewReader(all.Body)
+	for _, want := range []string{"progress", "file_done", "status"} {
+		if eventType, data := readEvent(allReader); eventType != want || data["job_id"] != job.ID && data["id"] != job.ID {
+			t.Errorf("Expected a %s event of the job on the all jobs stream, got %s %v", want, eventType, data)
+		}
+	}
+}
+
+// TestWebSocketChannel tests subscribing to a job and controlling it over the WebSocket channel
+func TestWebSocketChannel(t *testing.T) {
+	server := NewServer(t.TempDir())
+	// keep jobs pending so nothing is downloaded
+	server.queue.SetWorkers(0)
+	job := &DownloadJob{ID: "00050000101c9500_1", TitleID: "00050000101c9500", Status: "pending", Version: -1}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	job.progress = NewAPIProgressReporter(job)
+	job.progress.events = server.events
+	server.jobs[job.ID] = job
+	server.queue.Push(job)
+
+	ts := httptest.NewServer(server.router)
+	defer ts.Close()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/api/ws", "", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	// request sends a message and returns its reply and the events received until then
+	request := func(message map[string]interface{}) (wsReply, []wsReply) {
+		if err := websocket.JSON.Send(ws, message); err != nil {
+			t.Fatal(err)
+		}
+		events := make([]wsReply, 0)
+		for {
+			ws.SetReadDeadline(time.Now().Add(time.Second))
+			var reply wsReply
+			if err := websocket.JSON.Receive(ws, &reply); err != nil {
+				t.Fatalf("No reply to %v: %v", message, err)
+			}
+			if reply.Type == "event" {
+				events = append(events, reply)
+				continue
+			}
+			if reply.ID != message["id"] {
+				t.Fatalf("Expected the reply to %v, got %+v", message["id"], reply)
+			}
+			return reply, events
+		}
+	}
+
+	reply, _ := request(map[string]interface{}{"type": "subscribe", "id": "1", "job_id": job.ID})
+	if reply.Type != "result" || reply.Data["status"] != "pending" || reply.Data["queue_position"] != float64(1) {
+		t.Errorf("Expected the pending status, got %+v", reply)
+	}
+
+	reply, _ = request(map[string]interface{}{"type": "pause", "id": "2", "job_id": job.ID})
+	if reply.Type != "result" || reply.Data["status"] != "paused" || server.queue.Len() != 0 {
+		t.Errorf("Expected the job to be paused and out of the queue, got %+v", reply)
+	}
+
+	reply, events := request(map[string]interface{}{"type": "resume", "id": "3", "job_id": job.ID})
+	if reply.Type != "result" || reply.Data["status"] != "pending" || server.queue.Len() != 1 {
+		t.Errorf("Expected the job to be queued again, got %+v", reply)
+	}
+
+	reply, more := request(map[string]interface{}{"type": "cancel", "id": "4", "job_id": job.ID})
+	if reply.Type != "result" || reply.Data["status"] != "cancelled" {
+		t.Errorf("Expected the job to be cancelled, got %+v", reply)
+	}
+
+	// the events of every change arrive, in order, if not always before the replies
+	events = append(events, more...)
+	for len(events) < 3 {
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		var event wsReply
+		if err := websocket.JSON.Receive(ws, &event); err != nil {
+			t.Fatalf("Expected 3 status events, got %d: %v", len(events), err)
+		}
+		events = append(events, event)
+	}
+	for i, status := range []string{"paused", "pending", "cancelled"} {
+		if events[i].Event != "status" || events[i].JobID != job.ID || events[i].Data["status"] != status {
+			t.Errorf("Expected a %s status event, got %+v", status, events[i])
+		}
+	}
+
+	reply, _ = request(map[string]interface{}{"type": "resume", "id": "5", "job_id": job.ID})
+	if reply.Type != "error" || reply.Code != http.StatusBadRequest {
+		t.Errorf("Expected resuming a cancelled job to fail with 400, got %+v", reply)
+	}
+	reply, _ = request(map[string]interface{}{"type": "status", "id": "6", "job_id": "missing"})
+	if reply.Type != "error" || reply.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown job to fail with 404, got %+v", reply)
+	}
+	reply, _ = request(map[string]interface{}{"type": "bogus", "id": "7"})
+	if reply.Type != "error" || reply.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown message type to fail with 400, got %+v", reply)
+	}
+	reply, _ = request(map[string]interface{}{"type": "start", "id": "8", "title_id": "00050000101C9500", "priority": 10})
+	if reply.Type != "error" || reply.Code != http.StatusForbidden {
+		t.Errorf("Expected a priority without admin credentials to fail with 403, got %+v", reply)
+	}
+}
+
+// TestJobWebhook tests that finished jobs are reported to their callback URL
+func TestJobWebhook(t *testing.T) {
+	defer func(delay time.Duration) { webhookRetryDelay = delay }(webhookRetryDelay)
+	webhookRetryDelay = time.Millisecond
+
+	type delivery struct {
+		event, signature string
+		body             []byte
+	}
+	deliveries := make(chan delivery, 10)
+	failures := 1
+	var mu sync.Mutex
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- delivery{r.Header.Get(webhookEventHeader), r.Header.Get(webhookSignatureHeader), body}
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer callback.Close()
+
+	server := NewServer(t.TempDir())
+	server.webhookSecret = "secret"
+	// the callback server listens on loopback
+	server.callbackClient = newCallbackClient(true)
+
+	if _, err := server.startDownload(downloadRequest{TitleID: "00050000101C9500", CallbackURL: "ftp://example.com"}); err == nil {
+		t.Error("Expected a callback URL that isn't http to be refused")
+	}
+
+	job := &DownloadJob{ID: "00050000101c9500_1", TitleID: "00050000101c9500", Status: "completed", Version: -1, CallbackURL: callback.URL}
+	job.progress = NewAPIProgressReporter(job)
+	server.jobStatusChanged(job)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		select {
+		case d := <-deliveries:
+			if d.event != "job.completed" {
+				t.Errorf("Expected the job.completed event, got %q", d.event)
+			}
+			if d.signature != signWebhook("secret", d.body) {
+				t.Errorf("Invalid signature %q", d.signature)
+			}
+			var payload map[string]interface{}
+			if err := json.Unmarshal(d.body, &payload); err != nil {
+				t.Fatal(err)
+			}
+			if status := payload["job"].(map[string]interface{})["status"]; status != "completed" {
+				t.Errorf("Expected the job status in the payload, got %v", status)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for attempt %d", attempt)
+		}
+	}
+
+	// the delivery is recorded once the second attempt is answered
+	deadline := time.Now().Add(time.Second)
+	for {
+		job.mu.RLock()
+		webhook := *job.Webhook
+		job.mu.RUnlock()
+		if webhook.Status == "delivered" {
+			if webhook.Attempts != 2 || webhook.ResponseCode != http.StatusOK {
+				t.Errorf("Expected 2 attempts ending with 200, got %+v", webhook)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the webhook to be delivered, got %+v", webhook)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// a job only notifies once
+	server.jobStatusChanged(job)
+	select {
+	case <-deliveries:
+		t.Error("Expected no second webhook")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestAPITokens tests token authentication, scopes, rate limits and quotas
+func TestAPITokens(t *testing.T) {
+	tokens, err := ParseTokenStore([]byte(`{"tokens": [
+		{"name": "reader", "token": "reader-token-0123456789", "scopes": ["titles:read"], "rate_limit": 2},
+		{"name": "bot", "token": "bot-token-0123456789", "scopes": ["downloads:start", "downloads:read"], "daily_quota": 1},
+		{"name": "admin", "token": "admin-token-0123456789", "scopes": ["admin"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []string{
+		`{"tokens": [{"token": "short", "scopes": ["admin"]}]}`,
+		`{"tokens": [{"token": "long-enough-0123456789", "scopes": ["everything"]}]}`,
+		`{"tokens": [{"token": "long-enough-0123456789", "scopes": []}]}`,
+	} {
+		if _, err := ParseTokenStore([]byte(config)); err == nil {
+			t.Errorf("Expected %s to be refused", config)
+		}
+	}
+
+	server := NewServer(t.TempDir())
+	server.queue.SetWorkers(0)
+	server.tokens = tokens
+	server.latestVersion = func(string) (uint16, error) { return 0, nil }
+
+	request := func(method, path, token string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		server.router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name         string
+		method, path string
+		token, body  string
+		status       int
+	}{
+		{"missing token", "GET", "/api/titles", "", "", http.StatusUnauthorized},
+		{"invalid token", "GET", "/api/titles", "wrong-token-0123456789", "", http.StatusUnauthorized},
+		{"allowed scope", "GET", "/api/titles", "reader-token-0123456789", "", http.StatusOK},
+		{"query parameter", "GET", "/api/titles?access_token=reader-token-0123456789", "", "", http.StatusOK},
+		{"missing scope", "DELETE", "/api/download/job", "reader-token-0123456789", "", http.StatusForbidden},
+		{"rate limited", "GET", "/api/titles", "reader-token-0123456789", "", http.StatusTooManyRequests},
+		{"admin grants every scope", "GET", "/api/titles", "admin-token-0123456789", "", http.StatusOK},
+		{"admin endpoint", "POST", "/api/admin/titledb/reload", "admin-token-0123456789", "", http.StatusOK},
+		{"admin endpoint without admin", "POST", "/api/admin/titledb/reload", "bot-token-0123456789", "", http.StatusForbidden},
+		{"failed start", "POST", "/api/download", "bot-token-0123456789", `{"title_id": "zz"}`, http.StatusBadRequest},
+		{"priority without admin", "POST", "/api/download", "bot-token-0123456789", `{"title_id": "00050000101C9500", "priority": 5}`, http.StatusForbidden},
+		{"priority as admin", "POST", "/api/download", "admin-token-0123456789", `{"title_id": "00050000101C9500", "priority": 5}`, http.StatusAccepted},
+		{"start within quota", "POST", "/api/download", "bot-token-0123456789", `{"title_id": "00050000101C9500"}`, http.StatusAccepted},
+		{"start over quota", "POST", "/api/download", "bot-token-0123456789", `{"title_id": "00050000101C9500"}`, http.StatusTooManyRequests},
+		{"public spec", "GET", "/api/openapi.json", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rr := request(tt.method, tt.path, tt.token, tt.body)
+		if rr.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d: %s", tt.name, tt.status, rr.Code, rr.Body.String())
+		}
+		if tt.status == http.StatusTooManyRequests && tt.name == "rate limited" && rr.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: expected a Retry-After header", tt.name)
+		}
+	}
+}
+
+// TestCORSAllowList tests that only the configured origins get CORS headers
+func TestCORSAllowList(t *testing.T) {
+	server := NewServer(t.TempDir())
+	// without -cors-origins no other origin is allowed
+	req := httptest.NewRequest("OPTIONS", "/api/download", nil)
+	req.Header.Set("Origin", "https://bot.example.com")
+	rr := httptest.NewRecorder()
+	server.router.ServeHTTP(rr, req)
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Expected no CORS headers by default, got Access-Control-Allow-Origin %q", got)
+	}
+
+	policy, err := ParseCORSPolicy("https://bot.example.com, http://localhost:3000/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.cors = policy
+	if _, err := ParseCORSPolicy("example.com"); err == nil {
+		t.Error("Expected an origin without a scheme to be refused")
+	}
+
+	for origin, allowed := range map[string]string{
+		"https://bot.example.com":  "https://bot.example.com",
+		"http://localhost:3000":    "http://localhost:3000",
+		"https://evil.example.com": "",
+		"":                         "",
+	} {
+		req := httptest.NewRequest("OPTIONS", "/api/download", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rr := httptest.NewRecorder()
+		server.router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected preflight requests to succeed, got %d", rr.Code)
+		}
+		if got := rr.Header().Get("Access-Control-Allow-Origin"); got != allowed {
+			t.Errorf("Origin %q: expected Access-Control-Allow-Origin %q, got %q", origin, allowed, got)
+		}
+	}
+}
+
+// TestJobTransitions tests the statuses a job can move between
+func TestJobTransitions(t *testing.T) {
+	tests := []struct {
+		from, to string
+		valid    bool
+	}{
+		{statusPending, statusDownloading, true},
+		{statusPending, statusPaused, true},
+		{statusPending, statusCompleted, false},
+		{statusDownloading, statusCompleted, true},
+		{statusDownloading, statusPending, false},
+		{statusPaused, statusPending, true},
+		{statusPaused, statusCompleted, false},
+		{statusCompleted, statusCancelled, false},
+		{statusFailed, statusPending, false},
+		{statusCancelled, statusCancelled, false},
+	}
+
+	for _, tt := range tests {
+		job := &DownloadJob{Status: tt.from}
+		err := job.transition(tt.to, func() { job.Error = "updated" })
+		if (err == nil) != tt.valid {
+			t.Errorf("%s -> %s: got error %v, want valid %v", tt.from, tt.to, err, tt.valid)
+			continue
+		}
+		if !tt.valid {
+			if job.Status != tt.from || job.Error != "" {
+				t.Errorf("%s -> %s: expected a refused transition to change nothing, got %+v", tt.from, tt.to, job)
+			}
+			continue
+		}
+		if job.Status != tt.to || job.Error != "updated" {
+			t.Errorf("%s -> %s: got status %q and error %q", tt.from, tt.to, job.Status, job.Error)
+		}
+		if (job.EndTime != nil) != isFinalStatus(tt.to) {
+			t.Errorf("%s -> %s: expected the end time only for final statuses, got %v", tt.from, tt.to, job.EndTime)
+		}
+	}
+}
+
+// TestJobStateConcurrency reads, pauses and cancels a job while its download
+// reports progress, run it with -race
+func TestJobStateConcurrency(t *testing.T) {
+	server := NewServer(t.TempDir())
+	server.queue.SetWorkers(0)
+	store, jobs, err := OpenJobStore(filepath.Join(t.TempDir(), jobStoreFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	server.restoreJobs(store, jobs, false)
+
+	job := &DownloadJob{ID: "00050000101c9500_1", TitleID: "00050000101c9500", Status: statusPending, Version: -1}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	job.progress = NewAPIProgressReporter(job)
+	job.progress.events = server.events
+	server.jobs[job.ID] = job
+
+	// a fake download running until it is cancelled
+	downloaded := make(chan error)
+	go func() {
+		if err := job.transition(statusDownloading, nil); err != nil {
+			downloaded <- err
+			return
+		}
+		server.jobStatusChanged(job)
+		job.progress.SetDownloadSize(1 << 30)
+		for i := int64(1); !job.progress.Cancelled(); i++ {
+			job.progress.UpdateDownloadProgress(i, "/tmp/00000000.app")
+		}
+		downloaded <- job.transition(statusCompleted, nil)
+	}()
+
+	request := func(method, path string) int {
+		req := httptest.NewRequest(method, path, nil)
+		rr := httptest.NewRecorder()
+		server.router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if code := request("GET", "/api/download/"+job.ID); code != http.StatusOK {
+					t.Errorf("Expected the status to be readable, got %d", code)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			request("POST", "/api/download/"+job.ID+"/pause")
+			request("POST", "/api/download/"+job.ID+"/resume")
+		}()
+		go func() {
+			defer wg.Done()
+			time.Sleep(time.Millisecond)
+			if code := request("DELETE", "/api/download/"+job.ID); code != http.StatusOK {
+				t.Errorf("Expected cancelling to succeed every time, got %d", code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := <-downloaded; err == nil {
+		t.Error("Expected a cancelled download not to complete")
+	}
+	if status := job.state(); status != statusCancelled {
+		t.Errorf("Expected the job to end cancelled, got %s", status)
+	}
+	status := server.jobStatus(job)
+	if status["end_time"] == nil {
+		t.Error("Expected a cancelled job to have an end time")
+	}
+	if job.ctx.Err() == nil {
+		t.Error("Expected the job's context to be cancelled")
+	}
+}
+
+// TestProgressReporter tests adding up the progress of files downloaded at the same time
+func TestProgressReporter(t *testing.T) {
+	server := NewServer(t.TempDir())
+	job := &DownloadJob{ID: "00050000101c9500_1", TitleID: "00050000101c9500", Status: statusDownloading, Version: -1}
+	job.progress = NewAPIProgressReporter(job)
+	reporter := job.progress
+
+	reporter.ResetTotals()
+	reporter.UpdateDownloadProgress(10, "/tmp/title.tmd")
+	reporter.SetDownloadSize(1000)
+	reporter.SetStartTime(time.Now().Add(-time.Second))
+
+	// the downloader reports the bytes since the last update of each file
+	reporter.SetTotalDownloadedForFile("00000000.app", 0)
+	reporter.SetTotalDownloadedForFile("00000001.app", 0)
+	reporter.UpdateDownloadProgress(200, "00000000.app")
+	reporter.UpdateDownloadProgress(100, "00000001.app")
+	reporter.UpdateDownloadProgress(200, "00000000.app")
+	reporter.MarkFileAsDone("00000000.app")
+	// a retry starts the file over
+	reporter.UpdateDownloadProgress(50, "00000001.app")
+	reporter.SetTotalDownloadedForFile("00000001.app", 0)
+	reporter.UpdateDownloadProgress(100, "00000001.app")
+	// the TMD and hash files aren't part of the download size
+	reporter.SetTotalDownloadedForFile("00000000.h3", 0)
+	reporter.UpdateDownloadProgress(20, "00000000.h3")
+
+	status := server.jobStatus(job)
+	if status["downloaded"] != int64(500) || status["progress"] != 50.0 || status["phase"] != phaseDownloading {
+		t.Errorf("Expected 500 bytes and 50%% downloaded, got %v bytes, %v%% %v", status["downloaded"], status["progress"], status["phase"])
+	}
+	if status["speed"] == "" || status["eta"] == "" {
+		t.Errorf("Expected a speed and ETA, got %q and %q", status["speed"], status["eta"])
+	}
+	files, _ := status["files"].([]map[string]interface{})
+	want := []map[string]interface{}{
+		{"name": "00000000.app", "downloaded": int64(400), "done": true},
+		{"name": "00000000.h3", "downloaded": int64(20), "done": false},
+		{"name": "00000001.app", "downloaded": int64(100), "done": false},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("Expected the progress of the content files, got %v", files)
+	}
+
+	reporter.UpdateDecryptionProgress(0.25)
+	status = server.jobStatus(job)
+	if status["progress"] != 25.0 || status["phase"] != phaseDecrypting {
+		t.Errorf("Expected 25%% decrypted, got %v%% %v", status["progress"], status["phase"])
+	}
+
+	reporter.ResetTotals()
+	status = server.jobStatus(job)
+	if status["downloaded"] != int64(0) || status["progress"] != 0.0 || status["files"] != nil || status["phase"] != nil {
+		t.Errorf("Expected the totals to be reset, got %v", status)
+	}
+}
+
+// TestJobsEndpoint tests listing, filtering and removing jobs
+func TestJobsEndpoint(t *testing.T) {
+	downloadsDir := t.TempDir()
+	server := NewServer(downloadsDir)
+	server.queue.SetWorkers(0)
+	storePath := filepath.Join(downloadsDir, jobStoreFile)
+	store, jobs, err := OpenJobStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.restoreJobs(store, jobs, false)
+
+	start := time.Date(2025, 11, 26, 19, 0, 0, 0, time.UTC)
+	for i, job := range []*DownloadJob{
+		{ID: "a", TitleID: "00050000101C9500", Status: statusCompleted, Priority: 1},
+		{ID: "b", TitleID: "00050000101C9500", Status: statusFailed},
+		{ID: "c", TitleID: "0005000010145D00", Status: statusDownloading, Priority: 5},
+		{ID: "d", TitleID: "0005000010145D00", Status: statusCompleted},
+	} {
+		job.StartTime = start.Add(time.Duration(i) * time.Hour)
+		if isFinalStatus(job.Status) {
+			endTime := job.StartTime.Add(30 * time.Minute)
+			job.EndTime = &endTime
+		}
+		job.OutputDir = filepath.Join(downloadsDir, job.ID)
+		if err := os.MkdirAll(job.OutputDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		job.progress = NewAPIProgressReporter(job)
+		server.jobs[job.ID] = job
+		server.saveJob(job)
+	}
+
+	list := func(query string) (int, []string, map[string]interface{}) {
+		req := httptest.NewRequest("GET", "/api/downloads"+query, nil)
+		rr := httptest.NewRecorder()
+		server.router.ServeHTTP(rr, req)
+		var response map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		ids := []string{}
+		jobs, _ := response["jobs"].([]interface{})
+		for _, job := range jobs {
+			ids = append(ids, job.(map[string]interface{})["id"].(string))
+		}
+		return rr.Code, ids, response
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"d", "c", "b", "a"}},
+		{"?order=asc", []string{"a", "b", "c", "d"}},
+		{"?status=completed,failed", []string{"d", "b", "a"}},
+		{"?title_id=0005000010145d00", []string{"d", "c"}},
+		{"?since=2025-11-26T20:00:00Z&until=2025-11-26T22:00:00Z", []string{"c", "b"}},
+		{"?sort=priority", []string{"c", "a", "d", "b"}},
+		{"?sort=end_time&order=asc&status=downloading,completed", []string{"a", "d", "c"}},
+		{"?limit=2&offset=1", []string{"c", "b"}},
+		{"?offset=10", []string{}},
+	}
+	for _, tt := range tests {
+		code, ids, _ := list(tt.query)
+		if code != http.StatusOK || !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("GET /api/downloads%s = %d %v, want %v", tt.query, code, ids, tt.want)
+		}
+	}
+	if _, _, response := list("?limit=1"); response["total"] != float64(4) || response["count"] != float64(1) {
+		t.Errorf("Expected 1 of 4 jobs, got %v", response)
+	}
+	for _, query := range []string{"?status=done", "?title_id=xyz", "?since=yesterday", "?sort=size", "?order=up", "?limit=0", "?limit=501", "?offset=-1"} {
+		if code, _, response := list(query); code != http.StatusBadRequest || response["error"] == nil {
+			t.Errorf("GET /api/downloads%s = %d %v, want 400 with an error", query, code, response)
+		}
+	}
+
+	server.adminToken = "admin-token-0123456789"
+	remove := func(path, token string) (int, map[string]interface{}) {
+		req := httptest.NewRequest("DELETE", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		server.router.ServeHTTP(rr, req)
+		var response map[string]interface{}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		return rr.Code, response
+	}
+
+	if code, _ := remove("/api/downloads/c", ""); code != http.StatusBadRequest {
+		t.Errorf("Expected removing a running job to fail with 400, got %d", code)
+	}
+	if code, _ := remove("/api/downloads/missing", ""); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown job, got %d", code)
+	}
+	// deleting files needs admin credentials, removing the jobs doesn't
+	if code, _ := remove("/api/downloads/a?delete_files=true", ""); code != http.StatusForbidden {
+		t.Errorf("Expected deleting files without admin credentials to fail with 403, got %d", code)
+	}
+	if code, _ := remove("/api/downloads?delete_files=true", ""); code != http.StatusForbidden {
+		t.Errorf("Expected deleting files without admin credentials to fail with 403, got %d", code)
+	}
+	if code, response := remove("/api/downloads/a?delete_files=true", server.adminToken); code != http.StatusOK || response["files_deleted"] != true {
+		t.Errorf("Expected the job to be removed, got %d %v", code, response)
+	}
+	if _, err := os.Stat(filepath.Join(downloadsDir, "a")); !os.IsNotExist(err) {
+		t.Errorf("Expected the files of the job to be deleted, got %v", err)
+	}
+	if code, response := remove("/api/downloads?status=running", ""); code != http.StatusBadRequest {
+		t.Errorf("Expected removing jobs that aren't finished to fail with 400, got %d %v", code, response)
+	}
+	code, response := remove("/api/downloads?title_id=0005000010145D00", "")
+	if removed, _ := response["removed"].([]interface{}); code != http.StatusOK || len(removed) != 1 || removed[0] != "d" {
+		t.Errorf("Expected the finished job of the title to be removed, got %d %v", code, response)
+	}
+	if _, err := os.Stat(filepath.Join(downloadsDir, "d")); err != nil {
+		t.Errorf("Expected the files to be kept, got %v", err)
+	}
+	if _, ids, _ := list(""); !reflect.DeepEqual(ids, []string{"c", "b"}) {
+		t.Errorf("Expected the removed jobs to be gone, got %v", ids)
+	}
+
+	// the removed jobs stay removed after a restart
+	store.Close()
+	_, jobs, err = OpenJobStore(storePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs["b"] == nil || jobs["c"] == nil {
+		t.Errorf("Expected only the jobs left to be restored, got %v", jobs)
+	}
+}
+
+// TestRemoveJobFiles tests that only directories inside the downloads directory are deleted
+func TestRemoveJobFiles(t *testing.T) {
+	server := NewServer(t.TempDir())
+	outside := t.TempDir()
+	for _, dir := range []string{outside, server.downloadsDir, filepath.Join(server.downloadsDir, "..")} {
+		if err := server.removeJobFiles(&DownloadJob{OutputDir: dir}); err == nil {
+			t.Errorf("Expected deleting %s to be refused", dir)
+		}
+	}
+	if _, err := os.Stat(outside); err != nil {
+		t.Errorf("Expected %s to be kept, got %v", outside, err)
+	}
+}
+
+// archiveTestJob adds a completed job with a few files and a symbolic link
+// leaving its output directory, returning the contents of the files.
+func archiveTestJob(t *testing.T, server *Server, id string) map[string][]byte {
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	job := &DownloadJob{ID: id, TitleID: "00050000101C9500", Status: statusCompleted, OutputDir: filepath.Join(server.downloadsDir, id)}
+	job.progress = NewAPIProgressReporter(job)
+	server.jobs[job.ID] = job
+
+	files := map[string][]byte{
+		"title.tmd":            bytes.Repeat([]byte("tmd"), 700),
+		"title.tik":            {},
+		"content/00000000.app": bytes.Repeat([]byte{0, 1, 2, 3, 4, 5, 6}, 10000),
+		"content/Füße.h3":      []byte("hash"),
+	}
+	for name, data := range files {
+		file := filepath.Join(job.OutputDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(job.OutputDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// readTestArchive returns the contents of the files in a zip or tar archive.
+func readTestArchive(t *testing.T, format string, body []byte) map[string][]byte {
+	files := make(map[string][]byte)
+	switch format {
+	case "zip":
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatalf("Failed to read the zip archive: %v", err)
+		}
+		for _, file := range zr.File {
+			if file.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := file.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("Failed to read %s: %v", file.Name, err)
+			}
+			files[file.Name] = data
+		}
+	case "tar":
+		tr := tar.NewReader(bytes.NewReader(body))
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Failed to read the tar archive: %v", err)
+			}
+			if header.Typeflag == tar.TypeDir {
+				continue
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[header.Name] = data
+		}
+	}
+	return files
+}
+
+// TestJobArchive tests streaming the files of a completed job as zip and tar archives
+func TestJobArchive(t *testing.T) {
+	server := NewServer(t.TempDir())
+	files := archiveTestJob(t, server, "job")
+	want := make(map[string][]byte)
+	for name, data := range files {
+		want["job/"+name] = data
+	}
+	server.jobs["running"] = &DownloadJob{ID: "running", Status: statusDownloading, OutputDir: server.downloadsDir}
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for key := range header {
+			req.Header.Set(key, header.Get(key))
+		}
+		rr := httptest.NewRecorder()
+		server.router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, format := range []string{"zip", "tar"} {
+		rr := get("/api/download/job/archive?format="+format, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for the %s archive, got %d: %s", format, rr.Code, rr.Body.String())
+		}
+		if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="job.`+format+`"` {
+			t.Errorf("Unexpected Content-Disposition %q", got)
+		}
+		body := rr.Body.Bytes()
+		if got := readTestArchive(t, format, body); !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected the %s archive to hold %v, got %v", format, len(want), len(got))
+		}
+
+		etag := rr.Header().Get("ETag")
+		for _, tt := range []struct {
+			rng        string
+			start, end int
+		}{{"bytes=100-5000", 100, 5001}, {"bytes=-50", len(body) - 50, len(body)}} {
+			rr := get("/api/download/job/archive?format="+format, http.Header{"Range": {tt.rng}, "If-Range": {etag}})
+			if rr.Code != http.StatusPartialContent || !bytes.Equal(rr.Body.Bytes(), body[tt.start:tt.end]) {
+				t.Errorf("Expected %s of the %s archive, got %d with %d bytes", tt.rng, format, rr.Code, rr.Body.Len())
+			}
+		}
+
+		// a fresh archive read from the middle checksums the files it skipped
+		archive, err := NewArchive(filepath.Join(server.downloadsDir, "job"), "job", format, newCRCCache())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if archive.Size() != int64(len(body)) {
+			t.Errorf("Expected the %s archive to be %d bytes, got %d", format, len(body), archive.Size())
+		}
+		if _, err := archive.Seek(int64(len(body)/2), io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if rest, err := io.ReadAll(archive); err != nil || !bytes.Equal(rest, body[len(body)/2:]) {
+			t.Errorf("Expected the second half of the %s archive, got %d bytes, %v", format, len(rest), err)
+		}
+		archive.Close()
+	}
+
+	// zip64 fields, without writing 4 GiB of files
+	defer func(max int64) { zipUint32Max = max }(zipUint32Max)
+	zipUint32Max = 1000
+	rr := get("/api/download/job/archive", nil)
+	if got := readTestArchive(t, "zip", rr.Body.Bytes()); rr.Code != http.StatusOK || !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the zip64 archive to hold the files, got %d with %d files", rr.Code, len(got))
+	}
+
+	rr = get("/api/download/job/archive?format=rar", nil)
+	var errResp map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &errResp); rr.Code != http.StatusBadRequest || err != nil || errResp["error"] == "" {
+		t.Errorf("Expected a JSON 400 for an unknown format, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := get("/api/download/running/archive", nil); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a job that isn't completed, got %d", rr.Code)
+	}
+	if rr := get("/api/download/missing/archive", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown job, got %d", rr.Code)
+	}
+}
+
+// TestJobFiles tests listing and downloading the files of a completed job
+func TestJobFiles(t *testing.T) {
+	server := NewServer(t.TempDir())
+	files := archiveTestJob(t, server, "job")
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		for key := range header {
+			req.Header.Set(key, header.Get(key))
+		}
+		rr := httptest.NewRecorder()
+		server.router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := get("/api/download/job/files", nil)
+	var response struct {
+		Count     int   `json:"count"`
+		TotalSize int64 `json:"total_size"`
+		Files     []struct {
+			Path string `json:"path"`
+			Size int64  `json:"size"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("Expected a file list, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if response.Count != len(files) || len(response.Files) != len(files) {
+		t.Fatalf("Expected %d files, got %+v", len(files), response)
+	}
+	var totalSize int64
+	for _, file := range response.Files {
+		if data, ok := files[file.Path]; !ok || int64(len(data)) != file.Size {
+			t.Errorf("Unexpected file %s of %d bytes", file.Path, file.Size)
+		}
+		totalSize += file.Size
+	}
+	if response.TotalSize != totalSize {
+		t.Errorf("Expected a total size of %d, got %d", totalSize, response.TotalSize)
+	}
+
+	rr = get("/api/download/job/files/content/00000000.app", nil)
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), files["content/00000000.app"]) {
+		t.Errorf("Expected the file, got %d with %d bytes", rr.Code, rr.Body.Len())
+	}
+	rr = get("/api/download/job/files/title.tmd", http.Header{"Range": {"bytes=10-19"}})
+	if rr.Code != http.StatusPartialContent || !bytes.Equal(rr.Body.Bytes(), files["title.tmd"][10:20]) {
+		t.Errorf("Expected a part of the file, got %d %q", rr.Code, rr.Body.String())
+	}
+	for _, path := range []string{"link", "content", "missing"} {
+		if rr := get("/api/download/job/files/"+path, nil); rr.Code != http.StatusNotFound {
+			t.Errorf("Expected 404 for %s, got %d: %s", path, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+// TestStartDownloadJobID tests that jobs are named after the version they
+// download and that identical requests get their own jobs
+func TestStartDownloadJobID(t *testing.T) {
+	server := NewServer(t.TempDir())
+	server.queue.SetWorkers(0)
+	server.latestVersion = func(string) (uint16, error) { return 48, nil }
+
+	first, err := server.startDownload(downloadRequest{TitleID: "00050000101C9500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := server.startDownload(downloadRequest{TitleID: "00050000101C9500"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == second.ID || first.OutputDir == second.OutputDir {
+		t.Errorf("Expected identical requests to get their own jobs, got %s twice", first.ID)
+	}
+	for _, job := range []*DownloadJob{first, second} {
+		if !strings.HasPrefix(job.ID, "00050000101C9500_v48_") || job.Version != 48 {
+			t.Errorf("Expected a job of the resolved version 48, got %s v%d", job.ID, job.Version)
+		}
+	}
+
+	version := 32
+	job, err := server.startDownload(downloadRequest{TitleID: "00050000101C9500", Version: &version})
+	if err != nil || !strings.HasPrefix(job.ID, "00050000101C9500_v32_") {
+		t.Errorf("Expected a job of version 32, got %v, %v", job, err)
+	}
+
+	server.latestVersion = func(string) (uint16, error) { return 0, io.ErrUnexpectedEOF }
+	if _, err := server.startDownload(downloadRequest{TitleID: "00050000101C9500"}); err == nil || err.(*apiError).status != http.StatusBadGateway {
+		t.Errorf("Expected 502 when the CDN doesn't answer, got %v", err)
+	}
+}
+
+// TestCallbackAddresses tests that the callback URLs of requests can't reach
+// the server's own network
+func TestCallbackAddresses(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"0.0.0.0":         false,
+		"::ffff:10.0.0.1": false,
+	} {
+		if got := isPublicAddress(netip.MustParseAddr(addr)); got != public {
+			t.Errorf("isPublicAddress(%s) = %v, want %v", addr, got, public)
+		}
+	}
+
+	hits := 0
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits++ }))
+	defer callback.Close()
+	server := NewServer(t.TempDir())
+
+	job := &DownloadJob{ID: "00050000101c9500_1", TitleID: "00050000101c9500", Status: statusCompleted, CallbackURL: callback.URL}
+	job.progress = NewAPIProgressReporter(job)
+	job.Webhook = &WebhookDelivery{URL: callback.URL, Status: "pending"}
+	server.deliverWebhook(job)
+	if hits != 0 || job.Webhook.Status != "failed" || job.Webhook.Attempts != 1 || !strings.Contains(job.Webhook.Error, errPrivateCallback.Error()) {
+		t.Errorf("Expected the loopback callback to be refused once, got %d hits and %+v", hits, job.Webhook)
+	}
+
+	// the operator's own webhook URL may be on the server's network
+	server.webhookURL = callback.URL
+	job.Webhook = &WebhookDelivery{URL: callback.URL, Status: "pending"}
+	server.deliverWebhook(job)
+	if hits != 1 || job.Webhook.Status != "delivered" {
+		t.Errorf("Expected the -webhook-url to be notified, got %d hits and %+v", hits, job.Webhook)
+	}
+}
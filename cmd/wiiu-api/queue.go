@@ -0,0 +1,161 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+)
+
+const (
+	// defaultWorkers is how many downloads run at the same time
+	defaultWorkers = 2
+	// defaultQueueSize is how many jobs can wait for a worker
+	defaultQueueSize = 100
+)
+
+// errQueueFull is returned by Push when the queue holds its maximum of jobs
+var errQueueFull = errors.New("the download queue is full")
+
+// JobQueue hands pending jobs to a pool of workers, higher priorities first
+// and jobs of the same priority in the order they were queued.
+type JobQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    queuedJobs
+	seq     uint64
+	size    int // maximum number of waiting jobs, 0 for no limit
+	workers int // number of workers wanted
+	running int // number of worker goroutines alive
+	run     func(*DownloadJob)
+}
+
+type queuedJob struct {
+	job *DownloadJob
+	seq uint64
+}
+
+// queuedJobs is a container/heap of the waiting jobs
+type queuedJobs []queuedJob
+
+func (q queuedJobs) Len() int { return len(q) }
+func (q queuedJobs) Less(i, j int) bool {
+	return queuedBefore(q[i], q[j])
+}
+func (q queuedJobs) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *queuedJobs) Push(x any)   { *q = append(*q, x.(queuedJob)) }
+func (q *queuedJobs) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+func queuedBefore(a, b queuedJob) bool {
+	if a.job.Priority != b.job.Priority {
+		return a.job.Priority > b.job.Priority
+	}
+	return a.seq < b.seq
+}
+
+// NewJobQueue returns a queue holding at most size jobs, run is called by the
+// workers for every job. No worker runs until SetWorkers is called.
+func NewJobQueue(size int, run func(*DownloadJob)) *JobQueue {
+	q := &JobQueue{size: size, run: run}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// SetWorkers changes how many jobs run at the same time. Workers above the
+// new count stop once their current job is done.
+func (q *JobQueue) SetWorkers(workers int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.workers = workers
+	for q.running < q.workers {
+		q.running++
+		go q.work()
+	}
+	q.cond.Broadcast()
+}
+
+// SetSize changes how many jobs can wait, jobs already queued stay queued.
+func (q *JobQueue) SetSize(size int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.size = size
+}
+
+// Push queues a job, it fails with errQueueFull if no more jobs can wait.
+func (q *JobQueue) Push(job *DownloadJob) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size > 0 && len(q.jobs) >= q.size {
+		return errQueueFull
+	}
+	q.seq++
+	heap.Push(&q.jobs, queuedJob{job: job, seq: q.seq})
+	q.cond.Signal()
+	return nil
+}
+
+// Remove takes a job out of the queue, reporting whether it was waiting.
+func (q *JobQueue) Remove(job *DownloadJob) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range q.jobs {
+		if q.jobs[i].job == job {
+			heap.Remove(&q.jobs, i)
+			return true
+		}
+	}
+	return false
+}
+
+// Position returns the place of a job in the queue starting at 1, or 0 if
+// it isn't waiting.
+func (q *JobQueue) Position(job *DownloadJob) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var queued *queuedJob
+	for i := range q.jobs {
+		if q.jobs[i].job == job {
+			queued = &q.jobs[i]
+			break
+		}
+	}
+	if queued == nil {
+		return 0
+	}
+	position := 1
+	for i := range q.jobs {
+		if queuedBefore(q.jobs[i], *queued) {
+			position++
+		}
+	}
+	return position
+}
+
+// Len returns the number of waiting jobs.
+func (q *JobQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+func (q *JobQueue) work() {
+	for {
+		q.mu.Lock()
+		for len(q.jobs) == 0 && q.running <= q.workers {
+			q.cond.Wait()
+		}
+		if q.running > q.workers {
+			q.running--
+			q.mu.Unlock()
+			return
+		}
+		job := heap.Pop(&q.jobs).(queuedJob).job
+		q.mu.Unlock()
+
+		q.run(job)
+	}
+}
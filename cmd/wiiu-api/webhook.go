@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// webhookMaxAttempts is how many times a webhook is sent before giving up
+const webhookMaxAttempts = 6
+
+// webhookRetryDelay is the wait before the first retry, it doubles with every
+// attempt. A variable so tests don't wait.
+var webhookRetryDelay = 2 * time.Second
+
+// Webhook headers, the signature is "sha256=" and the hex HMAC-SHA256 of the
+// body keyed with the webhook secret.
+const (
+	webhookEventHeader     = "X-WiiUDownloader-Event"
+	webhookSignatureHeader = "X-WiiUDownloader-Signature"
+)
+
+// WebhookDelivery is the state of the webhook sent when a job finishes.
+type WebhookDelivery struct {
+	URL          string     `json:"url"`
+	Status       string     `json:"status"` // pending, delivered, failed
+	Attempts     int        `json:"attempts"`
+	LastAttempt  *time.Time `json:"last_attempt,omitempty"`
+	ResponseCode int        `json:"response_code,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// validateCallbackURL checks that a callback URL is an absolute http or https URL.
+func validateCallbackURL(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &apiError{http.StatusBadRequest, "callback_url must be an http or https URL"}
+	}
+	return nil
+}
+
+// errPrivateCallback is returned when a callback URL of a request leads to
+// the server itself or its network.
+var errPrivateCallback = errors.New("callback URLs can't lead to loopback, private or link-local addresses")
+
+// isPublicAddress reports whether the callback URLs of requests may be sent
+// to an address.
+func isPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return !addr.IsLoopback() && !addr.IsPrivate() && !addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() && !addr.IsUnspecified() && !addr.IsMulticast()
+}
+
+// newCallbackClient returns the client the callback URLs of requests are
+// notified with. Unless allowPrivate is set it refuses to connect to
+// addresses that aren't public, checked on the address being dialed so
+// redirects and DNS rebinding can't get around it. Proxies from the
+// environment aren't used, the check would only see the proxy.
+func newCallbackClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddress(addrPort.Addr()) {
+				return errPrivateCallback
+			}
+			return nil
+		}
+	}
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// signWebhook returns the signature header of a webhook body.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// queueWebhook starts delivering the webhook of a finished job, if it has a
+// callback URL and none was sent yet.
+func (s *Server) queueWebhook(job *DownloadJob) {
+	callbackURL := job.CallbackURL
+	if callbackURL == "" {
+		callbackURL = s.webhookURL
+	}
+	if callbackURL == "" {
+		return
+	}
+
+	job.mu.Lock()
+	if job.Webhook != nil || !isFinalStatus(job.Status) {
+		job.mu.Unlock()
+		return
+	}
+	job.Webhook = &WebhookDelivery{URL: callbackURL, Status: "pending"}
+	job.mu.Unlock()
+
+	s.saveJob(job)
+	go s.deliverWebhook(job)
+}
+
+// deliverWebhook POSTs the final status of a job to its webhook URL, retrying
+// with a growing delay until it is accepted or webhookMaxAttempts is reached.
+// Client errors other than timeouts and rate limits aren't retried.
+func (s *Server) deliverWebhook(job *DownloadJob) {
+	event := "job." + job.state()
+	body, err := json.Marshal(map[string]interface{}{
+		"event":     event,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+		"job":       s.jobStatus(job),
+	})
+	if err != nil {
+		log.Printf("Failed to encode the webhook of job %s: %v", job.ID, err)
+		return
+	}
+
+	job.mu.RLock()
+	delivery := *job.Webhook
+	job.mu.RUnlock()
+
+	delay := webhookRetryDelay
+	for delivery.Attempts < webhookMaxAttempts {
+		if delivery.Attempts > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+
+		now := time.Now()
+		delivery.Attempts++
+		delivery.LastAttempt = &now
+		delivery.ResponseCode = 0
+		delivery.Error = ""
+
+		retry := true
+		code, err := s.sendWebhook(delivery.URL, event, body)
+		switch {
+		case err != nil:
+			delivery.Error = err.Error()
+			retry = !errors.Is(err, errPrivateCallback)
+		case code >= 200 && code < 300:
+			delivery.ResponseCode = code
+			delivery.Status = "delivered"
+			retry = false
+		default:
+			delivery.ResponseCode = code
+			delivery.Error = fmt.Sprintf("the callback URL answered with status %d", code)
+			retry = code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
+		}
+		if !retry || delivery.Attempts == webhookMaxAttempts {
+			if delivery.Status != "delivered" {
+				delivery.Status = "failed"
+				log.Printf("Giving up on the webhook of job %s: %s", job.ID, delivery.Error)
+			}
+		}
+
+		updated := delivery
+		job.mu.Lock()
+		job.Webhook = &updated
+		job.mu.Unlock()
+		s.saveJob(job)
+
+		if delivery.Status != "pending" {
+			return
+		}
+	}
+}
+
+func (s *Server) sendWebhook(callbackURL, event string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "WiiUDownloader-API")
+	req.Header.Set(webhookEventHeader, event)
+	if s.webhookSecret != "" {
+		req.Header.Set(webhookSignatureHeader, signWebhook(s.webhookSecret, body))
+	}
+
+	// the -webhook-url of the operator may be on the server's network, the
+	// callback URLs of requests only if -webhook-allow-private is set
+	client := s.callbackClient
+	if callbackURL == s.webhookURL {
+		client = s.webhookClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsRequest is a message sent by a WebSocket client, asyncapi.json describes
+// every type.
+type wsRequest struct {
+	Type  string `json:"type"`
+	ID    string `json:"id,omitempty"` // echoed in the reply to tell replies apart
+	JobID string `json:"job_id,omitempty"`
+	downloadRequest
+}
+
+// wsReply is a message sent to a WebSocket client, the reply to a request or
+// an event of a subscribed job.
+type wsReply struct {
+	Type  string                 `json:"type"` // result, error or event
+	ID    string                 `json:"id,omitempty"`
+	Event string                 `json:"event,omitempty"`
+	JobID string                 `json:"job_id,omitempty"`
+	Data  map[string]interface{} `json:"data,omitempty"`
+	Error string                 `json:"error,omitempty"`
+	Code  int                    `json:"code,omitempty"` // the HTTP status code of the same error in the REST API
+}
+
+// wsConnection is a WebSocket client with the jobs it subscribed to.
+type wsConnection struct {
+	server *Server
+	token  *APIToken // nil when authentication is disabled
+	admin  bool      // opened with admin credentials
+	ws     *websocket.Conn
+	out    chan wsReply
+	done   chan struct{}
+	once   sync.Once
+
+	mu            sync.Mutex
+	subscriptions map[string]chan JobEvent // by job ID, "" for all jobs
+}
+
+func (s *Server) handleWebSocket(ws *websocket.Conn) {
+	conn := &wsConnection{
+		server:        s,
+		token:         requestToken(ws.Request()),
+		admin:         s.isAdmin(ws.Request()),
+		ws:            ws,
+		out:           make(chan wsReply, eventsBuffer),
+		done:          make(chan struct{}),
+		subscriptions: make(map[string]chan JobEvent),
+	}
+	defer conn.close()
+	go conn.writeLoop()
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			if err != io.EOF {
+				log.Printf("WebSocket closed: %v", err)
+			}
+			return
+		}
+		var req wsRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			conn.send(wsReply{Type: "error", Error: "Invalid JSON", Code: http.StatusBadRequest})
+			continue
+		}
+		conn.handle(req)
+	}
+}
+
+// wsScopes are the token scopes the message types need
+var wsScopes = map[string]string{
+	"subscribe":   scopeDownloadsRead,
+	"unsubscribe": scopeDownloadsRead,
+	"status":      scopeDownloadsRead,
+	"start":       scopeDownloadsStart,
+	"cancel":      scopeDownloadsCancel,
+	"pause":       scopeDownloadsCancel,
+	"resume":      scopeDownloadsCancel,
+}
+
+// allow checks a message against the scopes and rate limit of the token the
+// connection was opened with.
+func (c *wsConnection) allow(messageType string) error {
+	scope, ok := wsScopes[messageType]
+	if !ok {
+		return &apiError{http.StatusBadRequest, "Unknown message type " + messageType}
+	}
+	if c.token == nil {
+		return nil
+	}
+	if !c.token.HasScope(scope) {
+		return &apiError{http.StatusForbidden, "The token lacks the " + scope + " scope"}
+	}
+	if ok, _ := c.token.allowRequest(time.Now()); !ok {
+		return &apiError{http.StatusTooManyRequests, "Rate limit exceeded"}
+	}
+	return nil
+}
+
+func (c *wsConnection) handle(req wsRequest) {
+	var data map[string]interface{}
+	err := c.allow(req.Type)
+
+	switch {
+	case err != nil:
+	case req.Type == "subscribe":
+		data, err = c.subscribe(req.JobID)
+	case req.Type == "unsubscribe":
+		c.unsubscribe(req.JobID)
+	case req.Type == "status":
+		var job *DownloadJob
+		if job, err = c.server.findJob(req.JobID); err == nil {
+			data = c.server.jobStatus(job)
+		}
+	case req.Type == "start":
+		var job *DownloadJob
+		if job, err = c.server.startDownloadAs(c.token, c.admin, req.downloadRequest); err == nil {
+			// a started job's events go to the connection that started it
+			c.subscribe(job.ID)
+			data = c.server.jobStatus(job)
+		}
+	case req.Type == "cancel":
+		data, err = c.jobAction(c.server.cancelDownload, req.JobID)
+	case req.Type == "pause":
+		data, err = c.jobAction(c.server.pauseDownload, req.JobID)
+	case req.Type == "resume":
+		data, err = c.jobAction(c.server.resumeDownload, req.JobID)
+	}
+
+	if err != nil {
+		reply := wsReply{Type: "error", ID: req.ID, JobID: req.JobID, Error: err.Error(), Code: http.StatusInternalServerError}
+		if apiErr, ok := err.(*apiError); ok {
+			reply.Code = apiErr.status
+		}
+		c.send(reply)
+		return
+	}
+	c.send(wsReply{Type: "result", ID: req.ID, JobID: req.JobID, Data: data})
+}
+
+func (c *wsConnection) jobAction(action func(string) (*DownloadJob, error), jobID string) (map[string]interface{}, error) {
+	job, err := action(jobID)
+	if err != nil {
+		return nil, err
+	}
+	return c.server.jobStatus(job), nil
+}
+
+// subscribe sends the events of a job, or of all jobs if jobID is empty, and
+// returns their current status.
+func (c *wsConnection) subscribe(jobID string) (map[string]interface{}, error) {
+	var status map[string]interface{}
+	if jobID != "" {
+		job, err := c.server.findJob(jobID)
+		if err != nil {
+			return nil, err
+		}
+		status = c.server.jobStatus(job)
+	}
+
+	c.mu.Lock()
+	_, subscribed := c.subscriptions[jobID]
+	if _, all := c.subscriptions[""]; all && jobID != "" {
+		// the events of every job already come through
+		subscribed = true
+	}
+	if !subscribed {
+		events := c.server.events.Subscribe(jobID)
+		c.subscriptions[jobID] = events
+		go c.forward(jobID, events)
+	}
+	c.mu.Unlock()
+
+	if jobID != "" {
+		return status, nil
+	}
+	c.server.jobsMutex.RLock()
+	jobs := make([]map[string]interface{}, 0, len(c.server.jobs))
+	for _, job := range c.server.jobs {
+		jobs = append(jobs, c.server.jobStatus(job))
+	}
+	c.server.jobsMutex.RUnlock()
+	return map[string]interface{}{"jobs": jobs}, nil
+}
+
+func (c *wsConnection) unsubscribe(jobID string) {
+	c.mu.Lock()
+	events, ok := c.subscriptions[jobID]
+	delete(c.subscriptions, jobID)
+	c.mu.Unlock()
+	if ok {
+		c.server.events.Unsubscribe(events)
+	}
+}
+
+// forward sends the events of a subscription until it ends. A subscription
+// the broker dropped for falling behind closes the connection, so the client
+// knows to reconnect instead of silently missing events.
+func (c *wsConnection) forward(jobID string, events chan JobEvent) {
+	for event := range events {
+		c.send(wsReply{Type: "event", Event: event.Type, JobID: event.JobID, Data: event.Data})
+	}
+	c.mu.Lock()
+	dropped := c.subscriptions[jobID] == events
+	c.mu.Unlock()
+	if dropped {
+		c.close()
+	}
+}
+
+// send queues a message for the client, dropping it once the connection is closed.
+func (c *wsConnection) send(reply wsReply) {
+	select {
+	case c.out <- reply:
+	case <-c.done:
+	}
+}
+
+func (c *wsConnection) writeLoop() {
+	for {
+		select {
+		case reply := <-c.out:
+			if err := websocket.JSON.Send(c.ws, reply); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wsConnection) close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		subscriptions := c.subscriptions
+		c.subscriptions = make(map[string]chan JobEvent)
+		c.mu.Unlock()
+		for _, events := range subscriptions {
+			c.server.events.Unsubscribe(events)
+		}
+		c.ws.Close()
+	})
+}
+
+// checkWebSocketOrigin refuses connections from browser pages on origins the
+// CORS policy doesn't allow, clients that send no Origin aren't browsers.
+func (s *Server) checkWebSocketOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin != "" && !isSameOrigin(origin, r) && s.cors.allowOrigin(origin) == "" {
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+	return nil
+}
+
+func (s *Server) handleAsyncAPISpec(w http.ResponseWriter, r *http.Request) {
+	specFile := "/app/asyncapi.json"
+	if _, err := os.Stat(specFile); os.IsNotExist(err) {
+		http.Error(w, "AsyncAPI spec not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, specFile)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	wiiudownloader "github.com/Xpl0itU/WiiUDownloader"
+	"github.com/dustin/go-humanize"
+)
+
+// CLIProgressReporter prints progress to stderr and is cancelled by Ctrl+C
+type CLIProgressReporter struct {
+	cancelled    atomic.Bool
+	lastProgress atomic.Int64
+}
+
+func (c *CLIProgressReporter) SetGameTitle(title string) {
+	fmt.Fprintln(os.Stderr, title)
+}
+
+func (c *CLIProgressReporter) UpdateDownloadProgress(downloaded int64, filename string) {}
+
+func (c *CLIProgressReporter) UpdateDecryptionProgress(progress float64) {
+	percent := int64(progress * 100)
+	if c.lastProgress.Swap(percent) != percent {
+		fmt.Fprintf(os.Stderr, "\r%3d%%", percent)
+		if percent == 100 {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
+
+func (c *CLIProgressReporter) Cancelled() bool {
+	return c.cancelled.Load()
+}
+
+func (c *CLIProgressReporter) SetCancelled() {
+	c.cancelled.Store(true)
+}
+
+func (c *CLIProgressReporter) MarkFileAsDone(filename string) {
+	fmt.Fprintln(os.Stderr, filename)
+}
+
+func (c *CLIProgressReporter) SetDownloadSize(size int64)                                  {}
+func (c *CLIProgressReporter) ResetTotals()                                                {}
+func (c *CLIProgressReporter) SetTotalDownloadedForFile(filename string, downloaded int64) {}
+func (c *CLIProgressReporter) SetStartTime(startTime time.Time)                            {}
+
+func newCLIProgressReporter() *CLIProgressReporter {
+	progressReporter := &CLIProgressReporter{}
+	progressReporter.lastProgress.Store(-1)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		fmt.Fprintln(os.Stderr, "\nCancelling...")
+		progressReporter.SetCancelled()
+	}()
+	return progressReporter
+}
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"compress", "compress [-verify] <input.wud> [output.wux]", "Compress a WUD disc image into a WUX", runCompress},
+		{"expand", "expand [-verify] <input.wux> [output.wud]", "Expand a WUX disc image back into a WUD", runExpand},
+		{"info", "info [-json] <title folder>", "Show the metadata of a downloaded or decrypted title", runInfo},
+		{"images", "images <title folder> [output folder]", "Save the icon and boot images of a title as PNGs", runImages},
+		{"export-titledb", "export-titledb [output.json]", "Write the built-in title database as JSON, to start a custom one", runExportTitleDB},
+		{"download", "download [-version n] [-decrypt] [-delete-encrypted] <title id> [output folder]", "Download a title, the latest version unless one is given", runDownload},
+		{"versions", "versions <title id>", "List the versions of a title the CDN still has", runVersions},
+		{"update", "update <title folder>", "Bring a downloaded title to the latest version, fetching only what changed", runUpdate},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the options of a command.\n", filepath.Base(os.Args[0]))
+}
+
+func newFlagSet(cmd string) *flag.FlagSet {
+	flags := flag.NewFlagSet(cmd, flag.ExitOnError)
+	flags.Usage = func() {
+		for _, c := range commands {
+			if c.name == cmd {
+				fmt.Fprintf(os.Stderr, "Usage: %s %s\n", filepath.Base(os.Args[0]), c.usage)
+			}
+		}
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// imagePaths returns the input path and the output path, which defaults to
+// the input with its extension swapped.
+func imagePaths(flags *flag.FlagSet, outputExt string) (string, string, error) {
+	switch flags.NArg() {
+	case 1:
+		input := flags.Arg(0)
+		return input, strings.TrimSuffix(input, filepath.Ext(input)) + outputExt, nil
+	case 2:
+		return flags.Arg(0), flags.Arg(1), nil
+	default:
+		flags.Usage()
+		return "", "", fmt.Errorf("expected an input and an optional output path")
+	}
+}
+
+func runCompress(args []string) error {
+	flags := newFlagSet("compress")
+	verify := flags.Bool("verify", true, "Read the result back and compare its hash with the input")
+	flags.Parse(args)
+
+	input, output, err := imagePaths(flags, ".wux")
+	if err != nil {
+		return err
+	}
+	return wiiudownloader.CompressWUD(input, output, *verify, newCLIProgressReporter())
+}
+
+func runExpand(args []string) error {
+	flags := newFlagSet("expand")
+	verify := flags.Bool("verify", true, "Read the result back and compare its hash with the input")
+	flags.Parse(args)
+
+	input, output, err := imagePaths(flags, ".wud")
+	if err != nil {
+		return err
+	}
+	return wiiudownloader.ExpandWUX(input, output, *verify, newCLIProgressReporter())
+}
+
+func runInfo(args []string) error {
+	flags := newFlagSet("info")
+	asJSON := flags.Bool("json", false, "Print the metadata as JSON")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected the folder of a title")
+	}
+	metadata, err := wiiudownloader.ReadTitleMetadata(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(metadata)
+	}
+
+	oneLine := func(s string) string {
+		return strings.ReplaceAll(s, "\n", " ")
+	}
+	fmt.Printf("Name:         %s\n", oneLine(metadata.Name()))
+	fmt.Printf("Publisher:    %s\n", metadata.Publishers["en"])
+	fmt.Printf("Title ID:     %016X (%s)\n", metadata.TitleID, wiiudownloader.GetFormattedKind(metadata.TitleID))
+	fmt.Printf("Version:      %d\n", metadata.TitleVersion)
+	fmt.Printf("Product code: %s\n", metadata.ProductCode)
+	fmt.Printf("Company code: %s\n", metadata.CompanyCode)
+	fmt.Printf("Region:       %s\n", wiiudownloader.GetFormattedRegion(uint8(metadata.Region)))
+	fmt.Printf("OS version:   %016X\n", metadata.OSVersion)
+	fmt.Printf("SDK version:  %d\n", metadata.SDKVersion)
+	if metadata.Executable != "" {
+		fmt.Printf("Executable:   %s\n", metadata.Executable)
+	}
+	fmt.Println("Names:")
+	for _, language := range wiiudownloader.METADATA_LANGUAGES {
+		if name, ok := metadata.LongNames[language]; ok {
+			fmt.Printf("  %-4s %s\n", language, oneLine(name))
+		}
+	}
+	return nil
+}
+
+func runImages(args []string) error {
+	flags := newFlagSet("images")
+	flags.Parse(args)
+
+	var input, output string
+	switch flags.NArg() {
+	case 1:
+		input, output = flags.Arg(0), "."
+	case 2:
+		input, output = flags.Arg(0), flags.Arg(1)
+	default:
+		flags.Usage()
+		return fmt.Errorf("expected the folder of a title and an optional output folder")
+	}
+	written, err := wiiudownloader.ExtractTitleImages(input, output)
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	return err
+}
+
+func runExportTitleDB(args []string) error {
+	flags := newFlagSet("export-titledb")
+	flags.Parse(args)
+
+	switch flags.NArg() {
+	case 0:
+		return wiiudownloader.DefaultTitleDB().WriteJSON(os.Stdout)
+	case 1:
+		f, err := os.Create(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		err = wiiudownloader.DefaultTitleDB().WriteJSON(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	default:
+		flags.Usage()
+		return fmt.Errorf("expected an optional output path")
+	}
+}
+
+func newHTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 100,
+			MaxConnsPerHost:     100,
+		},
+	}
+}
+
+// titleIDArg returns the title ID argument as the 16 digit hex the CDN uses
+func titleIDArg(arg string) (string, error) {
+	tid, err := strconv.ParseUint(arg, 16, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid title id %q", arg)
+	}
+	return fmt.Sprintf("%016x", tid), nil
+}
+
+func runDownload(args []string) error {
+	flags := newFlagSet("download")
+	version := flags.Int("version", wiiudownloader.TITLE_VERSION_LATEST, "Version to download, see the versions command")
+	decrypt := flags.Bool("decrypt", false, "Decrypt the contents after downloading")
+	deleteEncrypted := flags.Bool("delete-encrypted", false, "Delete the encrypted contents after decrypting")
+	flags.Parse(args)
+
+	var output string
+	switch flags.NArg() {
+	case 1:
+		output = "."
+	case 2:
+		output = flags.Arg(1)
+	default:
+		flags.Usage()
+		return fmt.Errorf("expected a title id and an optional output folder")
+	}
+	titleID, err := titleIDArg(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	client := newHTTPClient()
+	if *version == wiiudownloader.TITLE_VERSION_LATEST {
+		latest, err := wiiudownloader.LatestTitleVersion(titleID, client)
+		if err != nil {
+			return fmt.Errorf("failed to get the latest version: %w", err)
+		}
+		*version = int(latest)
+	} else if *version < 0 || *version > 0xFFFF {
+		return fmt.Errorf("invalid title version %d", *version)
+	}
+
+	// versions get their own folder so they can be kept side by side
+	outputDir := filepath.Join(output, wiiudownloader.TitleDirectoryName(titleID, uint16(*version)))
+	progressReporter := newCLIProgressReporter()
+	if err := wiiudownloader.DownloadTitleVersion(titleID, *version, outputDir, *decrypt, progressReporter, *deleteEncrypted, client); err != nil {
+		return err
+	}
+	if progressReporter.Cancelled() {
+		return fmt.Errorf("download cancelled")
+	}
+	fmt.Println(outputDir)
+	return nil
+}
+
+func runVersions(args []string) error {
+	flags := newFlagSet("versions")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a title id")
+	}
+	titleID, err := titleIDArg(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	versions, err := wiiudownloader.ProbeTitleVersions(titleID, newHTTPClient())
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		fmt.Println(version)
+	}
+	return nil
+}
+
+func runUpdate(args []string) error {
+	flags := newFlagSet("update")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected the folder of a downloaded title")
+	}
+	result, err := wiiudownloader.UpdateTitle(flags.Arg(0), newCLIProgressReporter(), newHTTPClient())
+	if err != nil {
+		return err
+	}
+	if result.UpToDate() {
+		fmt.Printf("Already at the latest version, v%d\n", result.NewVersion)
+		return nil
+	}
+	fmt.Printf("Updated from v%d to v%d\n", result.OldVersion, result.NewVersion)
+	if result.Dir != filepath.Clean(flags.Arg(0)) {
+		fmt.Printf("Renamed the folder to %s\n", result.Dir)
+	}
+	fmt.Printf("Downloaded %d contents (%s), kept %d (%s saved), removed %d\n",
+		len(result.Downloaded), humanize.Bytes(result.BytesDownloaded),
+		len(result.Reused), humanize.Bytes(result.BytesSaved), len(result.Removed))
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 var commonKey = []byte{0xD7, 0xB0, 0x04, 0x02, 0x65, 0x9B, 0xA2, 0xAB, 0xD2, 0xCB, 0x0D, 0xB2, 0x7F, 0xA2, 0xB6, 0x56}
@@ -70,17 +71,11 @@ type FSTData struct {
 	FSTEntries  []FEntry
 }
 
-func extractFileHash(src *os.File, partDataOffset uint64, fileOffset uint64, size uint64, path string, contentId uint16, cipherHashTree cipher.Block) error {
+func extractFileHash(src io.ReadSeeker, partDataOffset uint64, fileOffset uint64, size uint64, dst io.Writer, contentId uint16, cipherHashTree cipher.Block) error {
 	writeSize := HASH_BLOCK_SIZE
 	blockNumber := (fileOffset / HASH_BLOCK_SIZE) & 0x0F
 
-	dst, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("could not create '%s': %w", path, err)
-	}
-	defer dst.Close()
 	bw := bufio.NewWriterSize(dst, BLOCK_SIZE_HASHED)
-	defer bw.Flush()
 
 	roffset := fileOffset / HASH_BLOCK_SIZE * BLOCK_SIZE_HASHED
 	soffset := fileOffset - (fileOffset / HASH_BLOCK_SIZE * HASH_BLOCK_SIZE)
@@ -89,8 +84,7 @@ func extractFileHash(src *os.File, partDataOffset uint64, fileOffset uint64, siz
 		writeSize = writeSize - int(soffset)
 	}
 
-	_, err = src.Seek(int64(partDataOffset+roffset), io.SeekStart)
-	if err != nil {
+	if _, err := src.Seek(int64(partDataOffset+roffset), io.SeekStart); err != nil {
 		return err
 	}
 
@@ -137,19 +131,13 @@ func extractFileHash(src *os.File, partDataOffset uint64, fileOffset uint64, siz
 		}
 	}
 
-	return nil
+	return bw.Flush()
 }
 
-func extractFile(src *os.File, partDataOffset uint64, fileOffset uint64, size uint64, path string, contentId uint16, cipherHashTree cipher.Block) error {
+func extractFile(src io.ReadSeeker, partDataOffset uint64, fileOffset uint64, size uint64, dst io.Writer, contentId uint16, cipherHashTree cipher.Block) error {
 	writeSize := BLOCK_SIZE
 
-	dst, err := os.Create(path)
-	if err != nil {
-		return fmt.Errorf("could not create '%s': %w", path, err)
-	}
-	defer dst.Close()
 	bw := bufio.NewWriterSize(dst, BLOCK_SIZE)
-	defer bw.Flush()
 
 	roffset := fileOffset / BLOCK_SIZE * BLOCK_SIZE
 	soffset := fileOffset - (fileOffset / BLOCK_SIZE * BLOCK_SIZE)
@@ -158,8 +146,7 @@ func extractFile(src *os.File, partDataOffset uint64, fileOffset uint64, size ui
 		writeSize = writeSize - int(soffset)
 	}
 
-	_, err = src.Seek(int64(partDataOffset+roffset), io.SeekStart)
-	if err != nil {
+	if _, err := src.Seek(int64(partDataOffset+roffset), io.SeekStart); err != nil {
 		return err
 	}
 
@@ -192,7 +179,68 @@ func extractFile(src *os.File, partDataOffset uint64, fileOffset uint64, size ui
 		}
 	}
 
-	return nil
+	return bw.Flush()
+}
+
+// decryptedSink receives the files of a title while it is being decrypted.
+// Paths are slash separated and relative to the title root.
+type decryptedSink interface {
+	CreateFile(path string) (io.WriteCloser, error)
+}
+
+// errSkipFile is returned by a sink for files it doesn't want, those are
+// never decrypted.
+var errSkipFile = errors.New("skip file")
+
+// directorySink writes decrypted files below a directory on disk.
+type directorySink string
+
+func (d directorySink) CreateFile(path string) (io.WriteCloser, error) {
+	outputPath := filepath.Join(string(d), filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(outputPath), 0755); err != nil {
+		return nil, err
+	}
+	dst, err := os.Create(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not create '%s': %w", outputPath, err)
+	}
+	return dst, nil
+}
+
+// extractFileOffsetIV extracts a file from an unhashed disc cluster. Every
+// block is decrypted on its own with bytes 8-15 of the IV holding the block
+// offset inside the cluster shifted right by 16.
+func extractFileOffsetIV(src io.ReadSeeker, partDataOffset uint64, fileOffset uint64, size uint64, dst io.Writer, cipherHashTree cipher.Block) error {
+	bw := bufio.NewWriterSize(dst, BLOCK_SIZE)
+
+	roffset := fileOffset / BLOCK_SIZE * BLOCK_SIZE
+	soffset := fileOffset - roffset
+
+	if _, err := src.Seek(int64(partDataOffset+roffset), io.SeekStart); err != nil {
+		return err
+	}
+
+	for size > 0 {
+		if _, err := io.ReadFull(src, encryptedContentBuffer); err != nil {
+			return fmt.Errorf("failed to read encrypted content block at offset %d (expected %d bytes): %w",
+				partDataOffset+roffset, BLOCK_SIZE, err)
+		}
+
+		var ivBlock [aes.BlockSize]byte
+		binary.BigEndian.PutUint64(ivBlock[8:], roffset>>16)
+		cipher.NewCBCDecrypter(cipherHashTree, ivBlock[:]).CryptBlocks(decryptedContentBuffer, encryptedContentBuffer)
+
+		writeSize := min(size, BLOCK_SIZE-soffset)
+		if _, err := bw.Write(decryptedContentBuffer[soffset : soffset+writeSize]); err != nil {
+			return err
+		}
+
+		size -= writeSize
+		roffset += BLOCK_SIZE
+		soffset = 0
+	}
+
+	return bw.Flush()
 }
 
 func (fst *FSTData) Parse() error {
@@ -494,6 +542,13 @@ func decryptContentToBuffer(encryptedFile *os.File, decryptedBuffer *bytes.Buffe
 }
 
 func DecryptContents(path string, progressReporter ProgressReporter, deleteEncryptedContents bool) error {
+	if isWiiTitle(path) {
+		return decryptWiiContents(path, progressReporter, deleteEncryptedContents)
+	}
+	return decryptContentsToSink(path, directorySink(path), progressReporter, deleteEncryptedContents)
+}
+
+func decryptContentsToSink(path string, sink decryptedSink, progressReporter ProgressReporter, deleteEncryptedContents bool) error {
 	tmdPath := filepath.Join(path, "title.tmd")
 	if _, err := os.Stat(tmdPath); os.IsNotExist(err) {
 		return err
@@ -507,18 +562,12 @@ func DecryptContents(path string, progressReporter ProgressReporter, deleteEncry
 	if err != nil {
 		return err
 	}
+	if tmd.Version == TMD_VERSION_WII {
+		return errors.New("wii titles have no file system to extract")
+	}
 
-	// Check if all contents are present and how they are named
-	for i := range tmd.Contents {
-		tmd.Contents[i].CIDStr = fmt.Sprintf("%08X", tmd.Contents[i].ID)
-		_, err := os.Stat(filepath.Join(path, tmd.Contents[i].CIDStr+".app"))
-		if err != nil {
-			tmd.Contents[i].CIDStr = fmt.Sprintf("%08x", tmd.Contents[i].ID)
-			_, err = os.Stat(filepath.Join(path, tmd.Contents[i].CIDStr+".app"))
-			if err != nil {
-				return errors.New("content not found")
-			}
-		}
+	if err := resolveContentNames(path, tmd); err != nil {
+		return err
 	}
 
 	// Find the encrypted titlekey
@@ -540,25 +589,11 @@ func DecryptContents(path string, progressReporter ProgressReporter, deleteEncry
 			}
 		}
 	}
-	c, err := aes.NewCipher(commonKey)
+	cipherHashTree, err := newTitleCipher(commonKey, encryptedTitleKey, tmd.TitleID)
 	if err != nil {
 		return err
 	}
 
-	var titleIDBytes [8]byte
-	binary.BigEndian.PutUint64(titleIDBytes[:], tmd.TitleID)
-	var ivTitle [16]byte
-	copy(ivTitle[:], titleIDBytes[:])
-	cbc := cipher.NewCBCDecrypter(c, ivTitle[:])
-
-	decryptedTitleKey := make([]byte, len(encryptedTitleKey))
-	cbc.CryptBlocks(decryptedTitleKey, encryptedTitleKey)
-
-	cipherHashTree, err := aes.NewCipher(decryptedTitleKey)
-	if err != nil {
-		return fmt.Errorf("failed to create AES cipher: %w", err)
-	}
-
 	fstEncFile, err := os.Open(filepath.Join(path, tmd.Contents[0].CIDStr+".app"))
 	if err != nil {
 		return err
@@ -579,7 +614,54 @@ func DecryptContents(path string, progressReporter ProgressReporter, deleteEncry
 		return err
 	}
 
-	outputPath := path
+	if err := extractFSTFiles(&fst, sink, progressReporter, cipherHashTree, func(contentID uint16) (fstCluster, error) {
+		if int(contentID) >= len(tmd.Contents) {
+			return fstCluster{}, fmt.Errorf("content %d not found in tmd", contentID)
+		}
+		matchingContent := tmd.Contents[contentID]
+		srcFile, err := os.Open(filepath.Join(path, matchingContent.CIDStr+".app"))
+		if err != nil {
+			return fstCluster{}, err
+		}
+		return fstCluster{src: srcFile, hashed: matchingContent.Type&0x02 != 0, closer: srcFile}, nil
+	}); err != nil {
+		return err
+	}
+
+	if deleteEncryptedContents {
+		doDeleteEncryptedContents(path)
+	}
+	return nil
+}
+
+// resolveContentNames checks if all contents are present and how they are named
+func resolveContentNames(path string, tmd *TMD) error {
+	for i := range tmd.Contents {
+		tmd.Contents[i].CIDStr = fmt.Sprintf("%08X", tmd.Contents[i].ID)
+		_, err := os.Stat(filepath.Join(path, tmd.Contents[i].CIDStr+".app"))
+		if err != nil {
+			tmd.Contents[i].CIDStr = fmt.Sprintf("%08x", tmd.Contents[i].ID)
+			_, err = os.Stat(filepath.Join(path, tmd.Contents[i].CIDStr+".app"))
+			if err != nil {
+				return errors.New("content not found")
+			}
+		}
+	}
+	return nil
+}
+
+// fstCluster tells extractFSTFiles where the encrypted data of a cluster lives.
+type fstCluster struct {
+	src    io.ReadSeeker
+	offset uint64
+	hashed bool
+	// offsetIV marks unhashed disc clusters encrypted with the disc key,
+	// those derive the IV from the block offset instead of the content ID
+	offsetIV bool
+	closer   io.Closer
+}
+
+func extractFSTFiles(fst *FSTData, sink decryptedSink, progressReporter ProgressReporter, cipherHashTree cipher.Block, openCluster func(contentID uint16) (fstCluster, error)) error {
 	entry := make([]uint32, 0x10)
 	lEntry := make([]uint32, 0x10)
 	level := uint32(0)
@@ -601,7 +683,7 @@ func DecryptContents(path string, progressReporter ProgressReporter, deleteEncry
 			}
 		} else {
 			pathOffset := uint32(0)
-			outputPath = path
+			outputPath := make([]string, 0, level+1)
 			for j := uint32(0); j < level; j++ {
 				pathOffset = fst.FSTEntries[entry[j]].NameOffset & 0x00FFFFFF
 				fst.FSTReader.Seek(int64(fst.NamesOffset+pathOffset), io.SeekStart)
@@ -609,8 +691,7 @@ func DecryptContents(path string, progressReporter ProgressReporter, deleteEncry
 				if err != nil {
 					return fmt.Errorf("failed to read directory name: %w", err)
 				}
-				outputPath = filepath.Join(outputPath, directory)
-				os.MkdirAll(outputPath, 0755)
+				outputPath = append(outputPath, directory)
 			}
 			pathOffset = fst.FSTEntries[i].NameOffset & 0x00FFFFFF
 			fst.FSTReader.Seek(int64(fst.NamesOffset+pathOffset), io.SeekStart)
@@ -618,24 +699,38 @@ func DecryptContents(path string, progressReporter ProgressReporter, deleteEncry
 			if err != nil {
 				return fmt.Errorf("failed to read file name: %w", err)
 			}
-			outputPath = filepath.Clean(filepath.Join(outputPath, fileName))
+			outputPath = append(outputPath, fileName)
 			contentOffset := uint64(fst.FSTEntries[i].Offset)
 			if fst.FSTEntries[i].Flags&4 == 0 {
 				contentOffset <<= 5
 			}
 			if fst.FSTEntries[i].Type&0x80 == 0 {
-				matchingContent := tmd.Contents[fst.FSTEntries[i].ContentID]
-				tmdFlags := matchingContent.Type
-				srcFile, err := os.Open(filepath.Join(path, matchingContent.CIDStr+".app"))
+				dst, err := sink.CreateFile(strings.Join(outputPath, "/"))
+				if err == errSkipFile {
+					continue
+				}
 				if err != nil {
 					return err
 				}
-				if tmdFlags&0x02 != 0 {
-					err = extractFileHash(srcFile, 0, contentOffset, uint64(fst.FSTEntries[i].Length), outputPath, fst.FSTEntries[i].ContentID, cipherHashTree)
-				} else {
-					err = extractFile(srcFile, 0, contentOffset, uint64(fst.FSTEntries[i].Length), outputPath, fst.FSTEntries[i].ContentID, cipherHashTree)
+				cluster, err := openCluster(fst.FSTEntries[i].ContentID)
+				if err != nil {
+					dst.Close()
+					return err
+				}
+				switch {
+				case cluster.hashed:
+					err = extractFileHash(cluster.src, cluster.offset, contentOffset, uint64(fst.FSTEntries[i].Length), dst, fst.FSTEntries[i].ContentID, cipherHashTree)
+				case cluster.offsetIV:
+					err = extractFileOffsetIV(cluster.src, cluster.offset, contentOffset, uint64(fst.FSTEntries[i].Length), dst, cipherHashTree)
+				default:
+					err = extractFile(cluster.src, cluster.offset, contentOffset, uint64(fst.FSTEntries[i].Length), dst, fst.FSTEntries[i].ContentID, cipherHashTree)
+				}
+				if cluster.closer != nil {
+					cluster.closer.Close()
+				}
+				if closeErr := dst.Close(); err == nil {
+					err = closeErr
 				}
-				srcFile.Close()
 				if err != nil {
 					return err
 				}
@@ -644,9 +739,28 @@ func DecryptContents(path string, progressReporter ProgressReporter, deleteEncry
 	}
 
 	progressReporter.UpdateDecryptionProgress(1.0)
+	return nil
+}
 
-	if deleteEncryptedContents {
-		doDeleteEncryptedContents(path)
+// newTitleCipher decrypts a title key from a ticket with a common key.
+func newTitleCipher(commonKey, encryptedTitleKey []byte, titleID uint64) (cipher.Block, error) {
+	c, err := aes.NewCipher(commonKey)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+
+	var titleIDBytes [8]byte
+	binary.BigEndian.PutUint64(titleIDBytes[:], titleID)
+	var ivTitle [16]byte
+	copy(ivTitle[:], titleIDBytes[:])
+	cbc := cipher.NewCBCDecrypter(c, ivTitle[:])
+
+	decryptedTitleKey := make([]byte, len(encryptedTitleKey))
+	cbc.CryptBlocks(decryptedTitleKey, encryptedTitleKey)
+
+	cipherHashTree, err := aes.NewCipher(decryptedTitleKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+	return cipherHashTree, nil
 }
@@ -23,6 +23,16 @@ const (
 	maxConcurrentDownloads = 4
 )
 
+const (
+	// TITLE_VERSION_LATEST asks DownloadTitleVersion for the newest version
+	TITLE_VERSION_LATEST = -1
+	// TITLE_VERSION_STEP is the interval between title versions, v0, v16, v32...
+	TITLE_VERSION_STEP = 16
+)
+
+// cdnDownloadURL is where titles are downloaded from, one folder per title ID
+var cdnDownloadURL = "http://ccs.cdn.c.shop.nintendowifi.net/ccs/download"
+
 var (
 	errCancel = fmt.Errorf("cancelled download")
 )
@@ -143,6 +153,7 @@ func downloadFile(progressReporter ProgressReporter, client *http.Client, downlo
 		if err != nil {
 			file.Close()
 			resp.Body.Close()
+			writerProgress.Close()
 			if doRetries && attempt < maxRetries && !progressReporter.Cancelled() {
 				time.Sleep(retryDelay)
 				continue
@@ -151,6 +162,7 @@ func downloadFile(progressReporter ProgressReporter, client *http.Client, downlo
 		}
 		file.Close()
 		resp.Body.Close()
+		writerProgress.Close()
 		break
 	}
 
@@ -158,24 +170,70 @@ func downloadFile(progressReporter ProgressReporter, client *http.Client, downlo
 }
 
 func DownloadTitle(titleID, outputDirectory string, doDecryption bool, progressReporter ProgressReporter, deleteEncryptedContents bool, client *http.Client) error {
+	return DownloadTitleVersion(titleID, TITLE_VERSION_LATEST, outputDirectory, doDecryption, progressReporter, deleteEncryptedContents, client)
+}
+
+// titleTMDName is the name of a version's TMD on the CDN, plain "tmd" being
+// the latest one.
+func titleTMDName(version int) (string, error) {
+	if version == TITLE_VERSION_LATEST {
+		return "tmd", nil
+	}
+	if version < 0 || version > 0xFFFF {
+		return "", fmt.Errorf("invalid title version %d", version)
+	}
+	return fmt.Sprintf("tmd.%d", version), nil
+}
+
+// TitleDirectoryName is the folder name for a title ID and version. The
+// latest version is resolved with LatestTitleVersion first, so downloading it
+// and asking for its number land in the same folder.
+func TitleDirectoryName(titleID string, version uint16) string {
+	return fmt.Sprintf("%s_v%d", titleID, version)
+}
+
+// LatestTitleVersion returns the version of the latest TMD of a title on the
+// CDN.
+func LatestTitleVersion(titleID string, client *http.Client) (uint16, error) {
+	if _, err := strconv.ParseUint(titleID, 16, 64); err != nil {
+		return 0, err
+	}
+	tmdData, err := fetchTitleFile(client, fmt.Sprintf("%s/%s/tmd", cdnDownloadURL, titleID))
+	if err != nil {
+		return 0, err
+	}
+	tmd, err := ParseTMD(tmdData)
+	if err != nil {
+		return 0, err
+	}
+	return tmd.TitleVersion, nil
+}
+
+// DownloadTitleVersion downloads a specific version of a title, or the
+// latest one when version is TITLE_VERSION_LATEST.
+func DownloadTitleVersion(titleID string, version int, outputDirectory string, doDecryption bool, progressReporter ProgressReporter, deleteEncryptedContents bool, client *http.Client) error {
 	tid, err := strconv.ParseUint(titleID, 16, 64)
 	if err != nil {
 		return err
 	}
+	tmdName, err := titleTMDName(version)
+	if err != nil {
+		return err
+	}
 	tEntry := GetTitleEntryFromTid(tid)
 
 	progressReporter.ResetTotals()
 	progressReporter.SetGameTitle(tEntry.Name)
 
 	outputDir := strings.TrimRight(outputDirectory, "/\\")
-	baseURL := fmt.Sprintf("http://ccs.cdn.c.shop.nintendowifi.net/ccs/download/%s", titleID)
+	baseURL := fmt.Sprintf("%s/%s", cdnDownloadURL, titleID)
 
 	if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
 		return err
 	}
 
 	tmdPath := filepath.Join(outputDir, "title.tmd")
-	if err := downloadFile(progressReporter, client, fmt.Sprintf("%s/%s", baseURL, "tmd"), tmdPath, true); err != nil {
+	if err := downloadFile(progressReporter, client, fmt.Sprintf("%s/%s", baseURL, tmdName), tmdPath, true); err != nil {
 		if progressReporter.Cancelled() {
 			return nil
 		}
@@ -191,6 +249,9 @@ func DownloadTitle(titleID, outputDirectory string, doDecryption bool, progressR
 	if err != nil {
 		return err
 	}
+	if version != TITLE_VERSION_LATEST && int(tmd.TitleVersion) != version {
+		return fmt.Errorf("asked for version %d of %s but the CDN sent version %d", version, titleID, tmd.TitleVersion)
+	}
 
 	tikPath := filepath.Join(outputDir, "title.tik")
 	if err := downloadFile(progressReporter, client, fmt.Sprintf("%s/%s", baseURL, "cetk"), tikPath, false); err != nil {
@@ -268,3 +329,85 @@ func DownloadTitle(titleID, outputDirectory string, doDecryption bool, progressR
 
 	return nil
 }
+
+// ProbeTitleVersions returns the versions of a title the CDN still has, oldest
+// first. Only multiples of TITLE_VERSION_STEP up to the latest are tried.
+func ProbeTitleVersions(titleID string, client *http.Client) ([]uint16, error) {
+	latestVersion, err := LatestTitleVersion(titleID, client)
+	if err != nil {
+		return nil, err
+	}
+	baseURL := fmt.Sprintf("%s/%s", cdnDownloadURL, titleID)
+	latest := int(latestVersion)
+
+	found := make([]bool, latest/TITLE_VERSION_STEP+1)
+	g := errgroup.Group{}
+	g.SetLimit(maxConcurrentDownloads)
+	for i := range found {
+		version := i * TITLE_VERSION_STEP
+		if version == latest {
+			found[i] = true
+			continue
+		}
+		g.Go(func() error {
+			exists, err := titleFileExists(client, fmt.Sprintf("%s/tmd.%d", baseURL, version))
+			found[i] = exists
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	versions := make([]uint16, 0, len(found)+1)
+	for i, exists := range found {
+		if exists {
+			versions = append(versions, uint16(i*TITLE_VERSION_STEP))
+		}
+	}
+	// versions off the usual steps still get listed when they are the latest
+	if latest%TITLE_VERSION_STEP != 0 {
+		versions = append(versions, uint16(latest))
+	}
+	return versions, nil
+}
+
+func fetchTitleFile(client *http.Client, fileURL string) ([]byte, error) {
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "WiiUDownloader")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s, status code: %d", fileURL, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// titleFileExists tells a missing file apart from the CDN failing to answer,
+// the body isn't read so only small files should be checked this way.
+func titleFileExists(client *http.Client, fileURL string) (bool, error) {
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("User-Agent", "WiiUDownloader")
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check %s, status code: %d", fileURL, resp.StatusCode)
+	}
+}
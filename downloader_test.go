@@ -0,0 +1,97 @@
+package wiiudownloader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// serveTestCDN serves the files of one title by name, a nil file makes the
+// CDN answer with an error.
+func serveTestCDN(t *testing.T, files map[string][]byte) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[path.Base(r.URL.Path)]
+		switch {
+		case !ok:
+			w.WriteHeader(http.StatusNotFound)
+		case data == nil:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write(data)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	defaultURL := cdnDownloadURL
+	cdnDownloadURL = server.URL
+	t.Cleanup(func() { cdnDownloadURL = defaultURL })
+}
+
+func testTMD(titleID uint64, version uint16, contents ...Content) []byte {
+	return buildTMD(&TMD{TitleID: titleID, TitleVersion: version, ContentCount: uint16(len(contents)), Contents: contents}, 0, 0, nil)
+}
+
+func TestProbeTitleVersions(t *testing.T) {
+	const tid = 0x0005000E101C9500
+	serveTestCDN(t, map[string][]byte{"tmd": testTMD(tid, 48), "tmd.0": testTMD(tid, 0), "tmd.32": testTMD(tid, 32), "tmd.48": testTMD(tid, 48)})
+	versions, err := ProbeTitleVersions("0005000E101C9500", http.DefaultClient)
+	if err != nil {
+		t.Fatalf("ProbeTitleVersions failed: %v", err)
+	}
+	if !reflect.DeepEqual(versions, []uint16{0, 32, 48}) {
+		t.Errorf("unexpected versions %v", versions)
+	}
+
+	// a CDN error isn't mistaken for a missing version
+	serveTestCDN(t, map[string][]byte{"tmd": testTMD(tid, 80), "tmd.64": nil})
+	if _, err := ProbeTitleVersions("0005000E101C9500", http.DefaultClient); err == nil {
+		t.Error("expected the unavailable tmd.64 to fail the probe")
+	}
+}
+
+func TestDownloadTitleVersionMismatch(t *testing.T) {
+	// a CDN sending the wrong TMD is caught before anything else is downloaded
+	serveTestCDN(t, map[string][]byte{"tmd.16": testTMD(0x0005000E101C9500, 32)})
+	err := DownloadTitleVersion("0005000E101C9500", 16, t.TempDir(), false, testProgressReporter{}, false, http.DefaultClient)
+	if err == nil || !strings.Contains(err.Error(), "version 32") {
+		t.Errorf("expected a version mismatch, got %v", err)
+	}
+
+	if err := DownloadTitleVersion("0005000E101C9500", 0x10000, t.TempDir(), false, testProgressReporter{}, false, http.DefaultClient); err == nil {
+		t.Error("expected an out of range version to be rejected")
+	}
+	if name := TitleDirectoryName("0005000E101C9500", 16); name != "0005000E101C9500_v16" {
+		t.Errorf("unexpected directory name %q", name)
+	}
+
+	serveTestCDN(t, map[string][]byte{"tmd": testTMD(0x0005000E101C9500, 48)})
+	if version, err := LatestTitleVersion("0005000E101C9500", http.DefaultClient); err != nil || version != 48 {
+		t.Errorf("expected the latest version to be 48, got %d, %v", version, err)
+	}
+}
+
+// countingProgressReporter adds up the bytes reported for every file.
+type countingProgressReporter struct {
+	testProgressReporter
+	downloaded map[string]int64
+}
+
+func (r countingProgressReporter) UpdateDownloadProgress(downloaded int64, filename string) {
+	r.downloaded[filename] += downloaded
+}
+
+func TestDownloadFileReportsEveryByte(t *testing.T) {
+	// files written between two progress updates are reported once closed
+	serveTestCDN(t, map[string][]byte{"cetk": make([]byte, 2048)})
+	reporter := countingProgressReporter{downloaded: make(map[string]int64)}
+	if err := downloadFile(reporter, http.DefaultClient, cdnDownloadURL+"/cetk", filepath.Join(t.TempDir(), "title.tik"), false); err != nil {
+		t.Fatal(err)
+	}
+	if reporter.downloaded["title.tik"] != 2048 {
+		t.Errorf("expected 2048 bytes reported, got %d", reporter.downloaded["title.tik"])
+	}
+}
@@ -9,6 +9,7 @@ require (
 	github.com/dustin/go-humanize v1.0.1
 	github.com/gorilla/mux v1.8.1
 	github.com/gotk3/gotk3 v0.6.5-0.20240618185848-ff349ae13f56
+	github.com/klauspost/compress v1.18.0
 	golang.org/x/crypto v0.42.0
 )
 
@@ -27,7 +28,7 @@ require (
 
 require (
 	github.com/jbenet/go-context v0.0.0-20150711004518-d14ea06fba99
-	golang.org/x/net v0.44.0 // indirect
+	golang.org/x/net v0.44.0
 )
 
 require (
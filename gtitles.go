@@ -45,41 +45,12 @@ const (
 )
 
 func GetTitleEntries(category uint8) []TitleEntry {
-	titleEntries := make([]TitleEntry, 0)
-	for _, entry := range titleEntry {
-		if category == TITLE_CATEGORY_ALL || category == entry.Category {
-			if entry.Category == TITLE_CATEGORY_DISC {
-				continue
-			}
-			titleEntries = append(titleEntries, entry)
-		}
-	}
-	return titleEntries
+	return defaultTitleDB.Entries(category)
 }
 
+// GetFormattedRegion returns the display name of a TitleEntry's regions.
 func GetFormattedRegion(region uint8) string {
-	if region&MCP_REGION_EUROPE != 0 {
-		if region&MCP_REGION_USA != 0 {
-			if region&MCP_REGION_JAPAN != 0 {
-				return "All"
-			}
-			return "USA/Europe"
-		}
-		if region&MCP_REGION_JAPAN != 0 {
-			return "Europe/Japan"
-		}
-		return "Europe"
-	}
-	if region&MCP_REGION_USA != 0 {
-		if region&MCP_REGION_JAPAN != 0 {
-			return "USA/Japan"
-		}
-		return "USA"
-	}
-	if region&MCP_REGION_JAPAN != 0 {
-		return "Japan"
-	}
-	return "Unknown"
+	return Region(region).String()
 }
 
 func GetFormattedKind(titleID uint64) string {
@@ -127,10 +98,10 @@ func GetCategoryFromFormattedCategory(formattedCategory string) uint8 {
 }
 
 func GetTitleEntryFromTid(tid uint64) TitleEntry {
-	for _, entry := range GetTitleEntries(TITLE_CATEGORY_ALL) {
-		if entry.TitleID == tid {
-			return entry
-		}
-	}
-	return TitleEntry{}
+	return defaultTitleDB.EntryFromTid(tid)
+}
+
+// RelatedTitles returns the game, update, DLC and demo that go with tid.
+func RelatedTitles(tid uint64) []TitleEntry {
+	return defaultTitleDB.Related(tid)
 }
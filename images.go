@@ -0,0 +1,194 @@
+package wiiudownloader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ICON_TEX_PATH     = "meta/iconTex.tga"
+	BOOT_TV_TEX_PATH  = "meta/bootTvTex.tga"
+	BOOT_DRC_TEX_PATH = "meta/bootDrcTex.tga"
+
+	TGA_HEADER_SIZE          = 18
+	TGA_TYPE_TRUE_COLOR      = 2
+	TGA_TYPE_TRUE_COLOR_RLE  = 10
+	TGA_DESCRIPTOR_TOP_RIGHT = 0x10
+	TGA_DESCRIPTOR_TOP_LEFT  = 0x20
+	// title images are at most 1280x720, anything much bigger is a broken file
+	TGA_MAX_DIMENSION = 4096
+)
+
+// TITLE_IMAGES are the images every title carries in its meta folder.
+var TITLE_IMAGES = []string{ICON_TEX_PATH, BOOT_TV_TEX_PATH, BOOT_DRC_TEX_PATH}
+
+// DecodeTGA decodes the uncompressed and RLE true color TGAs titles use.
+func DecodeTGA(r io.Reader) (*image.NRGBA, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, TGA_HEADER_SIZE)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("failed to read tga header: %w", err)
+	}
+	imageType := header[2]
+	width := int(binary.LittleEndian.Uint16(header[12:]))
+	height := int(binary.LittleEndian.Uint16(header[14:]))
+	bitsPerPixel := header[16]
+	descriptor := header[17]
+
+	if imageType != TGA_TYPE_TRUE_COLOR && imageType != TGA_TYPE_TRUE_COLOR_RLE {
+		return nil, fmt.Errorf("unsupported tga image type %d", imageType)
+	}
+	if bitsPerPixel != 24 && bitsPerPixel != 32 {
+		return nil, fmt.Errorf("unsupported tga pixel depth %d", bitsPerPixel)
+	}
+	if width == 0 || height == 0 {
+		return nil, errors.New("empty tga image")
+	}
+	if width > TGA_MAX_DIMENSION || height > TGA_MAX_DIMENSION {
+		return nil, fmt.Errorf("tga image too big: %dx%d", width, height)
+	}
+
+	// Skip the image ID and the color map, true color images don't use it
+	colorMapSize := int(binary.LittleEndian.Uint16(header[5:])) * ((int(header[7]) + 7) / 8)
+	if _, err := br.Discard(int(header[0]) + colorMapSize); err != nil {
+		return nil, err
+	}
+
+	bytesPerPixel := int(bitsPerPixel / 8)
+	pixels := make([]byte, width*height*bytesPerPixel)
+	if imageType == TGA_TYPE_TRUE_COLOR {
+		if _, err := io.ReadFull(br, pixels); err != nil {
+			return nil, fmt.Errorf("failed to read tga pixels: %w", err)
+		}
+	} else if err := readTGARLE(br, pixels, bytesPerPixel); err != nil {
+		return nil, err
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < width*height; i++ {
+		x, y := i%width, i/width
+		if descriptor&TGA_DESCRIPTOR_TOP_LEFT == 0 {
+			y = height - 1 - y
+		}
+		if descriptor&TGA_DESCRIPTOR_TOP_RIGHT != 0 {
+			x = width - 1 - x
+		}
+		pixel := pixels[i*bytesPerPixel:]
+		alpha := uint8(0xFF)
+		if bytesPerPixel == 4 {
+			alpha = pixel[3]
+		}
+		img.SetNRGBA(x, y, color.NRGBA{R: pixel[2], G: pixel[1], B: pixel[0], A: alpha})
+	}
+	return img, nil
+}
+
+// readTGARLE expands run length packets, each one either repeats a single
+// pixel or holds up to 128 raw ones.
+func readTGARLE(r *bufio.Reader, pixels []byte, bytesPerPixel int) error {
+	for offset := 0; offset < len(pixels); {
+		packet, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("failed to read tga packet: %w", err)
+		}
+		count := int(packet&0x7F) + 1
+		size := count * bytesPerPixel
+		if offset+size > len(pixels) {
+			return errors.New("tga packet overflows the image")
+		}
+		if packet&0x80 == 0 {
+			if _, err := io.ReadFull(r, pixels[offset:offset+size]); err != nil {
+				return fmt.Errorf("failed to read tga pixels: %w", err)
+			}
+		} else {
+			if _, err := io.ReadFull(r, pixels[offset:offset+bytesPerPixel]); err != nil {
+				return fmt.Errorf("failed to read tga pixels: %w", err)
+			}
+			for i := bytesPerPixel; i < size; i += bytesPerPixel {
+				copy(pixels[offset+i:], pixels[offset:offset+bytesPerPixel])
+			}
+		}
+		offset += size
+	}
+	return nil
+}
+
+// ReadTitleImages reads and decodes the given TITLE_IMAGES of a decrypted or
+// encrypted title, images the title doesn't have are left out.
+func ReadTitleImages(titlePath string, names ...string) (map[string]image.Image, error) {
+	files, err := readTitleFiles(titlePath, names)
+	if err != nil {
+		return nil, err
+	}
+	images := make(map[string]image.Image, len(files))
+	for name, data := range files {
+		img, err := DecodeTGA(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", name, err)
+		}
+		images[name] = img
+	}
+	return images, nil
+}
+
+// ReadTitleIconPNG returns the icon of a title converted to PNG.
+func ReadTitleIconPNG(titlePath string) ([]byte, error) {
+	images, err := ReadTitleImages(titlePath, ICON_TEX_PATH)
+	if err != nil {
+		return nil, err
+	}
+	icon, ok := images[ICON_TEX_PATH]
+	if !ok {
+		return nil, errors.New("title has no icon")
+	}
+	buffer := &bytes.Buffer{}
+	if err := png.Encode(buffer, icon); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// ExtractTitleImages writes the icon and boot images of a title to outputPath
+// as PNGs and returns the paths written.
+func ExtractTitleImages(titlePath, outputPath string) ([]string, error) {
+	images, err := ReadTitleImages(titlePath, TITLE_IMAGES...)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(outputPath, 0755); err != nil {
+		return nil, err
+	}
+
+	written := make([]string, 0, len(images))
+	for _, name := range TITLE_IMAGES {
+		img, ok := images[name]
+		if !ok {
+			continue
+		}
+		pngPath := filepath.Join(outputPath, strings.TrimSuffix(path.Base(name), ".tga")+".png")
+		f, err := os.Create(pngPath)
+		if err != nil {
+			return written, err
+		}
+		err = png.Encode(f, img)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return written, err
+		}
+		written = append(written, pngPath)
+	}
+	return written, nil
+}
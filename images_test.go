@@ -0,0 +1,158 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testImagePixel(x, y int) color.NRGBA {
+	return color.NRGBA{R: uint8(x * 16), G: uint8(y * 32), B: uint8(x ^ y), A: uint8(0xFF - x - y)}
+}
+
+// encodeTestTGA encodes a width x height image of testImagePixel, bottom-up
+// unless topLeft is set and run length encoded one row per packet when rle is.
+func encodeTestTGA(width, height int, bitsPerPixel byte, topLeft, rle bool) []byte {
+	header := make([]byte, TGA_HEADER_SIZE)
+	header[0] = 3 // image ID length
+	header[2] = TGA_TYPE_TRUE_COLOR
+	if rle {
+		header[2] = TGA_TYPE_TRUE_COLOR_RLE
+	}
+	binary.LittleEndian.PutUint16(header[12:], uint16(width))
+	binary.LittleEndian.PutUint16(header[14:], uint16(height))
+	header[16] = bitsPerPixel
+	if topLeft {
+		header[17] = TGA_DESCRIPTOR_TOP_LEFT
+	}
+
+	tga := bytes.NewBuffer(header)
+	tga.WriteString("ID!")
+	for row := 0; row < height; row++ {
+		y := height - 1 - row
+		if topLeft {
+			y = row
+		}
+		if rle {
+			// the left half repeats the first pixel, the right half is raw
+			half := width / 2
+			for x := 0; x < half; x += 128 {
+				tga.WriteByte(0x80 | byte(min(128, uint64(half-x))-1))
+				writeTestTGAPixel(tga, testImagePixel(0, y), bitsPerPixel)
+			}
+			for x := half; x < width; x++ {
+				if (x-half)%128 == 0 {
+					tga.WriteByte(byte(min(128, uint64(width-x)) - 1))
+				}
+				writeTestTGAPixel(tga, testImagePixel(x, y), bitsPerPixel)
+			}
+			continue
+		}
+		for x := 0; x < width; x++ {
+			writeTestTGAPixel(tga, testImagePixel(x, y), bitsPerPixel)
+		}
+	}
+	return tga.Bytes()
+}
+
+func writeTestTGAPixel(tga *bytes.Buffer, pixel color.NRGBA, bitsPerPixel byte) {
+	tga.Write([]byte{pixel.B, pixel.G, pixel.R})
+	if bitsPerPixel == 32 {
+		tga.WriteByte(pixel.A)
+	}
+}
+
+func TestDecodeTGA(t *testing.T) {
+	const width, height = 6, 4
+	for _, test := range []struct {
+		bitsPerPixel byte
+		topLeft, rle bool
+	}{{32, false, false}, {24, true, false}, {32, true, true}, {24, false, true}} {
+		img, err := DecodeTGA(bytes.NewReader(encodeTestTGA(width, height, test.bitsPerPixel, test.topLeft, test.rle)))
+		if err != nil {
+			t.Fatalf("%+v: DecodeTGA failed: %v", test, err)
+		}
+		if img.Bounds() != image.Rect(0, 0, width, height) {
+			t.Fatalf("%+v: unexpected bounds %v", test, img.Bounds())
+		}
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				expected := testImagePixel(x, y)
+				if test.rle && x < width/2 {
+					expected = testImagePixel(0, y)
+				}
+				if test.bitsPerPixel == 24 {
+					expected.A = 0xFF
+				}
+				if actual := img.NRGBAAt(x, y); actual != expected {
+					t.Errorf("%+v: pixel %d,%d is %v, want %v", test, x, y, actual, expected)
+				}
+			}
+		}
+	}
+
+	if _, err := DecodeTGA(bytes.NewReader(encodeTestTGA(width, height, 16, false, false))); err == nil {
+		t.Error("expected 16 bit TGAs to be rejected")
+	}
+	// only the header is read before a huge size is refused
+	huge := encodeTestTGA(width, height, 32, false, false)
+	binary.LittleEndian.PutUint16(huge[12:], 0xFFFF)
+	binary.LittleEndian.PutUint16(huge[14:], 0xFFFF)
+	if _, err := DecodeTGA(bytes.NewReader(huge)); err == nil {
+		t.Error("expected a TGA bigger than TGA_MAX_DIMENSION to be rejected")
+	}
+	truncated := encodeTestTGA(width, height, 32, false, true)
+	if _, err := DecodeTGA(bytes.NewReader(truncated[:len(truncated)-5])); err == nil {
+		t.Error("expected a truncated TGA to be rejected")
+	}
+}
+
+func TestExtractTitleImages(t *testing.T) {
+	files := testDecryptedTree()
+	files[ICON_TEX_PATH] = encodeTestTGA(128, 128, 32, false, false)
+	files[BOOT_DRC_TEX_PATH] = encodeTestTGA(854, 480, 24, false, true)
+	inputDir := t.TempDir()
+	writeTestTree(t, inputDir, files)
+	wupDir := t.TempDir()
+	options := PackOptions{TitleKey: bytes.Repeat([]byte{0x42}, 16), Certificate: bytes.Repeat([]byte{0x55}, TITLE_CERT_SIZE)}
+	if err := PackContents(inputDir, wupDir, options, testProgressReporter{}, nil); err != nil {
+		t.Fatalf("PackContents failed: %v", err)
+	}
+
+	for _, titlePath := range []string{inputDir, wupDir} {
+		outputDir := t.TempDir()
+		written, err := ExtractTitleImages(titlePath, outputDir)
+		if err != nil {
+			t.Fatalf("ExtractTitleImages failed: %v", err)
+		}
+		// the title has no TV boot image
+		if len(written) != 2 || filepath.Base(written[0]) != "iconTex.png" || filepath.Base(written[1]) != "bootDrcTex.png" {
+			t.Fatalf("unexpected images %v", written)
+		}
+		f, err := os.Open(written[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		icon, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("invalid PNG: %v", err)
+		}
+		if icon.Bounds().Dx() != 128 || color.NRGBAModel.Convert(icon.At(5, 7)) != testImagePixel(5, 7) {
+			t.Errorf("icon differs from the TGA")
+		}
+
+		iconPNG, err := ReadTitleIconPNG(titlePath)
+		if err != nil {
+			t.Fatalf("ReadTitleIconPNG failed: %v", err)
+		}
+		if _, err := png.Decode(bytes.NewReader(iconPNG)); err != nil {
+			t.Errorf("invalid icon PNG: %v", err)
+		}
+	}
+}
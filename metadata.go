@@ -0,0 +1,241 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	META_XML_PATH = "meta/meta.xml"
+	APP_XML_PATH  = "code/app.xml"
+	COS_XML_PATH  = "code/cos.xml"
+)
+
+// METADATA_LANGUAGES are the language suffixes of the names in meta.xml, in
+// the order the console lists them.
+var METADATA_LANGUAGES = []string{"ja", "en", "fr", "de", "it", "es", "zhs", "ko", "nl", "pt", "ru", "zht"}
+
+// TitleMetadata is what meta.xml, app.xml and cos.xml tell about a title.
+// Names and publishers are keyed by their METADATA_LANGUAGES suffix.
+type TitleMetadata struct {
+	TitleID      uint64            `json:"title_id"`
+	TitleVersion uint16            `json:"title_version"`
+	LongNames    map[string]string `json:"long_names"`
+	ShortNames   map[string]string `json:"short_names"`
+	Publishers   map[string]string `json:"publishers"`
+	ProductCode  string            `json:"product_code"`
+	CompanyCode  string            `json:"company_code"`
+	Region       uint32            `json:"region"`
+	OSVersion    uint64            `json:"os_version"`
+	SDKVersion   uint32            `json:"sdk_version"`
+	AppType      uint32            `json:"app_type"`
+	GroupID      uint32            `json:"group_id"`
+	Executable   string            `json:"executable,omitempty"`
+	MaxSize      uint64            `json:"max_size,omitempty"`
+	MaxCodeSize  uint64            `json:"max_code_size,omitempty"`
+}
+
+// Name returns the English long name, or the first one set.
+func (m *TitleMetadata) Name() string {
+	if name := m.LongNames["en"]; name != "" {
+		return name
+	}
+	for _, language := range METADATA_LANGUAGES {
+		if name := m.LongNames[language]; name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+type cosXML struct {
+	Argstr      string `xml:"argstr"`
+	MaxSize     string `xml:"max_size"`
+	MaxCodeSize string `xml:"max_codesize"`
+}
+
+// metadataHexField is a hexadecimal field and where its parsed value goes.
+type metadataHexField struct {
+	value   string
+	bitSize int
+	set     func(uint64)
+}
+
+// titleFileSink keeps the wanted files of a title in memory, everything else
+// is skipped without being decrypted.
+type titleFileSink struct {
+	files  memorySink
+	wanted []string
+}
+
+func (t titleFileSink) CreateFile(path string) (io.WriteCloser, error) {
+	path = strings.TrimPrefix(path, "/")
+	if !slices.Contains(t.wanted, path) {
+		return nil, errSkipFile
+	}
+	return t.files.CreateFile(path)
+}
+
+// readTitleFiles reads the given files from a decrypted title, or decrypts just
+// those files when path holds an encrypted download. Missing files are left out.
+func readTitleFiles(path string, names []string) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	_, metaErr := os.Stat(filepath.Join(path, "meta"))
+	if _, tmdErr := os.Stat(filepath.Join(path, "title.tmd")); metaErr == nil || tmdErr != nil {
+		for _, name := range names {
+			data, err := os.ReadFile(filepath.Join(path, filepath.FromSlash(name)))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			files[name] = data
+		}
+		return files, nil
+	}
+
+	if isWiiTitle(path) {
+		return nil, errors.New("wii titles have no file system")
+	}
+	sink := titleFileSink{files: make(memorySink), wanted: names}
+	if err := decryptContentsToSink(path, sink, ignoreProgressReporter{}, false); err != nil {
+		return nil, err
+	}
+	for name, data := range sink.files {
+		files[name] = data.Bytes()
+	}
+	return files, nil
+}
+
+// ReadTitleMetadata reads the metadata of a decrypted title, or decrypts just
+// the metadata files when path holds an encrypted download.
+func ReadTitleMetadata(path string) (*TitleMetadata, error) {
+	files, err := readTitleFiles(path, []string{META_XML_PATH, APP_XML_PATH, COS_XML_PATH})
+	if err != nil {
+		return nil, err
+	}
+	return parseTitleMetadata(files)
+}
+
+// readXMLFields returns the text of every element below the root, meta.xml
+// has too many per-language fields to list them in a struct.
+func readXMLFields(data []byte) (map[string]string, error) {
+	fields := make(map[string]string)
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	field := ""
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return fields, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch token := token.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 2 {
+				field = token.Name.Local
+				fields[field] = ""
+			}
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+			if depth == 2 {
+				fields[field] += string(token)
+			}
+		}
+	}
+}
+
+func parseTitleMetadata(files map[string][]byte) (*TitleMetadata, error) {
+	if len(files[META_XML_PATH]) == 0 {
+		return nil, errors.New("meta.xml not found")
+	}
+	meta, err := readXMLFields(files[META_XML_PATH])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse meta.xml: %w", err)
+	}
+
+	metadata := &TitleMetadata{
+		LongNames:   make(map[string]string),
+		ShortNames:  make(map[string]string),
+		Publishers:  make(map[string]string),
+		ProductCode: strings.TrimSpace(meta["product_code"]),
+		CompanyCode: strings.TrimSpace(meta["company_code"]),
+	}
+	for _, language := range METADATA_LANGUAGES {
+		for prefix, names := range map[string]map[string]string{
+			"longname_":  metadata.LongNames,
+			"shortname_": metadata.ShortNames,
+			"publisher_": metadata.Publishers,
+		} {
+			if name := strings.TrimSpace(meta[prefix+language]); name != "" {
+				names[language] = name
+			}
+		}
+	}
+
+	hexFields := []metadataHexField{
+		{meta["title_id"], 64, func(v uint64) { metadata.TitleID = v }},
+		{meta["title_version"], 32, func(v uint64) { metadata.TitleVersion = uint16(v) }},
+		{meta["os_version"], 64, func(v uint64) { metadata.OSVersion = v }},
+		{meta["region"], 32, func(v uint64) { metadata.Region = uint32(v) }},
+	}
+
+	// app.xml is what the system reads, it wins over meta.xml
+	if data := files[APP_XML_PATH]; len(data) != 0 {
+		app := &appXML{}
+		if err := xml.Unmarshal(data, app); err != nil {
+			return nil, fmt.Errorf("failed to parse app.xml: %w", err)
+		}
+		hexFields = append(hexFields, []metadataHexField{
+			{app.TitleID, 64, func(v uint64) { metadata.TitleID = v }},
+			{app.TitleVersion, 32, func(v uint64) { metadata.TitleVersion = uint16(v) }},
+			{app.OSVersion, 64, func(v uint64) { metadata.OSVersion = v }},
+			{app.AppType, 32, func(v uint64) { metadata.AppType = uint32(v) }},
+			{app.GroupID, 32, func(v uint64) { metadata.GroupID = uint32(v) }},
+		}...)
+		if sdkVersion := strings.TrimSpace(app.SDKVersion); sdkVersion != "" {
+			version, err := strconv.ParseUint(sdkVersion, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid sdk_version in app.xml: %w", err)
+			}
+			metadata.SDKVersion = uint32(version)
+		}
+	}
+
+	if data := files[COS_XML_PATH]; len(data) != 0 {
+		cos := &cosXML{}
+		if err := xml.Unmarshal(data, cos); err != nil {
+			return nil, fmt.Errorf("failed to parse cos.xml: %w", err)
+		}
+		metadata.Executable = strings.TrimSpace(cos.Argstr)
+		hexFields = append(hexFields, []metadataHexField{
+			{cos.MaxSize, 64, func(v uint64) { metadata.MaxSize = v }},
+			{cos.MaxCodeSize, 64, func(v uint64) { metadata.MaxCodeSize = v }},
+		}...)
+	}
+
+	for _, field := range hexFields {
+		if strings.TrimSpace(field.value) == "" {
+			continue
+		}
+		value, err := parseHexField(field.value, field.bitSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata field %q: %w", field.value, err)
+		}
+		field.set(value)
+	}
+	return metadata, nil
+}
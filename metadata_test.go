@@ -0,0 +1,88 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"testing"
+)
+
+const testMetaXML = `<?xml version="1.0" encoding="utf-8"?>
+<menu type="complex" access="777">
+  <version type="unsignedInt" length="4">33</version>
+  <product_code type="string" length="32">WUP-P-TEST</product_code>
+  <company_code type="string" length="8">0001</company_code>
+  <title_id type="hexBinary" length="8">0005000010FFFF00</title_id>
+  <title_version type="hexBinary" length="4">00000010</title_version>
+  <region type="hexBinary" length="4">00000002</region>
+  <longname_ja type="string" length="512">テスト
+タイトル</longname_ja>
+  <longname_en type="string" length="512">Test
+Title</longname_en>
+  <longname_fr type="string" length="512"></longname_fr>
+  <shortname_en type="string" length="256">Test</shortname_en>
+  <publisher_en type="string" length="256">Nintendo &amp; Co</publisher_en>
+</menu>
+`
+
+const testCosXML = `<?xml version="1.0" encoding="utf-8"?>
+<app type="complex" access="777">
+  <version type="unsignedInt" length="4">1</version>
+  <argstr type="string" length="4096">game.rpx</argstr>
+  <max_size type="hexBinary" length="4">40000000</max_size>
+  <max_codesize type="hexBinary" length="4">0E000000</max_codesize>
+</app>
+`
+
+func checkTestMetadata(t *testing.T, metadata *TitleMetadata) {
+	t.Helper()
+	// title_version comes from app.xml, which overrides meta.xml
+	if metadata.TitleID != 0x0005000010FFFF00 || metadata.TitleVersion != 0x20 {
+		t.Errorf("unexpected title %016X v%d", metadata.TitleID, metadata.TitleVersion)
+	}
+	if metadata.Name() != "Test\nTitle" || metadata.LongNames["ja"] != "テスト\nタイトル" {
+		t.Errorf("unexpected long names %q", metadata.LongNames)
+	}
+	if _, ok := metadata.LongNames["fr"]; ok {
+		t.Error("empty names should be left out")
+	}
+	if metadata.ShortNames["en"] != "Test" || metadata.Publishers["en"] != "Nintendo & Co" {
+		t.Errorf("unexpected short names %q or publishers %q", metadata.ShortNames, metadata.Publishers)
+	}
+	if metadata.ProductCode != "WUP-P-TEST" || metadata.CompanyCode != "0001" || metadata.Region != MCP_REGION_USA {
+		t.Errorf("unexpected product %s, company %s or region %d", metadata.ProductCode, metadata.CompanyCode, metadata.Region)
+	}
+	if metadata.OSVersion != 0x000500101000400A || metadata.SDKVersion != 21204 || metadata.AppType != 0x80000000 || metadata.GroupID != 0xFFFF {
+		t.Errorf("unexpected app.xml fields %+v", metadata)
+	}
+	if metadata.Executable != "game.rpx" || metadata.MaxSize != 0x40000000 || metadata.MaxCodeSize != 0x0E000000 {
+		t.Errorf("unexpected cos.xml fields %+v", metadata)
+	}
+}
+
+func TestReadTitleMetadata(t *testing.T) {
+	files := testDecryptedTree()
+	files[META_XML_PATH] = []byte(testMetaXML)
+	files[COS_XML_PATH] = []byte(testCosXML)
+	inputDir := t.TempDir()
+	writeTestTree(t, inputDir, files)
+
+	metadata, err := ReadTitleMetadata(inputDir)
+	if err != nil {
+		t.Fatalf("ReadTitleMetadata failed on the decrypted tree: %v", err)
+	}
+	checkTestMetadata(t, metadata)
+
+	wupDir := t.TempDir()
+	options := PackOptions{TitleKey: bytes.Repeat([]byte{0x42}, 16), Certificate: bytes.Repeat([]byte{0x55}, TITLE_CERT_SIZE)}
+	if err := PackContents(inputDir, wupDir, options, testProgressReporter{}, nil); err != nil {
+		t.Fatalf("PackContents failed: %v", err)
+	}
+	metadata, err = ReadTitleMetadata(wupDir)
+	if err != nil {
+		t.Fatalf("ReadTitleMetadata failed on the encrypted title: %v", err)
+	}
+	checkTestMetadata(t, metadata)
+
+	if _, err := ReadTitleMetadata(t.TempDir()); err == nil {
+		t.Error("expected an empty folder to fail")
+	}
+}
@@ -0,0 +1,703 @@
+package wiiudownloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CONTENT_TYPE_ENCRYPTED = 0x0001
+	CONTENT_TYPE_HASHED    = 0x0002
+	CONTENT_TYPE_CONTENT   = 0x2000
+)
+
+const (
+	FST_CLUSTER_HASH_MODE_RAW    = 0x01
+	FST_CLUSTER_HASH_MODE_HASHED = 0x02
+)
+
+const (
+	TMD_CONTENT_RECORDS_OFFSET = 0xB04
+	TMD_CONTENT_RECORD_SIZE    = 0x30
+	TMD_CERTIFICATES_SIZE      = 0x700
+	TITLE_CERT_SIZE            = 0xA00
+	DEFAULT_MAX_CONTENT_SIZE   = 0x40000000
+)
+
+const (
+	fstFileAlignment = 0x20
+	h3EntryBlocks    = 16 * 16 * 16
+)
+
+// PackOptions controls how a decrypted title is turned back into an
+// installable WUP package.
+type PackOptions struct {
+	TitleID        uint64 // read from code/app.xml when zero
+	TitleVersion   uint16 // read from code/app.xml when TitleID is zero
+	TitleKey       []byte // decrypted title key, the keygen key is used when nil
+	Certificate    []byte // title.cert chain, taken from the OSv10 TMD and ticket when nil
+	MaxContentSize uint64 // split hashed contents above this size, DEFAULT_MAX_CONTENT_SIZE when zero
+}
+
+type appXML struct {
+	OSVersion    string `xml:"os_version"`
+	TitleID      string `xml:"title_id"`
+	TitleVersion string `xml:"title_version"`
+	SDKVersion   string `xml:"sdk_version"`
+	AppType      string `xml:"app_type"`
+	GroupID      string `xml:"group_id"`
+}
+
+type packedFile struct {
+	path   string
+	size   uint64
+	offset uint64
+}
+
+type packedContent struct {
+	index    uint16
+	hashed   bool
+	files    []*packedFile
+	dataSize uint64
+}
+
+type fstNode struct {
+	name     string
+	isDir    bool
+	children []*fstNode
+	file     *packedFile
+	content  *packedContent
+}
+
+type titlePacker struct {
+	options  PackOptions
+	contents []*packedContent
+	current  *packedContent
+}
+
+func readAppXML(path string) (*appXML, error) {
+	data, err := os.ReadFile(filepath.Join(path, "code", "app.xml"))
+	if err != nil {
+		return nil, err
+	}
+	app := &appXML{}
+	if err := xml.Unmarshal(data, app); err != nil {
+		return nil, fmt.Errorf("failed to parse app.xml: %w", err)
+	}
+	return app, nil
+}
+
+func parseHexField(value string, bitSize int) (uint64, error) {
+	return strconv.ParseUint(strings.TrimSpace(value), 16, bitSize)
+}
+
+func (p *titlePacker) newContent(hashed bool) *packedContent {
+	content := &packedContent{index: uint16(len(p.contents)), hashed: hashed}
+	p.contents = append(p.contents, content)
+	return content
+}
+
+func (p *titlePacker) addFile(node *fstNode, hashed bool) {
+	if !hashed {
+		content := p.newContent(false)
+		content.files = append(content.files, node.file)
+		content.dataSize = node.file.size
+		node.content = content
+		return
+	}
+
+	offset := uint64(0)
+	if p.current != nil {
+		offset = (p.current.dataSize + fstFileAlignment - 1) &^ (fstFileAlignment - 1)
+	}
+	if p.current == nil || (len(p.current.files) > 0 && offset+node.file.size > p.options.MaxContentSize) {
+		p.current = p.newContent(true)
+		offset = 0
+	}
+	node.file.offset = offset
+	p.current.files = append(p.current.files, node.file)
+	p.current.dataSize = offset + node.file.size
+	node.content = p.current
+}
+
+func (p *titlePacker) buildTree(path, name string, hashed bool) (*fstNode, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	node := &fstNode{name: name, isDir: info.IsDir()}
+	if !node.isDir {
+		node.file = &packedFile{path: path, size: uint64(info.Size())}
+		p.addFile(node, hashed)
+		return node, nil
+	}
+
+	dirEntries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, dirEntry := range dirEntries {
+		child, err := p.buildTree(filepath.Join(path, dirEntry.Name()), dirEntry.Name(), hashed)
+		if err != nil {
+			return nil, err
+		}
+		node.children = append(node.children, child)
+	}
+	return node, nil
+}
+
+// Code files are stored unhashed, one per content, like Nintendo's own
+// packages; everything else goes into hashed contents.
+func (p *titlePacker) buildRoot(path string) (*fstNode, error) {
+	root := &fstNode{isDir: true}
+	p.newContent(false) // content 0 holds the FST
+
+	for _, dir := range []string{"code", "content", "meta"} {
+		dirPath := filepath.Join(path, dir)
+		if _, err := os.Stat(dirPath); os.IsNotExist(err) {
+			continue
+		}
+		p.current = nil
+		node, err := p.buildTree(dirPath, dir, dir != "code")
+		if err != nil {
+			return nil, err
+		}
+		root.children = append(root.children, node)
+	}
+	if len(root.children) == 0 {
+		return nil, errors.New("no code, content or meta directory found")
+	}
+	return root, nil
+}
+
+func countFSTNodes(node *fstNode) uint32 {
+	count := uint32(1)
+	for _, child := range node.children {
+		count += countFSTNodes(child)
+	}
+	return count
+}
+
+func (p *titlePacker) buildFST(root *fstNode, titleID uint64, groupID uint32) []byte {
+	entryCount := countFSTNodes(root)
+	entries := bytes.NewBuffer(make([]byte, 0, entryCount*0x10))
+	names := bytes.NewBuffer([]byte{0})
+
+	writeEntry := func(entryType byte, nameOffset, offset, length uint32, contentID uint16) {
+		binary.Write(entries, binary.BigEndian, uint32(entryType)<<24|nameOffset&0x00FFFFFF)
+		binary.Write(entries, binary.BigEndian, offset)
+		binary.Write(entries, binary.BigEndian, length)
+		binary.Write(entries, binary.BigEndian, uint16(0))
+		binary.Write(entries, binary.BigEndian, contentID)
+	}
+
+	writeEntry(1, 0, 0, entryCount, 0)
+
+	index := uint32(1)
+	var walk func(node *fstNode, parent uint32)
+	walk = func(node *fstNode, parent uint32) {
+		nameOffset := uint32(names.Len())
+		names.WriteString(node.name)
+		names.WriteByte(0)
+
+		current := index
+		index++
+		if node.isDir {
+			writeEntry(1, nameOffset, parent, current+countFSTNodes(node), 0)
+			for _, child := range node.children {
+				walk(child, current)
+			}
+			return
+		}
+		writeEntry(0, nameOffset, uint32(node.file.offset>>5), uint32(node.file.size), node.content.index)
+	}
+	for _, child := range root.children {
+		walk(child, 0)
+	}
+
+	fst := bytes.NewBuffer(make([]byte, 0, 0x20+len(p.contents)*0x20+entries.Len()+names.Len()))
+	fst.WriteString("FST\x00")
+	binary.Write(fst, binary.BigEndian, uint32(fstFileAlignment))
+	binary.Write(fst, binary.BigEndian, uint32(len(p.contents)))
+	fst.Write(make([]byte, 0x14))
+
+	for _, content := range p.contents {
+		hashMode := byte(FST_CLUSTER_HASH_MODE_RAW)
+		if content.hashed {
+			hashMode = FST_CLUSTER_HASH_MODE_HASHED
+		}
+		binary.Write(fst, binary.BigEndian, uint32(0))
+		binary.Write(fst, binary.BigEndian, uint32((content.dataSize+BLOCK_SIZE-1)/BLOCK_SIZE))
+		binary.Write(fst, binary.BigEndian, titleID)
+		binary.Write(fst, binary.BigEndian, groupID)
+		fst.WriteByte(hashMode)
+		fst.Write(make([]byte, 0xB))
+	}
+	fst.Write(entries.Bytes())
+	fst.Write(names.Bytes())
+	return fst.Bytes()
+}
+
+// packedDataReader streams the data area of a content: every file at its
+// planned offset with zero padding in between.
+type packedDataReader struct {
+	files     []*packedFile
+	index     int
+	position  uint64
+	current   *os.File
+	remaining uint64
+}
+
+func (r *packedDataReader) Read(p []byte) (int, error) {
+	for {
+		if r.current != nil {
+			if r.remaining == 0 {
+				r.current.Close()
+				r.current = nil
+				r.index++
+				continue
+			}
+			n, err := r.current.Read(p[:min(uint64(len(p)), r.remaining)])
+			r.position += uint64(n)
+			r.remaining -= uint64(n)
+			if err == io.EOF && r.remaining > 0 {
+				return n, fmt.Errorf("'%s' changed size while packing", r.current.Name())
+			}
+			if err != nil && err != io.EOF {
+				return n, err
+			}
+			return n, nil
+		}
+
+		if r.index >= len(r.files) {
+			return 0, io.EOF
+		}
+		file := r.files[r.index]
+		if r.position < file.offset {
+			n := min(uint64(len(p)), file.offset-r.position)
+			clear(p[:n])
+			r.position += n
+			return int(n), nil
+		}
+		f, err := os.Open(file.path)
+		if err != nil {
+			return 0, err
+		}
+		r.current = f
+		r.remaining = file.size
+	}
+}
+
+func (r *packedDataReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// readPackedBlock fills buf from reader, zero padding the tail of the last block.
+func readPackedBlock(reader io.Reader, buf []byte) error {
+	n, err := io.ReadFull(reader, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		clear(buf[n:])
+		return nil
+	}
+	return err
+}
+
+// packProgress reports the blocks of content data PackContents hashes and
+// encrypts as the progress of the .app file being written.
+type packProgress struct {
+	reporter ProgressReporter
+	writer   *WriterProgress
+}
+
+func newPackProgress(reporter ProgressReporter, filename string) *packProgress {
+	return &packProgress{reporter: reporter, writer: newWriterProgress(io.Discard, reporter, filename)}
+}
+
+// add reports a block, failing with context.Canceled once packing was cancelled.
+func (p *packProgress) add(block []byte) error {
+	if p.reporter.Cancelled() {
+		return context.Canceled
+	}
+	p.writer.Write(block)
+	return nil
+}
+
+func (p *packProgress) Close() error {
+	return p.writer.Close()
+}
+
+// packedProgressSize is how many bytes of a content packProgress is told
+// about, hashed contents being read once to hash them and once to encrypt them.
+func packedProgressSize(content *packedContent) uint64 {
+	if content.hashed {
+		return 2 * max((content.dataSize+HASH_BLOCK_SIZE-1)/HASH_BLOCK_SIZE, 1) * HASH_BLOCK_SIZE
+	}
+	return max((content.dataSize+BLOCK_SIZE-1)/BLOCK_SIZE, 1) * BLOCK_SIZE
+}
+
+func writeUnhashedContent(dst io.Writer, src io.Reader, dataSize uint64, cipherBlock cipher.Block, index uint16, progress *packProgress) (uint64, []byte, error) {
+	blockCount := max((dataSize+BLOCK_SIZE-1)/BLOCK_SIZE, 1)
+
+	var iv [aes.BlockSize]byte
+	binary.BigEndian.PutUint16(iv[:], index)
+	encrypter := cipher.NewCBCEncrypter(cipherBlock, iv[:])
+	contentHash := sha1.New()
+
+	plain := make([]byte, BLOCK_SIZE)
+	encrypted := make([]byte, BLOCK_SIZE)
+	for i := uint64(0); i < blockCount; i++ {
+		if err := readPackedBlock(src, plain); err != nil {
+			return 0, nil, err
+		}
+		if err := progress.add(plain); err != nil {
+			return 0, nil, err
+		}
+		contentHash.Write(plain)
+		encrypter.CryptBlocks(encrypted, plain)
+		if _, err := dst.Write(encrypted); err != nil {
+			return 0, nil, err
+		}
+	}
+	return blockCount * BLOCK_SIZE, contentHash.Sum(nil), nil
+}
+
+func hashPackedContent(content *packedContent, progress *packProgress) ([]byte, error) {
+	blockCount := max((content.dataSize+HASH_BLOCK_SIZE-1)/HASH_BLOCK_SIZE, 1)
+	h0 := make([]byte, blockCount*sha1.Size)
+
+	reader := &packedDataReader{files: content.files}
+	defer reader.Close()
+	plain := make([]byte, HASH_BLOCK_SIZE)
+	for i := uint64(0); i < blockCount; i++ {
+		if err := readPackedBlock(reader, plain); err != nil {
+			return nil, err
+		}
+		if err := progress.add(plain); err != nil {
+			return nil, err
+		}
+		hash := sha1.Sum(plain)
+		copy(h0[i*sha1.Size:], hash[:])
+	}
+	return h0, nil
+}
+
+// hashLevel hashes every group of 16 entries of the level below, missing
+// entries of the last group are left zeroed.
+func hashLevel(lower []byte) []byte {
+	lowerCount := uint64(len(lower) / sha1.Size)
+	groupCount := (lowerCount + 15) / 16
+	upper := make([]byte, groupCount*sha1.Size)
+	group := make([]byte, 16*sha1.Size)
+	for g := uint64(0); g < groupCount; g++ {
+		clear(group)
+		copy(group, lower[g*16*sha1.Size:min(uint64(len(lower)), (g+1)*16*sha1.Size)])
+		hash := sha1.Sum(group)
+		copy(upper[g*sha1.Size:], hash[:])
+	}
+	return upper
+}
+
+func hashGroup(hashes []byte, group uint64) []byte {
+	out := make([]byte, 16*sha1.Size)
+	start := group * 16 * sha1.Size
+	if start < uint64(len(hashes)) {
+		copy(out, hashes[start:min(uint64(len(hashes)), start+16*sha1.Size)])
+	}
+	return out
+}
+
+func writeHashedContent(dst io.Writer, content *packedContent, cipherBlock cipher.Block, progress *packProgress) (uint64, []byte, error) {
+	h0, err := hashPackedContent(content, progress)
+	if err != nil {
+		return 0, nil, err
+	}
+	h1 := hashLevel(h0)
+	h2 := hashLevel(h1)
+	h3 := hashLevel(h2)
+	blockCount := uint64(len(h0) / sha1.Size)
+
+	reader := &packedDataReader{files: content.files}
+	defer reader.Close()
+
+	hashArea := make([]byte, HASHES_SIZE)
+	plain := make([]byte, HASH_BLOCK_SIZE)
+	encrypted := make([]byte, BLOCK_SIZE_HASHED)
+	for block := uint64(0); block < blockCount; block++ {
+		if err := readPackedBlock(reader, plain); err != nil {
+			return 0, nil, err
+		}
+		if err := progress.add(plain); err != nil {
+			return 0, nil, err
+		}
+		if block%16 == 0 {
+			clear(hashArea)
+			copy(hashArea[0x000:], hashGroup(h0, block/16))
+			copy(hashArea[0x140:], hashGroup(h1, block/256))
+			copy(hashArea[0x280:], hashGroup(h2, block/h3EntryBlocks))
+		}
+
+		h0Hash := h0[block*sha1.Size : (block+1)*sha1.Size]
+		if plainHash := sha1.Sum(plain); !bytes.Equal(plainHash[:], h0Hash) {
+			return 0, nil, fmt.Errorf("content %d changed while packing", content.index)
+		}
+
+		var zeroIV [aes.BlockSize]byte
+		cipher.NewCBCEncrypter(cipherBlock, zeroIV[:]).CryptBlocks(encrypted[:HASHES_SIZE], hashArea)
+		cipher.NewCBCEncrypter(cipherBlock, h0Hash[:aes.BlockSize]).CryptBlocks(encrypted[HASHES_SIZE:], plain)
+		if _, err := dst.Write(encrypted); err != nil {
+			return 0, nil, err
+		}
+	}
+	return blockCount * BLOCK_SIZE_HASHED, h3, nil
+}
+
+func writeContentFile(path string, write func(w io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(file, BLOCK_SIZE_HASHED)
+	if err := write(bw); err != nil {
+		file.Close()
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func buildTMD(tmd *TMD, osVersion uint64, groupID uint16, certificates []byte) []byte {
+	data := make([]byte, TMD_CONTENT_RECORDS_OFFSET+TMD_CONTENT_RECORD_SIZE*len(tmd.Contents)+TMD_CERTIFICATES_SIZE)
+
+	binary.BigEndian.PutUint32(data[0x000:], 0x00010004)
+	copy(data[0x140:], "Root-CA00000003-CP0000000b")
+	data[0x180] = TMD_VERSION_WIIU
+	binary.BigEndian.PutUint64(data[0x184:], osVersion)
+	binary.BigEndian.PutUint64(data[0x18C:], tmd.TitleID)
+	binary.BigEndian.PutUint32(data[0x194:], 0x100)
+	binary.BigEndian.PutUint16(data[0x198:], groupID)
+	binary.BigEndian.PutUint16(data[0x1DC:], tmd.TitleVersion)
+	binary.BigEndian.PutUint16(data[0x1DE:], tmd.ContentCount)
+
+	records := data[TMD_CONTENT_RECORDS_OFFSET : TMD_CONTENT_RECORDS_OFFSET+TMD_CONTENT_RECORD_SIZE*len(tmd.Contents)]
+	for i, content := range tmd.Contents {
+		record := records[i*TMD_CONTENT_RECORD_SIZE:]
+		binary.BigEndian.PutUint32(record[0x00:], content.ID)
+		copy(record[0x04:0x06], content.Index)
+		binary.BigEndian.PutUint16(record[0x06:], content.Type)
+		binary.BigEndian.PutUint64(record[0x08:], content.Size)
+		copy(record[0x10:0x30], content.Hash)
+	}
+
+	// A single content info record covers every content
+	binary.BigEndian.PutUint16(data[0x204:], 0)
+	binary.BigEndian.PutUint16(data[0x206:], tmd.ContentCount)
+	recordsHash := sha256.Sum256(records)
+	copy(data[0x208:], recordsHash[:])
+	infoHash := sha256.Sum256(data[0x204:TMD_CONTENT_RECORDS_OFFSET])
+	copy(data[0x1E4:], infoHash[:])
+
+	copy(data[TMD_CONTENT_RECORDS_OFFSET+TMD_CONTENT_RECORD_SIZE*len(tmd.Contents):], certificates)
+	return data
+}
+
+func encryptTitleKey(titleID uint64, titleKey []byte) ([]byte, error) {
+	c, err := aes.NewCipher(commonKey)
+	if err != nil {
+		return nil, err
+	}
+	var ivTitle [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(ivTitle[:], titleID)
+	encrypted := make([]byte, aes.BlockSize)
+	cipher.NewCBCEncrypter(c, ivTitle[:]).CryptBlocks(encrypted, titleKey[:aes.BlockSize])
+	return encrypted, nil
+}
+
+// PackContents rebuilds an installable, encrypted WUP package in outputPath
+// from a decrypted code/content/meta tree in inputPath. Its progress is
+// reported like a download of the .app files, and it returns context.Canceled
+// once progressReporter is cancelled.
+func PackContents(inputPath, outputPath string, options PackOptions, progressReporter ProgressReporter, client *http.Client) error {
+	if options.MaxContentSize == 0 {
+		options.MaxContentSize = DEFAULT_MAX_CONTENT_SIZE
+	}
+
+	var osVersion uint64
+	var groupID uint16
+	app, err := readAppXML(inputPath)
+	if err == nil {
+		osVersion, _ = parseHexField(app.OSVersion, 64)
+		parsedGroupID, _ := parseHexField(app.GroupID, 32)
+		groupID = uint16(parsedGroupID)
+	}
+	if options.TitleID == 0 {
+		if err != nil {
+			return fmt.Errorf("title ID not given and app.xml not readable: %w", err)
+		}
+		if options.TitleID, err = parseHexField(app.TitleID, 64); err != nil {
+			return fmt.Errorf("invalid title_id in app.xml: %w", err)
+		}
+		titleVersion, err := parseHexField(app.TitleVersion, 16)
+		if err != nil {
+			return fmt.Errorf("invalid title_version in app.xml: %w", err)
+		}
+		options.TitleVersion = uint16(titleVersion)
+	}
+
+	var encryptedTitleKey []byte
+	if options.TitleKey == nil {
+		if encryptedTitleKey, err = GenerateKey(fmt.Sprintf("%016x", options.TitleID)); err != nil {
+			return err
+		}
+		encryptedTitleKey = encryptedTitleKey[:aes.BlockSize]
+	} else {
+		if len(options.TitleKey) != aes.BlockSize {
+			return fmt.Errorf("invalid title key length: %d", len(options.TitleKey))
+		}
+		if encryptedTitleKey, err = encryptTitleKey(options.TitleID, options.TitleKey); err != nil {
+			return err
+		}
+	}
+	titleKey := options.TitleKey
+	if titleKey == nil {
+		titleKey = make([]byte, aes.BlockSize)
+		c, err := aes.NewCipher(commonKey)
+		if err != nil {
+			return err
+		}
+		var ivTitle [aes.BlockSize]byte
+		binary.BigEndian.PutUint64(ivTitle[:], options.TitleID)
+		cipher.NewCBCDecrypter(c, ivTitle[:]).CryptBlocks(titleKey, encryptedTitleKey)
+	}
+	cipherBlock, err := aes.NewCipher(titleKey)
+	if err != nil {
+		return fmt.Errorf("failed to create AES cipher: %w", err)
+	}
+
+	packer := &titlePacker{options: options}
+	root, err := packer.buildRoot(inputPath)
+	if err != nil {
+		return err
+	}
+	if len(packer.contents) > 0xFFFF {
+		return fmt.Errorf("too many contents: %d", len(packer.contents))
+	}
+	fst := packer.buildFST(root, options.TitleID, uint32(groupID))
+	packer.contents[0].dataSize = uint64(len(fst))
+
+	if err := os.MkdirAll(outputPath, os.ModePerm); err != nil {
+		return err
+	}
+
+	tmd := &TMD{
+		TitleID:      options.TitleID,
+		Version:      TMD_VERSION_WIIU,
+		TitleVersion: options.TitleVersion,
+		ContentCount: uint16(len(packer.contents)),
+		Contents:     make([]Content, len(packer.contents)),
+	}
+
+	var totalSize uint64
+	for _, content := range packer.contents {
+		totalSize += packedProgressSize(content)
+	}
+	progressReporter.SetDownloadSize(int64(totalSize))
+	progressReporter.SetStartTime(time.Now())
+
+	for i, content := range packer.contents {
+		tmdContent := &tmd.Contents[i]
+		tmdContent.ID = uint32(i)
+		tmdContent.CIDStr = fmt.Sprintf("%08X", tmdContent.ID)
+		tmdContent.Index = binary.BigEndian.AppendUint16(nil, content.index)
+		tmdContent.Type = CONTENT_TYPE_CONTENT | CONTENT_TYPE_ENCRYPTED
+		tmdContent.Hash = make([]byte, 0x20)
+
+		appPath := filepath.Join(outputPath, tmdContent.CIDStr+".app")
+		progress := newPackProgress(progressReporter, tmdContent.CIDStr+".app")
+		var hash []byte
+		switch {
+		case i == 0:
+			err = writeContentFile(appPath, func(w io.Writer) error {
+				tmdContent.Size, hash, err = writeUnhashedContent(w, bytes.NewReader(fst), content.dataSize, cipherBlock, content.index, progress)
+				return err
+			})
+		case content.hashed:
+			tmdContent.Type |= CONTENT_TYPE_HASHED
+			var h3 []byte
+			err = writeContentFile(appPath, func(w io.Writer) error {
+				tmdContent.Size, h3, err = writeHashedContent(w, content, cipherBlock, progress)
+				return err
+			})
+			if err == nil {
+				h3Hash := sha1.Sum(h3)
+				hash = h3Hash[:]
+				err = os.WriteFile(filepath.Join(outputPath, tmdContent.CIDStr+".h3"), h3, 0644)
+			}
+		default:
+			err = writeContentFile(appPath, func(w io.Writer) error {
+				reader := &packedDataReader{files: content.files}
+				defer reader.Close()
+				tmdContent.Size, hash, err = writeUnhashedContent(w, reader, content.dataSize, cipherBlock, content.index, progress)
+				return err
+			})
+		}
+		progress.Close()
+		if errors.Is(err, context.Canceled) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to pack content %s: %w", tmdContent.CIDStr, err)
+		}
+		progressReporter.MarkFileAsDone(tmdContent.CIDStr + ".app")
+		copy(tmdContent.Hash, hash)
+	}
+
+	var certificates []byte
+	if options.Certificate != nil {
+		if len(options.Certificate) < TMD_CERTIFICATES_SIZE {
+			return fmt.Errorf("certificate chain too short: %d", len(options.Certificate))
+		}
+		certificates = options.Certificate[:TMD_CERTIFICATES_SIZE]
+	} else if certificates, err = getDefaultTMDCert(client); err != nil {
+		return fmt.Errorf("failed to get the TMD certificates: %w", err)
+	}
+	tmdData := buildTMD(tmd, osVersion, groupID, certificates)
+	if err := os.WriteFile(filepath.Join(outputPath, "title.tmd"), tmdData, 0644); err != nil {
+		return err
+	}
+
+	if err := GenerateTicket(filepath.Join(outputPath, "title.tik"), options.TitleID, encryptedTitleKey, options.TitleVersion); err != nil {
+		return err
+	}
+
+	certPath := filepath.Join(outputPath, "title.cert")
+	if options.Certificate != nil {
+		return os.WriteFile(certPath, options.Certificate, 0644)
+	}
+	parsedTMD, err := ParseTMD(tmdData)
+	if err != nil {
+		return err
+	}
+	return GenerateCert(parsedTMD, certPath, progressReporter, client)
+}
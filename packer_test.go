@@ -0,0 +1,206 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testProgressReporter struct{}
+
+func (testProgressReporter) SetGameTitle(title string)                                   {}
+func (testProgressReporter) UpdateDownloadProgress(downloaded int64, filename string)    {}
+func (testProgressReporter) UpdateDecryptionProgress(progress float64)                   {}
+func (testProgressReporter) Cancelled() bool                                             { return false }
+func (testProgressReporter) SetCancelled()                                               {}
+func (testProgressReporter) SetDownloadSize(size int64)                                  {}
+func (testProgressReporter) ResetTotals()                                                {}
+func (testProgressReporter) MarkFileAsDone(filename string)                              {}
+func (testProgressReporter) SetTotalDownloadedForFile(filename string, downloaded int64) {}
+func (testProgressReporter) SetStartTime(startTime time.Time)                            {}
+
+const testAppXML = `<?xml version="1.0" encoding="utf-8"?>
+<app type="complex" access="777">
+  <version type="unsignedInt" length="4">16</version>
+  <os_version type="hexBinary" length="8">000500101000400A</os_version>
+  <title_id type="hexBinary" length="8">0005000010FFFF00</title_id>
+  <title_version type="hexBinary" length="2">0020</title_version>
+  <sdk_version type="unsignedInt" length="4">21204</sdk_version>
+  <app_type type="hexBinary" length="4">80000000</app_type>
+  <group_id type="hexBinary" length="4">0000FFFF</group_id>
+</app>
+`
+
+func randomBytes(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func writeTestTree(t *testing.T, root string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testDecryptedTree() map[string][]byte {
+	return map[string][]byte{
+		"code/app.xml":             []byte(testAppXML),
+		"code/game.rpx":            randomBytes(1, 0x9123),
+		"code/empty.bin":           {},
+		"content/big.bin":          randomBytes(2, HASH_BLOCK_SIZE*17+123),
+		"content/sub/small.txt":    []byte("hello from the packer"),
+		"content/sub/deeper/a.bin": randomBytes(3, 0x2001),
+		"meta/meta.xml":            []byte("<menu></menu>"),
+		"meta/empty":               {},
+	}
+}
+
+func TestPackContentsRoundTrip(t *testing.T) {
+	for _, maxContentSize := range []uint64{0, 0x20000} {
+		inputDir := t.TempDir()
+		outputDir := t.TempDir()
+		files := testDecryptedTree()
+		writeTestTree(t, inputDir, files)
+
+		options := PackOptions{
+			TitleKey:       bytes.Repeat([]byte{0x42}, 16),
+			Certificate:    bytes.Repeat([]byte{0x55}, TITLE_CERT_SIZE),
+			MaxContentSize: maxContentSize,
+		}
+		if err := PackContents(inputDir, outputDir, options, testProgressReporter{}, nil); err != nil {
+			t.Fatalf("PackContents failed: %v", err)
+		}
+
+		tmdData, err := os.ReadFile(filepath.Join(outputDir, "title.tmd"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmd, err := ParseTMD(tmdData)
+		if err != nil {
+			t.Fatalf("ParseTMD failed: %v", err)
+		}
+		if tmd.TitleID != 0x0005000010FFFF00 || tmd.TitleVersion != 0x20 {
+			t.Errorf("unexpected TMD title %016X v%d", tmd.TitleID, tmd.TitleVersion)
+		}
+		if maxContentSize != 0 && tmd.ContentCount < 6 {
+			t.Errorf("expected hashed contents to be split, got %d contents", tmd.ContentCount)
+		}
+
+		if err := DecryptContents(outputDir, testProgressReporter{}, false); err != nil {
+			t.Fatalf("DecryptContents failed: %v", err)
+		}
+		for name, expected := range files {
+			actual, err := os.ReadFile(filepath.Join(outputDir, filepath.FromSlash(name)))
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			if !bytes.Equal(actual, expected) {
+				t.Errorf("%s: decrypted contents differ (got %d bytes, want %d)", name, len(actual), len(expected))
+			}
+		}
+	}
+}
+
+func TestPackContentsGeneratedKey(t *testing.T) {
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	files := testDecryptedTree()
+	writeTestTree(t, inputDir, files)
+
+	options := PackOptions{Certificate: make([]byte, TITLE_CERT_SIZE)}
+	if err := PackContents(inputDir, outputDir, options, testProgressReporter{}, nil); err != nil {
+		t.Fatalf("PackContents failed: %v", err)
+	}
+	if err := DecryptContents(outputDir, testProgressReporter{}, false); err != nil {
+		t.Fatalf("DecryptContents failed: %v", err)
+	}
+	actual, err := os.ReadFile(filepath.Join(outputDir, "content", "big.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(actual, files["content/big.bin"]) {
+		t.Error("decrypted contents differ")
+	}
+}
+
+func TestPackContentsDefaultCertificate(t *testing.T) {
+	// without a certificate chain the one of OSv10 is used, like on download
+	certificates := randomBytes(4, TMD_CERTIFICATES_SIZE)
+	cetk := randomBytes(5, 0x350+0x300)
+	serveTestCDN(t, map[string][]byte{
+		"tmd":  buildTMD(&TMD{TitleID: 0x000500101000400A}, 0, 0, certificates),
+		"cetk": cetk,
+	})
+
+	inputDir := t.TempDir()
+	outputDir := t.TempDir()
+	writeTestTree(t, inputDir, testDecryptedTree())
+	options := PackOptions{TitleKey: bytes.Repeat([]byte{0x42}, 16)}
+	if err := PackContents(inputDir, outputDir, options, testProgressReporter{}, http.DefaultClient); err != nil {
+		t.Fatalf("PackContents failed: %v", err)
+	}
+
+	tmdData, err := os.ReadFile(filepath.Join(outputDir, "title.tmd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tmdData[len(tmdData)-TMD_CERTIFICATES_SIZE:], certificates) {
+		t.Error("expected the TMD to carry the OSv10 certificates")
+	}
+	cert, err := os.ReadFile(filepath.Join(outputDir, "title.cert"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := append(append([]byte{}, certificates...), cetk[0x350:]...); !bytes.Equal(cert, expected) {
+		t.Errorf("unexpected title.cert of %d bytes", len(cert))
+	}
+}
+
+// packTestProgressReporter records the progress of PackContents, cancelling
+// it once cancelAfter bytes were reported unless that is 0.
+type packTestProgressReporter struct {
+	testProgressReporter
+	size, reported, cancelAfter int64
+}
+
+func (r *packTestProgressReporter) SetDownloadSize(size int64) { r.size = size }
+func (r *packTestProgressReporter) UpdateDownloadProgress(downloaded int64, filename string) {
+	r.reported += downloaded
+}
+func (r *packTestProgressReporter) Cancelled() bool {
+	return r.cancelAfter > 0 && r.reported >= r.cancelAfter
+}
+
+func TestPackContentsProgress(t *testing.T) {
+	inputDir := t.TempDir()
+	writeTestTree(t, inputDir, testDecryptedTree())
+	options := PackOptions{Certificate: make([]byte, TITLE_CERT_SIZE)}
+
+	reporter := &packTestProgressReporter{}
+	if err := PackContents(inputDir, t.TempDir(), options, reporter, nil); err != nil {
+		t.Fatalf("PackContents failed: %v", err)
+	}
+	if reporter.size == 0 || reporter.reported != reporter.size {
+		t.Errorf("expected every byte of the %d to be reported, got %d", reporter.size, reporter.reported)
+	}
+
+	reporter = &packTestProgressReporter{cancelAfter: 1}
+	if err := PackContents(inputDir, t.TempDir(), options, reporter, nil); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled packing to fail with context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package wiiudownloader
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Region is a mask of MCP_REGION_* bits, the regions a title is sold in or a
+// selection of regions to filter titles by.
+type Region uint8
+
+// REGION_ALL selects every region, including the bits without a name.
+const REGION_ALL Region = 0xFF
+
+// REGION_MAIN are the regions most titles come in, the ones "All" stands for.
+const REGION_MAIN Region = MCP_REGION_JAPAN | MCP_REGION_USA | MCP_REGION_EUROPE
+
+// REGIONS lists the named regions in the order they are shown.
+var REGIONS = []Region{MCP_REGION_USA, MCP_REGION_EUROPE, MCP_REGION_JAPAN, MCP_REGION_CHINA, MCP_REGION_KOREA, MCP_REGION_TAIWAN}
+
+var regionNames = map[Region]struct{ name, key string }{
+	MCP_REGION_JAPAN:  {"Japan", "japan"},
+	MCP_REGION_USA:    {"USA", "usa"},
+	MCP_REGION_EUROPE: {"Europe", "europe"},
+	MCP_REGION_CHINA:  {"China", "china"},
+	MCP_REGION_KOREA:  {"Korea", "korea"},
+	MCP_REGION_TAIWAN: {"Taiwan", "taiwan"},
+}
+
+// Regions returns the named regions set in r, in REGIONS order.
+func (r Region) Regions() []Region {
+	regions := make([]Region, 0, len(REGIONS))
+	for _, region := range REGIONS {
+		if r&region != 0 {
+			regions = append(regions, region)
+		}
+	}
+	return regions
+}
+
+// Overlaps reports whether r and other have a region in common.
+func (r Region) Overlaps(other Region) bool {
+	return r&other != 0
+}
+
+// Keys returns the lower case names of the regions in r, as ParseRegion
+// accepts them.
+func (r Region) Keys() []string {
+	regions := r.Regions()
+	keys := make([]string, len(regions))
+	for i, region := range regions {
+		keys[i] = regionNames[region].key
+	}
+	return keys
+}
+
+// String returns the regions joined with slashes, like "USA/Europe", "All"
+// when Japan, USA and Europe are all in r, or "Unknown" if no named region is.
+func (r Region) String() string {
+	if r&REGION_MAIN == REGION_MAIN {
+		return "All"
+	}
+	regions := r.Regions()
+	if len(regions) == 0 {
+		return "Unknown"
+	}
+	names := make([]string, len(regions))
+	for i, region := range regions {
+		names[i] = regionNames[region].name
+	}
+	return strings.Join(names, "/")
+}
+
+// ParseRegion reads a comma separated list of region names, case is ignored.
+// An empty string or "all" gives REGION_ALL.
+func ParseRegion(s string) (Region, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" || s == "all" {
+		return REGION_ALL, nil
+	}
+	var regions Region
+	for _, key := range strings.Split(s, ",") {
+		key = strings.TrimSpace(key)
+		found := false
+		for region, names := range regionNames {
+			if key == names.key {
+				regions |= region
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown region %q, expected %s or all", key, strings.Join(REGION_ALL.Keys(), ", "))
+		}
+	}
+	return regions, nil
+}
@@ -0,0 +1,54 @@
+package wiiudownloader
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegionString(t *testing.T) {
+	for region, expected := range map[Region]string{
+		MCP_REGION_USA | MCP_REGION_EUROPE:   "USA/Europe",
+		MCP_REGION_EUROPE | MCP_REGION_JAPAN: "Europe/Japan",
+		REGION_MAIN:                          "All",
+		REGION_ALL:                           "All",
+		MCP_REGION_KOREA:                     "Korea",
+		MCP_REGION_CHINA | MCP_REGION_TAIWAN: "China/Taiwan",
+		MCP_REGION_JAPAN | MCP_REGION_KOREA:  "Japan/Korea",
+		0x08:                                 "Unknown",
+	} {
+		if actual := region.String(); actual != expected {
+			t.Errorf("Region(%#02x).String() = %q, want %q", uint8(region), actual, expected)
+		}
+	}
+	if keys := Region(MCP_REGION_TAIWAN | MCP_REGION_USA).Keys(); !reflect.DeepEqual(keys, []string{"usa", "taiwan"}) {
+		t.Errorf("unexpected keys %q", keys)
+	}
+}
+
+func TestParseRegion(t *testing.T) {
+	for input, expected := range map[string]Region{
+		"":                 REGION_ALL,
+		"All":              REGION_ALL,
+		"korea":            MCP_REGION_KOREA,
+		"USA, europe":      MCP_REGION_USA | MCP_REGION_EUROPE,
+		"china,taiwan":     MCP_REGION_CHINA | MCP_REGION_TAIWAN,
+		"japan,japan":      MCP_REGION_JAPAN,
+		"usa,europe,japan": REGION_MAIN,
+	} {
+		if actual, err := ParseRegion(input); err != nil || actual != expected {
+			t.Errorf("ParseRegion(%q) = %#02x, %v, want %#02x", input, uint8(actual), err, uint8(expected))
+		}
+	}
+	for _, input := range []string{"mars", "usa,", "usa,all"} {
+		if _, err := ParseRegion(input); err == nil {
+			t.Errorf("expected %q to be rejected", input)
+		}
+	}
+
+	// every region a title can be filtered by round trips through its keys
+	for _, region := range REGIONS {
+		if parsed, err := ParseRegion(region.Keys()[0]); err != nil || parsed != region {
+			t.Errorf("%s didn't round trip: %#02x, %v", region, uint8(parsed), err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package wiiudownloader
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	SEARCH_SCORE_TITLE_ID     = 1000
+	SEARCH_SCORE_EXACT_TOKEN  = 100
+	SEARCH_SCORE_PREFIX_TOKEN = 70
+	SEARCH_SCORE_INNER_TOKEN  = 40
+	SEARCH_SCORE_TYPO_TOKEN   = 20
+	SEARCH_SCORE_PHRASE       = 50
+)
+
+// searchFolds turns letters with diacritics into their base letters, the
+// rest of the text only goes through lower casing.
+var searchFolds = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ă': "a", 'ą': "a",
+	'æ': "ae", 'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ğ': "g", 'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'ı': "i", 'ł': "l",
+	'ñ': "n", 'ń': "n", 'ň': "n", 'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o",
+	'ø': "o", 'ō': "o", 'ő': "o", 'œ': "oe", 'ř': "r", 'ś': "s", 'ş': "s", 'š': "s",
+	'ß': "ss", 'ť': "t", 'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u",
+	'ű': "u", 'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z", 'þ': "th",
+}
+
+// NormalizeSearchText lower cases s, strips diacritics, turns full width
+// characters into ASCII and hiragana into katakana, and replaces punctuation
+// with spaces, so "Pokémon™ Rumble Ｕ" becomes "pokemon rumble u".
+func NormalizeSearchText(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range s {
+		switch {
+		case r >= 0xFF01 && r <= 0xFF5E: // full width ASCII
+			r -= 0xFEE0
+		case r >= 0x3041 && r <= 0x3096: // hiragana
+			r += 0x60
+		}
+		r = unicode.ToLower(r)
+		if fold, ok := searchFolds[r]; ok {
+			b.WriteString(fold)
+			continue
+		}
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		case unicode.Is(unicode.Mn, r): // combining diacritics
+		default:
+			b.WriteByte(' ')
+		}
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// SearchTitles returns the entries matching query, best matches first and
+// the rest in their original order. Every word of the query has to appear in
+// the name, as a whole word, the start of one, inside one or with a typo,
+// unless the query is the start of a title ID. An empty query matches all.
+func SearchTitles(entries []TitleEntry, query string) []TitleEntry {
+	query = NormalizeSearchText(query)
+	if query == "" {
+		return entries
+	}
+	queryTokens := strings.Fields(query)
+	tidQuery := strings.ReplaceAll(query, " ", "")
+
+	type match struct {
+		entry TitleEntry
+		score int
+	}
+	matches := make([]match, 0)
+	for _, entry := range entries {
+		if score := searchScore(entry, query, queryTokens, tidQuery); score > 0 {
+			matches = append(matches, match{entry, score})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].score > matches[j].score
+	})
+
+	results := make([]TitleEntry, len(matches))
+	for i := range matches {
+		results[i] = matches[i].entry
+	}
+	return results
+}
+
+func searchScore(entry TitleEntry, query string, queryTokens []string, tidQuery string) int {
+	if isSearchTitleIDPrefix(entry.TitleID, tidQuery) {
+		return SEARCH_SCORE_TITLE_ID
+	}
+
+	name := NormalizeSearchText(entry.Name)
+	nameTokens := strings.Fields(name)
+	score := 0
+	for _, queryToken := range queryTokens {
+		tokenScore := 0
+		for _, nameToken := range nameTokens {
+			tokenScore = max(tokenScore, searchTokenScore(nameToken, queryToken))
+		}
+		if tokenScore == 0 {
+			return 0
+		}
+		score += tokenScore
+	}
+
+	if strings.HasPrefix(name, query) {
+		score += 2 * SEARCH_SCORE_PHRASE
+	} else if strings.Contains(name, query) {
+		score += SEARCH_SCORE_PHRASE
+	}
+	// between equal matches prefer the shorter name, "Mario Kart 8" before
+	// "Mario Kart 8 Deluxe Booster Course Pass"
+	return score*10 + max(0, minInt(9, 9-len(nameTokens)+len(queryTokens)))
+}
+
+// isSearchTitleIDPrefix matches the start of the full hexadecimal title ID,
+// or of its low half once at least 8 digits are typed.
+func isSearchTitleIDPrefix(tid uint64, query string) bool {
+	if len(query) < 4 || len(query) > 16 {
+		return false
+	}
+	for _, c := range query {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	formatted := fmt.Sprintf("%016x", tid)
+	return strings.HasPrefix(formatted, query) || (len(query) >= 8 && strings.HasPrefix(formatted[8:], query))
+}
+
+func searchTokenScore(nameToken, queryToken string) int {
+	switch {
+	case nameToken == queryToken:
+		return SEARCH_SCORE_EXACT_TOKEN
+	case strings.HasPrefix(nameToken, queryToken):
+		return SEARCH_SCORE_PREFIX_TOKEN
+	case strings.Contains(nameToken, queryToken):
+		return SEARCH_SCORE_INNER_TOKEN
+	}
+
+	name, query := []rune(nameToken), []rune(queryToken)
+	allowed := searchAllowedTypos(len(query))
+	if allowed == 0 {
+		return 0
+	}
+	distance := editDistance(name, query, allowed)
+	// a word still being typed is compared with the start of the name's word
+	if len(name) > len(query) {
+		distance = minInt(distance, editDistance(name[:len(query)], query, allowed))
+	}
+	if distance > allowed {
+		return 0
+	}
+	return SEARCH_SCORE_TYPO_TOKEN / distance
+}
+
+// searchAllowedTypos is how many typos a word of length runes may have, short
+// words need to match exactly or they'd match nearly everything.
+func searchAllowedTypos(length int) int {
+	switch {
+	case length < 4:
+		return 0
+	case length < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// editDistance is the Damerau-Levenshtein distance between a and b counting
+// adjacent transpositions as one edit, anything above limit is reported as
+// limit+1.
+func editDistance(a, b []rune, limit int) int {
+	if abs := len(a) - len(b); abs > limit || -abs > limit {
+		return limit + 1
+	}
+	previous2 := make([]int, len(b)+1)
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		rowMin := current[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				current[j] = minInt(current[j], previous2[j-2]+1)
+			}
+			rowMin = minInt(rowMin, current[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		previous2, previous, current = previous, current, previous2
+	}
+	return minInt(previous[len(b)], limit+1)
+}
+
+// minInt is the builtin min for ints, which utils.go's min shadows
+func minInt(first int, rest ...int) int {
+	for _, value := range rest {
+		if value < first {
+			first = value
+		}
+	}
+	return first
+}
@@ -0,0 +1,84 @@
+package wiiudownloader
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testSearchEntries = []TitleEntry{
+	{"Mario Kart 8 Deluxe Booster Course Pass", 0x0005000C1010EC00, MCP_REGION_EUROPE, TITLE_KEY_mypass, TITLE_CATEGORY_DLC},
+	{"Mario Kart 8", 0x000500001010EC00, MCP_REGION_EUROPE, TITLE_KEY_mypass, TITLE_CATEGORY_GAME},
+	{"Pokémon Rumble U", 0x0005000010130B00, MCP_REGION_JAPAN, TITLE_KEY_mypass, TITLE_CATEGORY_GAME},
+	{"ポケモンスクランブル Ｕ", 0x0005000010130C00, MCP_REGION_JAPAN, TITLE_KEY_mypass, TITLE_CATEGORY_GAME},
+	{"The Legend of Zelda: Breath of the Wild", 0x00050000101C9500, MCP_REGION_USA, TITLE_KEY_mypass, TITLE_CATEGORY_GAME},
+	{"Super Mario 3D World", 0x00050000101C9400, MCP_REGION_EUROPE, TITLE_KEY_mypass, TITLE_CATEGORY_GAME},
+}
+
+func TestNormalizeSearchText(t *testing.T) {
+	for input, expected := range map[string]string{
+		"Pokémon™ Rumble Ｕ":         "pokemon rumble u",
+		"Zelda: Breath of the Wild": "zelda breath of the wild",
+		"ÆON STRAßE":                "aeon strasse",
+		"Poke\u0301mon":             "pokemon",
+		"ぽけもん":                      "ポケモン",
+		"  ":                        "",
+	} {
+		if actual := NormalizeSearchText(input); actual != expected {
+			t.Errorf("NormalizeSearchText(%q) = %q, want %q", input, actual, expected)
+		}
+	}
+}
+
+func TestSearchTitles(t *testing.T) {
+	names := func(entries []TitleEntry) []string {
+		names := make([]string, len(entries))
+		for i, entry := range entries {
+			names[i] = entry.Name
+		}
+		return names
+	}
+	for _, test := range []struct {
+		query    string
+		expected []string
+	}{
+		// shorter names come first between equal matches
+		{"mario kart", []string{"Mario Kart 8", "Mario Kart 8 Deluxe Booster Course Pass"}},
+		// names starting with the query rank above the others
+		{"mario", []string{"Mario Kart 8", "Mario Kart 8 Deluxe Booster Course Pass", "Super Mario 3D World"}},
+		{"legend zelda", []string{"The Legend of Zelda: Breath of the Wild"}},
+		{"POKEMON", []string{"Pokémon Rumble U"}},
+		{"ポケモン", []string{"ポケモンスクランブル Ｕ"}},
+		{"zleda wild", []string{"The Legend of Zelda: Breath of the Wild"}},
+		{"breth", []string{"The Legend of Zelda: Breath of the Wild"}},
+		{"bre", []string{"The Legend of Zelda: Breath of the Wild"}},
+		// short words don't get typos
+		{"kat", []string{}},
+		{"101c95", []string{}},
+		{"00050000101C95", []string{"The Legend of Zelda: Breath of the Wild"}},
+		{"101c9400", []string{"Super Mario 3D World"}},
+		{"", names(testSearchEntries)},
+	} {
+		if actual := names(SearchTitles(testSearchEntries, test.query)); !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("SearchTitles(%q) = %q, want %q", test.query, actual, test.expected)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	for _, test := range []struct {
+		a, b     string
+		limit    int
+		expected int
+	}{
+		{"zelda", "zelda", 2, 0},
+		{"zelda", "zleda", 2, 1},
+		{"breath", "breth", 2, 1},
+		{"kitten", "sitting", 3, 3},
+		{"kitten", "sitting", 2, 3},
+		{"a", "abcdef", 2, 3},
+	} {
+		if actual := editDistance([]rune(test.a), []rune(test.b), test.limit); actual != test.expected {
+			t.Errorf("editDistance(%q, %q, %d) = %d, want %d", test.a, test.b, test.limit, actual, test.expected)
+		}
+	}
+}
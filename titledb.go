@@ -0,0 +1,351 @@
+package wiiudownloader
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TitleDB holds the known titles. It starts out with the entries generated
+// into db.go by grabTitles.py and can be loaded, and reloaded, from a JSON or
+// CSV file without rebuilding.
+//
+// Lookups go through indexes built whenever the entries change, the slices
+// returned are shared between callers and must not be modified.
+type TitleDB struct {
+	mu         sync.RWMutex
+	entries    []TitleEntry
+	path       string
+	byTid      map[uint64]TitleEntry
+	byCategory map[uint8][]TitleEntry
+
+	// filters caches Filter results, guarded by filtersMu while holding mu for reading
+	filtersMu sync.Mutex
+	filters   map[titleDBFilter][]TitleEntry
+}
+
+type titleDBFilter struct {
+	category uint8
+	regions  Region
+}
+
+var defaultTitleDB = NewTitleDB(titleEntry)
+
+// DefaultTitleDB returns the database behind GetTitleEntries and
+// GetTitleEntryFromTid.
+func DefaultTitleDB() *TitleDB {
+	return defaultTitleDB
+}
+
+// NewTitleDB returns a database holding a copy of entries.
+func NewTitleDB(entries []TitleEntry) *TitleDB {
+	db := &TitleDB{}
+	db.setEntries(append([]TitleEntry(nil), entries...), "")
+	return db
+}
+
+// LoadTitleDB returns a database read from a .json or .csv file.
+func LoadTitleDB(path string) (*TitleDB, error) {
+	db := &TitleDB{}
+	if err := db.Load(path); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// setEntries replaces the entries and rebuilds the indexes, the caller must
+// not hold mu.
+func (db *TitleDB) setEntries(entries []TitleEntry, path string) {
+	byTid := make(map[uint64]TitleEntry, len(entries))
+	byCategory := make(map[uint8][]TitleEntry)
+	for _, entry := range entries {
+		// disc titles can't be downloaded, they are only kept for WriteJSON
+		if entry.Category == TITLE_CATEGORY_DISC {
+			continue
+		}
+		if _, ok := byTid[entry.TitleID]; !ok {
+			byTid[entry.TitleID] = entry
+		}
+		byCategory[entry.Category] = append(byCategory[entry.Category], entry)
+		byCategory[TITLE_CATEGORY_ALL] = append(byCategory[TITLE_CATEGORY_ALL], entry)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.entries = entries
+	db.path = path
+	db.byTid = byTid
+	db.byCategory = byCategory
+	db.filtersMu.Lock()
+	db.filters = make(map[titleDBFilter][]TitleEntry)
+	db.filtersMu.Unlock()
+}
+
+// Load replaces the entries with the ones in a .json or .csv file, which
+// later Reload calls read again. On error the entries are left untouched.
+func (db *TitleDB) Load(path string) error {
+	entries, err := readTitleDBFile(path)
+	if err != nil {
+		return err
+	}
+	db.setEntries(entries, path)
+	return nil
+}
+
+// Reload reads the file last loaded again, a database that was never loaded
+// from a file goes back to the entries built into db.go.
+func (db *TitleDB) Reload() error {
+	path := db.Path()
+	if path == "" {
+		db.setEntries(append([]TitleEntry(nil), titleEntry...), "")
+		return nil
+	}
+	return db.Load(path)
+}
+
+// Path returns the file the entries were loaded from, or "" for the built-in ones.
+func (db *TitleDB) Path() string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.path
+}
+
+// Len returns the number of entries, disc titles included.
+func (db *TitleDB) Len() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.entries)
+}
+
+// Entries returns the titles of a category, TITLE_CATEGORY_ALL returns every
+// title except the ones only found on discs.
+func (db *TitleDB) Entries(category uint8) []TitleEntry {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.categoryEntries(category)
+}
+
+func (db *TitleDB) categoryEntries(category uint8) []TitleEntry {
+	entries := db.byCategory[category]
+	if entries == nil {
+		return []TitleEntry{}
+	}
+	// a full slice expression so appending never writes into the index
+	return entries[:len(entries):len(entries)]
+}
+
+// Filter returns the titles of a category available in any of the given
+// regions. Results are cached until the entries change.
+func (db *TitleDB) Filter(category uint8, regions Region) []TitleEntry {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	entries := db.categoryEntries(category)
+	if regions == REGION_ALL {
+		return entries
+	}
+
+	key := titleDBFilter{category, regions}
+	db.filtersMu.Lock()
+	defer db.filtersMu.Unlock()
+	if filtered, ok := db.filters[key]; ok {
+		return filtered
+	}
+	filtered := make([]TitleEntry, 0)
+	for _, entry := range entries {
+		if regions.Overlaps(Region(entry.Region)) {
+			filtered = append(filtered, entry)
+		}
+	}
+	filtered = filtered[:len(filtered):len(filtered)]
+	db.filters[key] = filtered
+	return filtered
+}
+
+// EntryFromTid returns the title with the given ID, or an empty entry.
+func (db *TitleDB) EntryFromTid(tid uint64) TitleEntry {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.byTid[tid]
+}
+
+// relatedTitleHighs are the kinds of title sharing the low half of a game's
+// title ID, in the order Related returns them.
+var relatedTitleHighs = []uint64{TID_HIGH_GAME, TID_HIGH_UPDATE, TID_HIGH_DLC, TID_HIGH_DEMO}
+
+// Related returns the game, update, DLC and demo sharing the low half of
+// tid, leaving out tid itself and the ones the database doesn't know.
+func (db *TitleDB) Related(tid uint64) []TitleEntry {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	related := make([]TitleEntry, 0, len(relatedTitleHighs))
+	if !isRelatableTitle(tid) {
+		return related
+	}
+	for _, high := range relatedTitleHighs {
+		relatedTid := high<<32 | tid&0xFFFFFFFF
+		if relatedTid == tid {
+			continue
+		}
+		if entry, ok := db.byTid[relatedTid]; ok {
+			related = append(related, entry)
+		}
+	}
+	return related
+}
+
+func isRelatableTitle(tid uint64) bool {
+	for _, high := range relatedTitleHighs {
+		if tid>>32 == high {
+			return true
+		}
+	}
+	return false
+}
+
+// titleDBRecord is an entry as stored in JSON and CSV files. Title IDs are
+// hexadecimal and categories are spelled out, regions stay MCP_REGION_* masks.
+type titleDBRecord struct {
+	Name     string `json:"name"`
+	TitleID  string `json:"title_id"`
+	Region   uint8  `json:"region"`
+	Key      uint8  `json:"key"`
+	Category string `json:"category"`
+}
+
+var titleDBCategories = map[string]uint8{
+	"game":   TITLE_CATEGORY_GAME,
+	"update": TITLE_CATEGORY_UPDATE,
+	"dlc":    TITLE_CATEGORY_DLC,
+	"demo":   TITLE_CATEGORY_DEMO,
+	"disc":   TITLE_CATEGORY_DISC,
+}
+
+func (r *titleDBRecord) entry() (TitleEntry, error) {
+	tid, err := strconv.ParseUint(strings.TrimSpace(r.TitleID), 16, 64)
+	if err != nil {
+		return TitleEntry{}, fmt.Errorf("invalid title id %q", r.TitleID)
+	}
+	category, ok := titleDBCategories[strings.ToLower(strings.TrimSpace(r.Category))]
+	if !ok {
+		return TitleEntry{}, fmt.Errorf("unknown category %q", r.Category)
+	}
+	return TitleEntry{Name: r.Name, TitleID: tid, Region: r.Region, Key: r.Key, Category: category}, nil
+}
+
+func readTitleDBFile(path string) ([]TitleEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return ReadTitleDBJSON(f)
+	case ".csv":
+		return ReadTitleDBCSV(f)
+	default:
+		return nil, fmt.Errorf("unsupported title database format '%s', expected .json or .csv", filepath.Ext(path))
+	}
+}
+
+// ReadTitleDBJSON reads an array of {"name", "title_id", "region", "key",
+// "category"} objects.
+func ReadTitleDBJSON(r io.Reader) ([]TitleEntry, error) {
+	records := make([]titleDBRecord, 0)
+	if err := json.NewDecoder(r).Decode(&records); err != nil {
+		return nil, fmt.Errorf("failed to parse title database: %w", err)
+	}
+	entries := make([]TitleEntry, len(records))
+	for i := range records {
+		entry, err := records[i].entry()
+		if err != nil {
+			return nil, fmt.Errorf("title database entry %d: %w", i, err)
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+// ReadTitleDBCSV reads a CSV whose header names the name, title_id, region,
+// key and category columns, in any order.
+func ReadTitleDBCSV(r io.Reader) ([]TitleEntry, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read title database header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"name", "title_id", "region", "key", "category"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("title database is missing the %s column", name)
+		}
+	}
+
+	entries := make([]TitleEntry, 0)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse title database: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+		region, err := strconv.ParseUint(strings.TrimSpace(row[columns["region"]]), 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("title database line %d: invalid region %q", line, row[columns["region"]])
+		}
+		key, err := strconv.ParseUint(strings.TrimSpace(row[columns["key"]]), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("title database line %d: invalid key %q", line, row[columns["key"]])
+		}
+		record := titleDBRecord{
+			Name:     row[columns["name"]],
+			TitleID:  row[columns["title_id"]],
+			Region:   uint8(region),
+			Key:      uint8(key),
+			Category: row[columns["category"]],
+		}
+		entry, err := record.entry()
+		if err != nil {
+			return nil, fmt.Errorf("title database line %d: %w", line, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// WriteJSON writes every entry in the format ReadTitleDBJSON reads, as a
+// starting point for a custom database.
+func (db *TitleDB) WriteJSON(w io.Writer) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	records := make([]titleDBRecord, len(db.entries))
+	for i, entry := range db.entries {
+		category := ""
+		for name, value := range titleDBCategories {
+			if value == entry.Category {
+				category = name
+			}
+		}
+		if category == "" {
+			return fmt.Errorf("title %016X has an unknown category %d", entry.TitleID, entry.Category)
+		}
+		records[i] = titleDBRecord{Name: entry.Name, TitleID: fmt.Sprintf("%016X", entry.TitleID), Region: entry.Region, Key: entry.Key, Category: category}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(records)
+}
@@ -0,0 +1,242 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testTitleDBEntries = []TitleEntry{
+	{"Test Game", 0x0005000010FFFF00, MCP_REGION_USA | MCP_REGION_EUROPE, TITLE_KEY_nintendo, TITLE_CATEGORY_GAME},
+	{"Test Game", 0x0005000E10FFFF00, MCP_REGION_USA, TITLE_KEY_mypass, TITLE_CATEGORY_UPDATE},
+	{"Test Disc", 0x0005000010FFFE00, MCP_REGION_JAPAN, TITLE_KEY_mypass, TITLE_CATEGORY_DISC},
+}
+
+const testTitleDBCSV = `category,title_id,name,region,key
+game,0005000010FFFF00,"Test Game",0x06,1
+Update,0005000e10ffff00,Test Game,2,0
+disc,0005000010FFFE00,Test Disc,1,0
+`
+
+func TestTitleDBFormats(t *testing.T) {
+	jsonData := &bytes.Buffer{}
+	if err := NewTitleDB(testTitleDBEntries).WriteJSON(jsonData); err != nil {
+		t.Fatalf("WriteJSON failed: %v", err)
+	}
+	fromJSON, err := ReadTitleDBJSON(jsonData)
+	if err != nil {
+		t.Fatalf("ReadTitleDBJSON failed: %v", err)
+	}
+	if !reflect.DeepEqual(fromJSON, testTitleDBEntries) {
+		t.Errorf("JSON round trip gave %+v", fromJSON)
+	}
+
+	fromCSV, err := ReadTitleDBCSV(strings.NewReader(testTitleDBCSV))
+	if err != nil {
+		t.Fatalf("ReadTitleDBCSV failed: %v", err)
+	}
+	if !reflect.DeepEqual(fromCSV, testTitleDBEntries) {
+		t.Errorf("CSV gave %+v", fromCSV)
+	}
+
+	for _, invalid := range []string{
+		"name,title_id,region,key\nA,0005000010FFFF00,1,0\n",
+		"name,title_id,region,key,category\nA,not hex,1,0,game\n",
+		"name,title_id,region,key,category\nA,0005000010FFFF00,1,0,movie\n",
+	} {
+		if _, err := ReadTitleDBCSV(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+	if _, err := ReadTitleDBJSON(strings.NewReader(`[{"name": "A", "title_id": "0005000010FFFF00", "category": "movie"}]`)); err == nil {
+		t.Error("expected an unknown category to be rejected")
+	}
+}
+
+func TestTitleDBReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "titles.csv")
+	if err := os.WriteFile(path, []byte(testTitleDBCSV), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := LoadTitleDB(path)
+	if err != nil {
+		t.Fatalf("LoadTitleDB failed: %v", err)
+	}
+	if db.Len() != 3 || len(db.Entries(TITLE_CATEGORY_ALL)) != 2 || len(db.Entries(TITLE_CATEGORY_UPDATE)) != 1 {
+		t.Errorf("unexpected entries %+v", db.Entries(TITLE_CATEGORY_ALL))
+	}
+	if entry := db.EntryFromTid(0x0005000010FFFF00); entry.Name != "Test Game" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if entry := db.EntryFromTid(0x0005000010FFFE00); entry.TitleID != 0 {
+		t.Errorf("disc titles shouldn't be found, got %+v", entry)
+	}
+
+	if err := os.WriteFile(path, []byte(testTitleDBCSV+"dlc,0005000C10FFFF00,Test DLC,2,0\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if entry := db.EntryFromTid(0x0005000C10FFFF00); entry.Name != "Test DLC" {
+		t.Errorf("reload didn't pick up the new title, got %+v", entry)
+	}
+
+	// a broken file keeps the entries already loaded
+	if err := os.WriteFile(path, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Reload(); err == nil {
+		t.Error("expected reloading a broken file to fail")
+	}
+	if db.Len() != 4 || db.Path() != path {
+		t.Errorf("failed reload changed the database to %d entries from %q", db.Len(), db.Path())
+	}
+
+	builtin := NewTitleDB(titleEntry)
+	builtin.entries = nil
+	if err := builtin.Reload(); err != nil || builtin.Len() != len(titleEntry) {
+		t.Errorf("reloading the built-in database gave %d entries: %v", builtin.Len(), err)
+	}
+}
+
+func TestTitleDBFilter(t *testing.T) {
+	db := NewTitleDB(testTitleDBEntries)
+	if entries := db.Filter(TITLE_CATEGORY_ALL, 0xFF); len(entries) != 2 {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+	if entries := db.Filter(TITLE_CATEGORY_GAME, MCP_REGION_EUROPE); len(entries) != 1 || entries[0].TitleID != 0x0005000010FFFF00 {
+		t.Errorf("unexpected European games %+v", entries)
+	}
+	if entries := db.Filter(TITLE_CATEGORY_UPDATE, MCP_REGION_EUROPE); len(entries) != 0 {
+		t.Errorf("unexpected European updates %+v", entries)
+	}
+	if entries := db.Filter(TITLE_CATEGORY_DLC, 0xFF); entries == nil || len(entries) != 0 {
+		t.Errorf("expected an empty list, got %#v", entries)
+	}
+
+	// appending to a result must not change the index
+	games := db.Entries(TITLE_CATEGORY_GAME)
+	_ = append(games, TitleEntry{Name: "Appended"})
+	if all := db.Entries(TITLE_CATEGORY_ALL); all[1].Name == "Appended" {
+		t.Error("appending to a result changed the index")
+	}
+
+	// cached filters are dropped when the entries change
+	if err := db.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if entries := db.Filter(TITLE_CATEGORY_GAME, MCP_REGION_EUROPE); len(entries) != 0 && entries[0].TitleID == 0x0005000010FFFF00 {
+		t.Errorf("stale filter after reload %+v", entries)
+	}
+}
+
+// benchmarkTitleEntries is about the size of the real database
+func benchmarkTitleEntries() []TitleEntry {
+	categories := []uint8{TITLE_CATEGORY_GAME, TITLE_CATEGORY_UPDATE, TITLE_CATEGORY_DLC, TITLE_CATEGORY_DEMO}
+	highs := []uint64{TID_HIGH_GAME, TID_HIGH_UPDATE, TID_HIGH_DLC, TID_HIGH_DEMO}
+	regions := []uint8{MCP_REGION_JAPAN, MCP_REGION_USA, MCP_REGION_EUROPE, MCP_REGION_USA | MCP_REGION_EUROPE}
+	entries := make([]TitleEntry, 8000)
+	for i := range entries {
+		entries[i] = TitleEntry{
+			Name:     "Title",
+			TitleID:  highs[i%4]<<32 | uint64(0x10000000+i/4*0x100),
+			Region:   regions[i/4%4],
+			Category: categories[i%4],
+		}
+	}
+	return entries
+}
+
+// linearEntries and linearEntryFromTid are the scans TitleDB replaced, a copy
+// of the category followed by a filter over it.
+func linearEntries(entries []TitleEntry, category uint8) []TitleEntry {
+	titleEntries := make([]TitleEntry, 0)
+	for _, entry := range entries {
+		if (category == TITLE_CATEGORY_ALL || category == entry.Category) && entry.Category != TITLE_CATEGORY_DISC {
+			titleEntries = append(titleEntries, entry)
+		}
+	}
+	return titleEntries
+}
+
+func linearEntryFromTid(entries []TitleEntry, tid uint64) TitleEntry {
+	for _, entry := range linearEntries(entries, TITLE_CATEGORY_ALL) {
+		if entry.TitleID == tid {
+			return entry
+		}
+	}
+	return TitleEntry{}
+}
+
+func BenchmarkEntryFromTid(b *testing.B) {
+	entries := benchmarkTitleEntries()
+	tid := entries[len(entries)/2].TitleID
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			linearEntryFromTid(entries, tid)
+		}
+	})
+	b.Run("indexed", func(b *testing.B) {
+		db := NewTitleDB(entries)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			db.EntryFromTid(tid)
+		}
+	})
+}
+
+// BenchmarkTitleFilter is the category and region part of GET /api/titles
+func BenchmarkTitleFilter(b *testing.B) {
+	entries := benchmarkTitleEntries()
+	b.Run("linear", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			filtered := make([]TitleEntry, 0)
+			for _, entry := range linearEntries(entries, TITLE_CATEGORY_GAME) {
+				if entry.Region&MCP_REGION_EUROPE != 0 {
+					filtered = append(filtered, entry)
+				}
+			}
+		}
+	})
+	b.Run("indexed", func(b *testing.B) {
+		db := NewTitleDB(entries)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			db.Filter(TITLE_CATEGORY_GAME, MCP_REGION_EUROPE)
+		}
+	})
+}
+
+func TestTitleDBRelated(t *testing.T) {
+	db := NewTitleDB([]TitleEntry{
+		{"Game", 0x0005000010101A00, MCP_REGION_USA, TITLE_KEY_mypass, TITLE_CATEGORY_GAME},
+		{"Game", 0x0005000E10101A00, MCP_REGION_USA, TITLE_KEY_mypass, TITLE_CATEGORY_UPDATE},
+		{"Game", 0x0005000C10101A00, MCP_REGION_USA, TITLE_KEY_mypass, TITLE_CATEGORY_DLC},
+		{"Other Game", 0x0005000010101B00, MCP_REGION_USA, TITLE_KEY_mypass, TITLE_CATEGORY_GAME},
+		{"System App", 0x0005001010101A00, MCP_REGION_USA, TITLE_KEY_mypass, TITLE_CATEGORY_GAME},
+	})
+	titleIDs := func(entries []TitleEntry) []uint64 {
+		tids := make([]uint64, 0, len(entries))
+		for _, entry := range entries {
+			tids = append(tids, entry.TitleID)
+		}
+		return tids
+	}
+
+	if related := titleIDs(db.Related(0x0005000010101A00)); !reflect.DeepEqual(related, []uint64{0x0005000E10101A00, 0x0005000C10101A00}) {
+		t.Errorf("unexpected titles related to the game %016X", related)
+	}
+	if related := titleIDs(db.Related(0x0005000C10101A00)); !reflect.DeepEqual(related, []uint64{0x0005000010101A00, 0x0005000E10101A00}) {
+		t.Errorf("unexpected titles related to the DLC %016X", related)
+	}
+	if related := db.Related(0x0005000010101B00); len(related) != 0 {
+		t.Errorf("expected no related titles, got %+v", related)
+	}
+	if related := db.Related(0x0005001010101A00); len(related) != 0 {
+		t.Errorf("system titles shouldn't be related to games, got %+v", related)
+	}
+}
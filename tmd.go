@@ -2,6 +2,7 @@ package wiiudownloader
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -72,7 +73,7 @@ func ParseTMD(data []byte) (*TMD, error) {
 				return nil, err
 			}
 
-			tmd.Contents[i].Hash = make([]byte, 0x20)
+			tmd.Contents[i].Hash = make([]byte, sha1.Size)
 			if err := binary.Read(reader, binary.BigEndian, &tmd.Contents[i].Hash); err != nil {
 				return nil, err
 			}
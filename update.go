@@ -0,0 +1,268 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// UPDATE_STAGING_DIRECTORY holds the contents UpdateTitle downloads until
+// all of them arrived, so a failed update leaves the old version intact.
+const UPDATE_STAGING_DIRECTORY = ".update"
+
+// ErrDecryptedTitle is returned by UpdateTitle for a download that was
+// decrypted, its decrypted files would stay at the old version.
+var ErrDecryptedTitle = errors.New("decrypted titles can't be updated, download the new version instead")
+
+// renameFile is os.Rename, replaced by tests to fail partway through an update
+var renameFile = os.Rename
+
+// UpdateResult describes what UpdateTitle changed.
+type UpdateResult struct {
+	Dir             string // folder of the title, renamed to the new version if TitleDirectoryName named it
+	OldVersion      uint16
+	NewVersion      uint16
+	Downloaded      []uint32 // content IDs fetched from the CDN
+	Removed         []uint32 // content IDs the new version no longer has
+	Reused          []uint32 // content IDs kept from the old version
+	BytesDownloaded uint64
+	BytesSaved      uint64 // size of the reused contents
+}
+
+// UpToDate reports whether the title already was at the latest version.
+func (r *UpdateResult) UpToDate() bool {
+	return r.OldVersion == r.NewVersion && len(r.Downloaded) == 0 && len(r.Removed) == 0
+}
+
+// contentFileNames returns the files of a content in a download folder, the
+// .h3 only exists for hashed contents.
+func contentFileNames(content Content) []string {
+	names := []string{fmt.Sprintf("%08X.app", content.ID)}
+	if content.Type&0x2 == 2 {
+		names = append(names, fmt.Sprintf("%08X.h3", content.ID))
+	}
+	return names
+}
+
+// isContentReusable reports whether content is in the old TMD unchanged and
+// its files are still on disk.
+func isContentReusable(dir string, content Content, oldContents map[uint32]Content) bool {
+	old, ok := oldContents[content.ID]
+	if !ok || old.Size != content.Size || old.Type != content.Type || !bytes.Equal(old.Hash, content.Hash) {
+		return false
+	}
+	for i, name := range contentFileNames(content) {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil || (i == 0 && uint64(info.Size()) != content.Size) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasDecryptedFiles reports whether dir holds the decrypted tree of a title.
+func hasDecryptedFiles(dir string) bool {
+	for _, name := range []string{"code", "content", "meta"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err == nil && info.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateTitle brings a title downloaded by DownloadTitle to the latest
+// version, only downloading the contents that changed. The new TMD replaces
+// the old one once everything is in place and contents the new version
+// doesn't use are deleted. Decrypted downloads are refused with
+// ErrDecryptedTitle. A cancelled or failed update returns an error and
+// leaves the old version as it was. A folder named by TitleDirectoryName is
+// renamed to the new version unless a folder of that name already exists.
+func UpdateTitle(dir string, progressReporter ProgressReporter, client *http.Client) (*UpdateResult, error) {
+	if hasDecryptedFiles(dir) {
+		return nil, ErrDecryptedTitle
+	}
+	tmdPath := filepath.Join(dir, "title.tmd")
+	oldTMDData, err := os.ReadFile(tmdPath)
+	if err != nil {
+		return nil, err
+	}
+	oldTMD, err := ParseTMD(oldTMDData)
+	if err != nil {
+		return nil, err
+	}
+
+	titleID := fmt.Sprintf("%016x", oldTMD.TitleID)
+	baseURL := fmt.Sprintf("%s/%s", cdnDownloadURL, titleID)
+	newTMDData, err := fetchTitleFile(client, baseURL+"/tmd")
+	if err != nil {
+		return nil, err
+	}
+	newTMD, err := ParseTMD(newTMDData)
+	if err != nil {
+		return nil, err
+	}
+	if newTMD.TitleID != oldTMD.TitleID {
+		return nil, fmt.Errorf("the CDN sent the TMD of %016X for %016X", newTMD.TitleID, oldTMD.TitleID)
+	}
+
+	result := &UpdateResult{Dir: dir, OldVersion: oldTMD.TitleVersion, NewVersion: newTMD.TitleVersion}
+	oldContents := make(map[uint32]Content, len(oldTMD.Contents))
+	for _, content := range oldTMD.Contents {
+		oldContents[content.ID] = content
+	}
+	changed := make([]Content, 0)
+	for _, content := range newTMD.Contents {
+		if isContentReusable(dir, content, oldContents) {
+			result.Reused = append(result.Reused, content.ID)
+			result.BytesSaved += content.Size
+		} else {
+			changed = append(changed, content)
+			result.Downloaded = append(result.Downloaded, content.ID)
+			result.BytesDownloaded += content.Size
+		}
+	}
+
+	progressReporter.ResetTotals()
+	progressReporter.SetGameTitle(GetTitleEntryFromTid(newTMD.TitleID).Name)
+	progressReporter.SetDownloadSize(int64(result.BytesDownloaded))
+	progressReporter.SetStartTime(time.Now())
+
+	stagingDir := filepath.Join(dir, UPDATE_STAGING_DIRECTORY)
+	if err := os.MkdirAll(stagingDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	g, ctx := errgroup.WithContext(context.Background())
+	g.SetLimit(maxConcurrentDownloads)
+	sem := semaphore.NewWeighted(maxConcurrentDownloads)
+	for _, content := range changed {
+		for _, name := range contentFileNames(content) {
+			g.Go(func() error {
+				// contents are served without the .app extension, hashes with .h3
+				contentURL := fmt.Sprintf("%s/%s", baseURL, strings.TrimSuffix(name, ".app"))
+				if err := downloadFileWithSemaphore(ctx, progressReporter, client, contentURL, filepath.Join(stagingDir, name), true, sem); err != nil {
+					if progressReporter.Cancelled() {
+						return errCancel
+					}
+					return err
+				}
+				if progressReporter.Cancelled() {
+					return errCancel
+				}
+				return nil
+			})
+		}
+	}
+	if err := g.Wait(); err != nil {
+		if err == errCancel {
+			return nil, context.Canceled
+		}
+		return nil, err
+	}
+
+	// Everything arrived. The files of the old contents are moved aside before
+	// the new ones are moved in, so a failure puts them back and the old TMD
+	// matches its contents again.
+	asideDir := filepath.Join(stagingDir, "old")
+	if err := os.MkdirAll(asideDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	var movedAside, movedIn []string
+	rollback := func() {
+		for _, name := range movedIn {
+			os.Remove(filepath.Join(dir, name))
+		}
+		for _, name := range movedAside {
+			os.Rename(filepath.Join(asideDir, name), filepath.Join(dir, name))
+		}
+	}
+	for _, content := range changed {
+		for _, name := range contentFileNames(content) {
+			if err := renameFile(filepath.Join(dir, name), filepath.Join(asideDir, name)); err == nil {
+				movedAside = append(movedAside, name)
+			} else if !os.IsNotExist(err) {
+				rollback()
+				return nil, err
+			}
+		}
+	}
+	for _, content := range changed {
+		for _, name := range contentFileNames(content) {
+			if err := renameFile(filepath.Join(stagingDir, name), filepath.Join(dir, name)); err != nil {
+				rollback()
+				return nil, err
+			}
+			movedIn = append(movedIn, name)
+		}
+	}
+	if err := writeFileAtomic(tmdPath, newTMDData); err != nil {
+		rollback()
+		return nil, err
+	}
+
+	newContents := make(map[uint32]bool, len(newTMD.Contents))
+	for _, content := range newTMD.Contents {
+		newContents[content.ID] = true
+	}
+	for _, content := range oldTMD.Contents {
+		if newContents[content.ID] {
+			continue
+		}
+		for _, name := range contentFileNames(content) {
+			if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		result.Removed = append(result.Removed, content.ID)
+	}
+
+	if result.NewVersion != result.OldVersion {
+		os.RemoveAll(stagingDir)
+		result.Dir = renameTitleDirectory(dir, titleID, result.OldVersion, result.NewVersion)
+	}
+	return result, nil
+}
+
+// renameTitleDirectory renames the folder of a title named by
+// TitleDirectoryName after its new version, returning where the title is.
+// Folders named otherwise and names already taken are left alone.
+func renameTitleDirectory(dir, titleID string, oldVersion, newVersion uint16) string {
+	dir = filepath.Clean(dir)
+	name := filepath.Base(dir)
+	if !strings.EqualFold(name, TitleDirectoryName(titleID, oldVersion)) {
+		return dir
+	}
+	// the title ID keeps the case it was downloaded with
+	newDir := filepath.Join(filepath.Dir(dir), TitleDirectoryName(name[:len(titleID)], newVersion))
+	if _, err := os.Lstat(newDir); !os.IsNotExist(err) {
+		return dir
+	}
+	if err := os.Rename(dir, newDir); err != nil {
+		return dir
+	}
+	return newDir
+}
+
+// writeFileAtomic replaces path with data through a temporary file, readers
+// see either the old or the new contents.
+func writeFileAtomic(path string, data []byte) error {
+	tempPath := path + ".tmp"
+	if err := os.WriteFile(tempPath, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return nil
+}
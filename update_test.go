@@ -0,0 +1,132 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestUpdateTitle(t *testing.T) {
+	const tid = 0x0005000E101C9500
+	content := func(id uint32, contentType uint16, size int, hash byte) Content {
+		return Content{ID: id, Index: []byte{0, byte(id)}, Type: contentType, Size: uint64(size), Hash: bytes.Repeat([]byte{hash}, 0x20)}
+	}
+	unchanged := content(0, 0x2003, 0x40, 0xAA)
+	oldVersion := []Content{unchanged, content(1, 0x2001, 0x20, 0xBB), content(2, 0x2003, 0x10, 0xCC)}
+	newVersion := []Content{unchanged, content(1, 0x2001, 0x30, 0xBD), content(3, 0x2001, 0x50, 0xDD)}
+
+	// the folder is named after the version, like DownloadTitleVersion names it
+	dir := filepath.Join(t.TempDir(), TitleDirectoryName("0005000E101C9500", 16))
+	writeTestTree(t, dir, map[string][]byte{
+		"title.tmd":    testTMD(tid, 16, oldVersion...),
+		"00000000.app": bytes.Repeat([]byte{0}, 0x40),
+		"00000000.h3":  {0},
+		"00000001.app": bytes.Repeat([]byte{1}, 0x20),
+		"00000002.app": bytes.Repeat([]byte{2}, 0x10),
+		"00000002.h3":  {2},
+	})
+	newTMD := testTMD(tid, 32, newVersion...)
+	serveTestCDN(t, map[string][]byte{
+		"tmd":      newTMD,
+		"00000001": bytes.Repeat([]byte{0x11}, 0x30),
+		"00000003": bytes.Repeat([]byte{0x33}, 0x50),
+	})
+
+	result, err := UpdateTitle(dir, testProgressReporter{}, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("UpdateTitle failed: %v", err)
+	}
+	newDir := filepath.Join(filepath.Dir(dir), "0005000E101C9500_v32")
+	expected := &UpdateResult{
+		Dir:             newDir,
+		OldVersion:      16,
+		NewVersion:      32,
+		Downloaded:      []uint32{1, 3},
+		Removed:         []uint32{2},
+		Reused:          []uint32{0},
+		BytesDownloaded: 0x80,
+		BytesSaved:      0x40,
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	for name, expected := range map[string][]byte{
+		"title.tmd":    newTMD,
+		"00000000.app": bytes.Repeat([]byte{0}, 0x40),
+		"00000001.app": bytes.Repeat([]byte{0x11}, 0x30),
+		"00000003.app": bytes.Repeat([]byte{0x33}, 0x50),
+	} {
+		if data, err := os.ReadFile(filepath.Join(newDir, name)); err != nil || !bytes.Equal(data, expected) {
+			t.Errorf("%s wasn't updated: %v", name, err)
+		}
+	}
+	for _, name := range []string{"00000002.app", "00000002.h3", UPDATE_STAGING_DIRECTORY, "title.tmd.tmp"} {
+		if _, err := os.Stat(filepath.Join(newDir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should be gone", name)
+		}
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected the folder of the old version to be renamed, got %v", err)
+	}
+
+	// a second update has nothing left to do
+	result, err = UpdateTitle(newDir, testProgressReporter{}, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("UpdateTitle failed: %v", err)
+	}
+	if !result.UpToDate() || result.BytesSaved != 0xC0 || result.Dir != newDir {
+		t.Errorf("expected the title to be up to date, got %+v", result)
+	}
+}
+
+func TestUpdateTitleRollback(t *testing.T) {
+	const tid = 0x0005000E101C9500
+	content := func(id uint32, size int, hash byte) Content {
+		return Content{ID: id, Index: []byte{0, byte(id)}, Type: 0x2001, Size: uint64(size), Hash: bytes.Repeat([]byte{hash}, 0x20)}
+	}
+	oldTMD := testTMD(tid, 16, content(0, 0x10, 0xAA), content(1, 0x20, 0xBB))
+	oldFiles := map[string][]byte{
+		"title.tmd":    oldTMD,
+		"00000000.app": bytes.Repeat([]byte{0}, 0x10),
+		"00000001.app": bytes.Repeat([]byte{1}, 0x20),
+	}
+	dir := t.TempDir()
+	writeTestTree(t, dir, oldFiles)
+	serveTestCDN(t, map[string][]byte{
+		"tmd":      testTMD(tid, 32, content(0, 0x18, 0xAB), content(1, 0x28, 0xBC)),
+		"00000000": bytes.Repeat([]byte{0x10}, 0x18),
+		"00000001": bytes.Repeat([]byte{0x11}, 0x28),
+	})
+
+	// the second new content fails to move in after the first one did
+	renames := 0
+	renameFile = func(oldPath, newPath string) error {
+		if renames++; renames == 4 {
+			return errors.New("disk full")
+		}
+		return os.Rename(oldPath, newPath)
+	}
+	t.Cleanup(func() { renameFile = os.Rename })
+
+	if _, err := UpdateTitle(dir, testProgressReporter{}, http.DefaultClient); err == nil {
+		t.Fatal("expected the update to fail")
+	}
+	for name, expected := range oldFiles {
+		if data, err := os.ReadFile(filepath.Join(dir, name)); err != nil || !bytes.Equal(data, expected) {
+			t.Errorf("%s wasn't restored: %v", name, err)
+		}
+	}
+}
+
+func TestUpdateTitleDecrypted(t *testing.T) {
+	dir := t.TempDir()
+	writeTestTree(t, dir, map[string][]byte{"title.tmd": testTMD(0x0005000E101C9500, 16), "code/app.xml": {}})
+	if _, err := UpdateTitle(dir, testProgressReporter{}, http.DefaultClient); !errors.Is(err, ErrDecryptedTitle) {
+		t.Errorf("expected ErrDecryptedTitle, got %v", err)
+	}
+}
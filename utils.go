@@ -14,6 +14,9 @@ func min(a, b uint64) uint64 {
 }
 
 func isThisDecryptedFile(path string) bool {
+	if filepath.Base(filepath.Dir(path)) == WII_DECRYPTED_DIRECTORY || filepath.Ext(path) == ".wad" {
+		return true
+	}
 	return strings.Contains(path, "code") || strings.Contains(path, "content") || strings.Contains(path, "meta")
 }
 
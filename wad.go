@@ -0,0 +1,366 @@
+package wiiudownloader
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Wii titles have no FST, every content is a plain file encrypted with the
+// title key. The ticket selects which common key decrypts the title key.
+var (
+	wiiCommonKey       = []byte{0xEB, 0xE4, 0x2A, 0x22, 0x5E, 0x85, 0x93, 0xE4, 0x48, 0xD9, 0xC5, 0x45, 0x73, 0x81, 0xAA, 0xF7}
+	wiiKoreanCommonKey = []byte{0x63, 0xB8, 0x2B, 0xB4, 0xF4, 0x61, 0x4E, 0x2E, 0x13, 0xF2, 0xFE, 0xFB, 0xBA, 0x4C, 0x9B, 0x7E}
+	vWiiCommonKey      = []byte{0x30, 0xBF, 0xC7, 0x6E, 0x7C, 0x19, 0xAF, 0xBB, 0x23, 0x16, 0x33, 0x30, 0xCE, 0xD7, 0xC2, 0x8D}
+)
+
+const (
+	WII_TICKET_SIZE             = 0x2A4
+	WII_TMD_HEADER_SIZE         = 0x1E4
+	WII_TMD_CONTENT_SIZE        = 0x24
+	WII_TICKET_KEY_INDEX        = 0x1F1
+	WII_DECRYPTED_DIRECTORY     = "decrypted"
+	WAD_HEADER_SIZE             = 0x20
+	WAD_ALIGNMENT               = 0x40
+	WAD_TYPE_INSTALLABLE        = 0x4973 // "Is"
+	signedDataIssuerOffset      = 0x140
+	certificateHeaderSize       = 0x88
+	certificateNameOffset       = 0x44
+	certificateKeyTypeOffset    = 0x40
+	certificateSignatureRSA4096 = 0x00010000
+	certificateSignatureRSA2048 = 0x00010001
+	certificateSignatureECC     = 0x00010002
+)
+
+func isWiiTitle(path string) bool {
+	tmdData, err := os.ReadFile(filepath.Join(path, "title.tmd"))
+	if err != nil {
+		return false
+	}
+	tmd, err := ParseTMD(tmdData)
+	return err == nil && tmd.Version == TMD_VERSION_WII
+}
+
+func getWiiCommonKey(keyIndex byte) ([]byte, error) {
+	switch keyIndex {
+	case 0:
+		return wiiCommonKey, nil
+	case 1:
+		return wiiKoreanCommonKey, nil
+	case 2:
+		return vWiiCommonKey, nil
+	default:
+		return nil, fmt.Errorf("unknown common key index %d", keyIndex)
+	}
+}
+
+type certificate struct {
+	issuer string
+	name   string
+	data   []byte
+}
+
+func readCString(data []byte) string {
+	if end := bytes.IndexByte(data, 0); end >= 0 {
+		data = data[:end]
+	}
+	return string(data)
+}
+
+// parseCertificates splits a certificate chain, the size of every
+// certificate follows from its signature and public key types.
+func parseCertificates(data []byte) []certificate {
+	certs := make([]certificate, 0)
+	for len(data) >= 4 {
+		var signatureSize int
+		switch binary.BigEndian.Uint32(data) {
+		case certificateSignatureRSA4096:
+			signatureSize = 0x200
+		case certificateSignatureRSA2048:
+			signatureSize = 0x100
+		case certificateSignatureECC:
+			signatureSize = 0x3C
+		default:
+			return certs
+		}
+		headerOffset := (4 + signatureSize + WAD_ALIGNMENT - 1) &^ (WAD_ALIGNMENT - 1)
+		if len(data) < headerOffset+certificateHeaderSize {
+			return certs
+		}
+		header := data[headerOffset:]
+
+		var keySize int
+		switch binary.BigEndian.Uint32(header[certificateKeyTypeOffset:]) {
+		case 0: // RSA-4096
+			keySize = 0x238
+		case 1: // RSA-2048
+			keySize = 0x138
+		case 2: // ECC
+			keySize = 0x78
+		default:
+			return certs
+		}
+		size := headerOffset + certificateHeaderSize + keySize
+		if len(data) < size {
+			return certs
+		}
+		certs = append(certs, certificate{
+			issuer: readCString(header[:0x40]),
+			name:   readCString(header[certificateNameOffset : certificateNameOffset+0x40]),
+			data:   data[:size],
+		})
+		data = data[size:]
+	}
+	return certs
+}
+
+// buildWiiCertificateChain returns the CA, CP and XS certificates that sign
+// the TMD and the ticket, in the order WADs store them.
+func buildWiiCertificateChain(certs []certificate, tmdIssuer, ticketIssuer string) ([]byte, error) {
+	find := func(fullName string) (*certificate, error) {
+		for i := range certs {
+			if certs[i].issuer+"-"+certs[i].name == fullName {
+				return &certs[i], nil
+			}
+		}
+		return nil, fmt.Errorf("certificate %s not found", fullName)
+	}
+
+	cp, err := find(tmdIssuer)
+	if err != nil {
+		return nil, err
+	}
+	xs, err := find(ticketIssuer)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := find(cp.issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := make([]byte, 0, len(ca.data)+len(cp.data)+len(xs.data))
+	chain = append(chain, ca.data...)
+	chain = append(chain, cp.data...)
+	return append(chain, xs.data...), nil
+}
+
+type wiiTitle struct {
+	tmd        *TMD
+	tmdData    []byte
+	ticketData []byte
+	certs      []certificate
+}
+
+func readWiiTitle(path string) (*wiiTitle, error) {
+	tmdData, err := os.ReadFile(filepath.Join(path, "title.tmd"))
+	if err != nil {
+		return nil, err
+	}
+	tmd, err := ParseTMD(tmdData)
+	if err != nil {
+		return nil, err
+	}
+	if tmd.Version != TMD_VERSION_WII {
+		return nil, errors.New("not a wii title")
+	}
+	if err := resolveContentNames(path, tmd); err != nil {
+		return nil, err
+	}
+	tmdSize := WII_TMD_HEADER_SIZE + int(tmd.ContentCount)*WII_TMD_CONTENT_SIZE
+	if len(tmdData) < tmdSize {
+		return nil, errors.New("tmd is too small")
+	}
+
+	ticketData, err := os.ReadFile(filepath.Join(path, "title.tik"))
+	if err != nil {
+		return nil, err
+	}
+	if len(ticketData) < WII_TICKET_SIZE {
+		return nil, errors.New("ticket is too small")
+	}
+
+	// NUS appends the signing certificates to the TMD and the ticket
+	certs := parseCertificates(tmdData[tmdSize:])
+	certs = append(certs, parseCertificates(ticketData[WII_TICKET_SIZE:])...)
+	if certData, err := os.ReadFile(filepath.Join(path, "title.cert")); err == nil {
+		certs = append(certs, parseCertificates(certData)...)
+	}
+
+	return &wiiTitle{tmd: tmd, tmdData: tmdData[:tmdSize], ticketData: ticketData[:WII_TICKET_SIZE], certs: certs}, nil
+}
+
+func (t *wiiTitle) cipher() (cipher.Block, error) {
+	commonKey, err := getWiiCommonKey(t.ticketData[WII_TICKET_KEY_INDEX])
+	if err != nil {
+		return nil, err
+	}
+	return newTitleCipher(commonKey, t.ticketData[0x1BF:0x1BF+0x10], t.tmd.TitleID)
+}
+
+func decryptWiiContent(path string, content Content, titleCipher cipher.Block, dst io.Writer) error {
+	src, err := os.Open(filepath.Join(path, content.CIDStr+".app"))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	var iv [aes.BlockSize]byte
+	copy(iv[:], content.Index)
+	decrypter := cipher.NewCBCDecrypter(titleCipher, iv[:])
+	contentHash := sha1.New()
+	bw := bufio.NewWriterSize(dst, READ_SIZE)
+	buffer := make([]byte, READ_SIZE)
+
+	left := content.Size
+	for left > 0 {
+		toWrite := min(READ_SIZE, left)
+		toRead := (toWrite + aes.BlockSize - 1) &^ (aes.BlockSize - 1)
+		if _, err := io.ReadFull(src, buffer[:toRead]); err != nil {
+			return fmt.Errorf("failed to read content %s: %w", content.CIDStr, err)
+		}
+		decrypter.CryptBlocks(buffer[:toRead], buffer[:toRead])
+		contentHash.Write(buffer[:toWrite])
+		if _, err := bw.Write(buffer[:toWrite]); err != nil {
+			return err
+		}
+		left -= toWrite
+	}
+	if !bytes.Equal(contentHash.Sum(nil), content.Hash[:sha1.Size]) {
+		return fmt.Errorf("content %s hash mismatch", content.CIDStr)
+	}
+	return bw.Flush()
+}
+
+// decryptWiiContents writes every decrypted content to the decrypted folder
+// and packs the title into a WAD next to them.
+func decryptWiiContents(path string, progressReporter ProgressReporter, deleteEncryptedContents bool) error {
+	title, err := readWiiTitle(path)
+	if err != nil {
+		return err
+	}
+	titleCipher, err := title.cipher()
+	if err != nil {
+		return err
+	}
+
+	outputPath := filepath.Join(path, WII_DECRYPTED_DIRECTORY)
+	if err := os.MkdirAll(outputPath, 0755); err != nil {
+		return err
+	}
+	for i, content := range title.tmd.Contents {
+		progressReporter.UpdateDecryptionProgress(float64(i) / float64(len(title.tmd.Contents)))
+		dst, err := os.Create(filepath.Join(outputPath, content.CIDStr+".app"))
+		if err != nil {
+			return err
+		}
+		err = decryptWiiContent(path, content, titleCipher, dst)
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := packWAD(path, title, filepath.Join(path, fmt.Sprintf("%016x.wad", title.tmd.TitleID))); err != nil {
+		return err
+	}
+	progressReporter.UpdateDecryptionProgress(1.0)
+
+	if deleteEncryptedContents {
+		doDeleteEncryptedContents(path)
+	}
+	return nil
+}
+
+// PackWAD packs a downloaded Wii title into an installable WAD.
+func PackWAD(path, outputPath string) error {
+	title, err := readWiiTitle(path)
+	if err != nil {
+		return err
+	}
+	return packWAD(path, title, outputPath)
+}
+
+func writeWADSection(w io.Writer, data []byte) error {
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return writeWADPadding(w, uint64(len(data)))
+}
+
+func writeWADPadding(w io.Writer, size uint64) error {
+	padding := (WAD_ALIGNMENT - size%WAD_ALIGNMENT) % WAD_ALIGNMENT
+	_, err := w.Write(make([]byte, padding))
+	return err
+}
+
+// A WAD is a header followed by the certificate chain, the ticket, the TMD
+// and the encrypted contents, every section aligned to 0x40 bytes.
+func packWAD(path string, title *wiiTitle, outputPath string) error {
+	certChain, err := buildWiiCertificateChain(title.certs,
+		readCString(title.tmdData[signedDataIssuerOffset:signedDataIssuerOffset+0x40]),
+		readCString(title.ticketData[signedDataIssuerOffset:signedDataIssuerOffset+0x40]))
+	if err != nil {
+		return err
+	}
+
+	contentSizes := make([]uint64, len(title.tmd.Contents))
+	dataSize := uint64(0)
+	for i, content := range title.tmd.Contents {
+		contentSizes[i] = (content.Size + aes.BlockSize - 1) &^ (aes.BlockSize - 1)
+		dataSize += (contentSizes[i] + WAD_ALIGNMENT - 1) &^ (WAD_ALIGNMENT - 1)
+	}
+
+	header := make([]byte, WAD_HEADER_SIZE)
+	binary.BigEndian.PutUint32(header[0x00:], WAD_HEADER_SIZE)
+	binary.BigEndian.PutUint16(header[0x04:], WAD_TYPE_INSTALLABLE)
+	binary.BigEndian.PutUint32(header[0x08:], uint32(len(certChain)))
+	binary.BigEndian.PutUint32(header[0x10:], uint32(len(title.ticketData)))
+	binary.BigEndian.PutUint32(header[0x14:], uint32(len(title.tmdData)))
+	binary.BigEndian.PutUint32(header[0x18:], uint32(dataSize))
+
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		bw := bufio.NewWriterSize(output, READ_SIZE)
+		for _, section := range [][]byte{header, certChain, title.ticketData, title.tmdData} {
+			if err := writeWADSection(bw, section); err != nil {
+				return err
+			}
+		}
+		for i, content := range title.tmd.Contents {
+			src, err := os.Open(filepath.Join(path, content.CIDStr+".app"))
+			if err != nil {
+				return err
+			}
+			_, err = io.CopyN(bw, src, int64(contentSizes[i]))
+			src.Close()
+			if err != nil {
+				return fmt.Errorf("failed to read content %s: %w", content.CIDStr, err)
+			}
+			if err := writeWADPadding(bw, contentSizes[i]); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	}()
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+	}
+	return err
+}
@@ -0,0 +1,162 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// buildTestCertificate builds a certificate holding an RSA-2048 public key.
+func buildTestCertificate(signatureType uint32, issuer, name string) []byte {
+	signatureSize := 0x100
+	if signatureType == certificateSignatureRSA4096 {
+		signatureSize = 0x200
+	}
+	headerOffset := int(alignTo(uint64(4+signatureSize), WAD_ALIGNMENT))
+	cert := make([]byte, headerOffset+certificateHeaderSize+0x138)
+	binary.BigEndian.PutUint32(cert, signatureType)
+	copy(cert[headerOffset:], issuer)
+	binary.BigEndian.PutUint32(cert[headerOffset+certificateKeyTypeOffset:], 1)
+	copy(cert[headerOffset+certificateNameOffset:], name)
+	return cert
+}
+
+// writeTestWiiTitle writes a vWii title the way NUS serves it, with the
+// certificates appended to the TMD and the ticket. It returns the TMD, the
+// ticket and the certificate chain a WAD of it should contain.
+func writeTestWiiTitle(t *testing.T, dir string, titleID uint64, contents [][]byte) ([]byte, []byte, []byte) {
+	t.Helper()
+	ca := buildTestCertificate(certificateSignatureRSA4096, "Root", "CA00000001")
+	cp := buildTestCertificate(certificateSignatureRSA2048, "Root-CA00000001", "CP00000004")
+	xs := buildTestCertificate(certificateSignatureRSA2048, "Root-CA00000001", "XS00000003")
+
+	titleKey := bytes.Repeat([]byte{0x37}, 16)
+	var titleIV [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(titleIV[:], titleID)
+	ticket := make([]byte, WII_TICKET_SIZE)
+	copy(ticket[signedDataIssuerOffset:], "Root-CA00000001-XS00000003")
+	copy(ticket[0x1BF:], titleKey)
+	encryptCBC(t, vWiiCommonKey, titleIV[:], ticket[0x1BF:0x1BF+0x10])
+	binary.BigEndian.PutUint64(ticket[0x1DC:], titleID)
+	ticket[WII_TICKET_KEY_INDEX] = 2
+
+	tmd := make([]byte, WII_TMD_HEADER_SIZE+len(contents)*WII_TMD_CONTENT_SIZE)
+	copy(tmd[signedDataIssuerOffset:], "Root-CA00000001-CP00000004")
+	tmd[0x180] = TMD_VERSION_WII
+	binary.BigEndian.PutUint64(tmd[0x18C:], titleID)
+	binary.BigEndian.PutUint16(tmd[0x1DE:], uint16(len(contents)))
+	for i, content := range contents {
+		record := tmd[WII_TMD_HEADER_SIZE+i*WII_TMD_CONTENT_SIZE:]
+		binary.BigEndian.PutUint32(record[0x00:], uint32(0x10+i))
+		binary.BigEndian.PutUint16(record[0x04:], uint16(i))
+		binary.BigEndian.PutUint16(record[0x06:], 1)
+		binary.BigEndian.PutUint64(record[0x08:], uint64(len(content)))
+		contentHash := sha1.Sum(content)
+		copy(record[0x10:], contentHash[:])
+
+		encrypted := make([]byte, alignTo(uint64(len(content)), aes.BlockSize))
+		copy(encrypted, content)
+		var iv [aes.BlockSize]byte
+		binary.BigEndian.PutUint16(iv[:], uint16(i))
+		encryptCBC(t, titleKey, iv[:], encrypted)
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%08X.app", 0x10+i)), encrypted, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files := map[string][]byte{
+		"title.tmd": append(append(append([]byte{}, tmd...), cp...), ca...),
+		"title.tik": append(append(append([]byte{}, ticket...), xs...), ca...),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tmd, ticket, append(append(append([]byte{}, ca...), cp...), xs...)
+}
+
+func TestWiiTitleWAD(t *testing.T) {
+	const titleID = 0x0000000700000050
+	contents := [][]byte{
+		bytes.Repeat([]byte{0xA1}, 0x40),
+		bytes.Repeat([]byte("vWii IOS"), 0x1235),
+		{0x01, 0x02, 0x03},
+	}
+	dir := t.TempDir()
+	tmd, ticket, certChain := writeTestWiiTitle(t, dir, titleID, contents)
+
+	if err := DecryptContents(dir, testProgressReporter{}, true); err != nil {
+		t.Fatalf("DecryptContents failed: %v", err)
+	}
+	for i, expected := range contents {
+		name := fmt.Sprintf("%08X.app", 0x10+i)
+		actual, err := os.ReadFile(filepath.Join(dir, WII_DECRYPTED_DIRECTORY, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("%s: contents differ", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: encrypted content was not deleted", name)
+		}
+	}
+
+	wad, err := os.ReadFile(filepath.Join(dir, fmt.Sprintf("%016x.wad", uint64(titleID))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint32(wad[0x00:]) != WAD_HEADER_SIZE || binary.BigEndian.Uint16(wad[0x04:]) != WAD_TYPE_INSTALLABLE {
+		t.Fatalf("invalid wad header % x", wad[:WAD_HEADER_SIZE])
+	}
+	offset := alignTo(WAD_HEADER_SIZE, WAD_ALIGNMENT)
+	sizeOffsets := []int{0x08, 0x10, 0x14}
+	for i, expected := range [][]byte{certChain, ticket, tmd} {
+		size := uint64(binary.BigEndian.Uint32(wad[sizeOffsets[i]:]))
+		if size != uint64(len(expected)) || !bytes.Equal(wad[offset:offset+size], expected) {
+			t.Errorf("wad section %d differs", i)
+		}
+		offset += alignTo(size, WAD_ALIGNMENT)
+	}
+	for i, content := range contents {
+		size := alignTo(uint64(len(content)), aes.BlockSize)
+		encrypted := append([]byte{}, wad[offset:offset+size]...)
+		var iv [aes.BlockSize]byte
+		binary.BigEndian.PutUint16(iv[:], uint16(i))
+		block, err := aes.NewCipher(bytes.Repeat([]byte{0x37}, 16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cipher.NewCBCDecrypter(block, iv[:]).CryptBlocks(encrypted, encrypted)
+		if !bytes.Equal(encrypted[:len(content)], content) {
+			t.Errorf("wad content %d differs", i)
+		}
+		offset += alignTo(size, WAD_ALIGNMENT)
+	}
+	if offset != uint64(len(wad)) {
+		t.Errorf("wad is %d bytes, want %d", len(wad), offset)
+	}
+}
+
+func TestWiiTitleHashMismatch(t *testing.T) {
+	dir := t.TempDir()
+	writeTestWiiTitle(t, dir, 0x0000000700000050, [][]byte{bytes.Repeat([]byte{0xA1}, 0x40)})
+	encrypted, err := os.ReadFile(filepath.Join(dir, "00000010.app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted[0] ^= 0xFF
+	if err := os.WriteFile(filepath.Join(dir, "00000010.app"), encrypted, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := DecryptContents(dir, testProgressReporter{}, false); err == nil {
+		t.Error("expected a corrupted content to be rejected")
+	}
+}
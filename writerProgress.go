@@ -35,7 +35,12 @@ func (r *WriterProgress) Write(p []byte) (n int, err error) {
 	return n, err
 }
 
+// Close stops the updates and reports the bytes written since the last one.
 func (r *WriterProgress) Close() error {
 	r.updateProgressTicker.Stop()
+	if r.downloadToReport > 0 {
+		r.progressReporter.UpdateDownloadProgress(r.downloadToReport, r.filename)
+		r.downloadToReport = 0
+	}
 	return nil
 }
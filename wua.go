@@ -0,0 +1,752 @@
+package wiiudownloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// WUA files are Cemu's ZArchive containers: 64KiB zstd compressed blocks
+// followed by offset records, a name table, a breadth-first file tree and a
+// footer. All values are big endian.
+const (
+	WUA_BLOCK_SIZE                = 64 * 1024
+	WUA_ENTRIES_PER_OFFSET_RECORD = 16
+	WUA_OFFSET_RECORD_SIZE        = 8 + 2*WUA_ENTRIES_PER_OFFSET_RECORD
+	WUA_FILE_TREE_ENTRY_SIZE      = 16
+	WUA_FOOTER_SIZE               = 6*16 + sha256.Size + 8 + 4 + 4
+	WUA_MAX_NAME_LENGTH           = 0x7FFF
+	WUA_VERSION                   = 0x61bf3a01
+	WUA_MAGIC                     = 0x169f52d6
+)
+
+const (
+	wuaRootNameOffset = 0x7FFFFFFF
+	wuaFileFlag       = 0x80000000
+	wuaHashOffset     = 6 * 16
+)
+
+var ErrWUAFileNotFound = errors.New("file not found in wua")
+
+type wuaSection struct {
+	Offset uint64
+	Size   uint64
+}
+
+type wuaNode struct {
+	name     string
+	isFile   bool
+	offset   uint64
+	size     uint64
+	children []*wuaNode
+	lookup   map[string]*wuaNode
+}
+
+func newWUADirectory(name string) *wuaNode {
+	return &wuaNode{name: name, lookup: make(map[string]*wuaNode)}
+}
+
+// WUAWriter creates a ZArchive. Files are written one at a time: StartFile
+// begins a new file and subsequent Write calls append to it.
+type WUAWriter struct {
+	output      *bufio.Writer
+	hash        hash.Hash
+	written     uint64
+	encoder     *zstd.Encoder
+	block       []byte
+	compressed  []byte
+	blockSizes  []uint32
+	inputOffset uint64
+	root        *wuaNode
+	currentFile *wuaNode
+	closed      bool
+}
+
+func NewWUAWriter(w io.Writer) (*WUAWriter, error) {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBetterCompression), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &WUAWriter{
+		output:     bufio.NewWriterSize(w, READ_SIZE),
+		hash:       sha256.New(),
+		encoder:    encoder,
+		block:      make([]byte, 0, WUA_BLOCK_SIZE),
+		compressed: make([]byte, 0, WUA_BLOCK_SIZE),
+		root:       newWUADirectory(""),
+	}, nil
+}
+
+func splitWUAPath(path string) ([]string, error) {
+	parts := make([]string, 0)
+	for _, part := range strings.Split(strings.ReplaceAll(path, "\\", "/"), "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			return nil, fmt.Errorf("invalid wua path '%s'", path)
+		}
+		if len(part) > WUA_MAX_NAME_LENGTH {
+			return nil, fmt.Errorf("name too long in wua path '%s'", path)
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+func (w *WUAWriter) makeDirs(parts []string) (*wuaNode, error) {
+	node := w.root
+	for _, part := range parts {
+		child, ok := node.lookup[strings.ToLower(part)]
+		if !ok {
+			child = newWUADirectory(part)
+			node.lookup[strings.ToLower(part)] = child
+			node.children = append(node.children, child)
+		} else if child.isFile {
+			return nil, fmt.Errorf("'%s' is a file", part)
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// MakeDir creates a directory and all of its parents.
+func (w *WUAWriter) MakeDir(path string) error {
+	if w.closed {
+		return errors.New("wua writer is closed")
+	}
+	parts, err := splitWUAPath(path)
+	if err != nil {
+		return err
+	}
+	_, err = w.makeDirs(parts)
+	return err
+}
+
+// StartFile creates a new file, its parent directories are created as needed.
+// Names are case-insensitive, so a file can only be added once.
+func (w *WUAWriter) StartFile(path string) error {
+	if w.closed {
+		return errors.New("wua writer is closed")
+	}
+	parts, err := splitWUAPath(path)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return fmt.Errorf("invalid wua path '%s'", path)
+	}
+	parent, err := w.makeDirs(parts[:len(parts)-1])
+	if err != nil {
+		return err
+	}
+	name := parts[len(parts)-1]
+	if _, ok := parent.lookup[strings.ToLower(name)]; ok {
+		return fmt.Errorf("'%s' already exists in wua", path)
+	}
+	file := &wuaNode{name: name, isFile: true, offset: w.inputOffset}
+	parent.lookup[strings.ToLower(name)] = file
+	parent.children = append(parent.children, file)
+	w.currentFile = file
+	return nil
+}
+
+func (w *WUAWriter) Write(p []byte) (int, error) {
+	if w.currentFile == nil {
+		return 0, errors.New("no file started in wua")
+	}
+	written := 0
+	for len(p) > 0 {
+		n := min(uint64(len(p)), uint64(WUA_BLOCK_SIZE-len(w.block)))
+		w.block = append(w.block, p[:n]...)
+		p = p[n:]
+		written += int(n)
+		w.currentFile.size += n
+		w.inputOffset += n
+		if len(w.block) == WUA_BLOCK_SIZE {
+			if err := w.flushBlock(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *WUAWriter) writeOutput(data []byte) error {
+	if _, err := w.output.Write(data); err != nil {
+		return err
+	}
+	w.hash.Write(data)
+	w.written += uint64(len(data))
+	return nil
+}
+
+func (w *WUAWriter) flushBlock() error {
+	w.compressed = w.encoder.EncodeAll(w.block, w.compressed[:0])
+	data := w.compressed
+	// Blocks that don't shrink are stored as is, the reader tells them apart by size
+	if len(data) >= WUA_BLOCK_SIZE {
+		data = w.block
+	}
+	if err := w.writeOutput(data); err != nil {
+		return err
+	}
+	w.blockSizes = append(w.blockSizes, uint32(len(data)))
+	w.block = w.block[:0]
+	return nil
+}
+
+// Close writes the file tree and footer. It doesn't close the underlying writer.
+func (w *WUAWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.currentFile = nil
+	defer w.encoder.Close()
+
+	if len(w.block) > 0 {
+		w.block = append(w.block, make([]byte, WUA_BLOCK_SIZE-len(w.block))...)
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+	}
+
+	var sections [6]wuaSection
+	sections[0] = wuaSection{Offset: 0, Size: w.written}
+
+	offsetRecords := &bytes.Buffer{}
+	blockOffset := uint64(0)
+	for i := 0; i < len(w.blockSizes); i += WUA_ENTRIES_PER_OFFSET_RECORD {
+		var record [WUA_OFFSET_RECORD_SIZE]byte
+		binary.BigEndian.PutUint64(record[:8], blockOffset)
+		for j := 0; j < WUA_ENTRIES_PER_OFFSET_RECORD && i+j < len(w.blockSizes); j++ {
+			binary.BigEndian.PutUint16(record[8+j*2:], uint16(w.blockSizes[i+j]-1))
+			blockOffset += uint64(w.blockSizes[i+j])
+		}
+		offsetRecords.Write(record[:])
+	}
+	sections[1] = wuaSection{Offset: w.written, Size: uint64(offsetRecords.Len())}
+	if err := w.writeOutput(offsetRecords.Bytes()); err != nil {
+		return err
+	}
+
+	names, tree := w.buildFileTree()
+	sections[2] = wuaSection{Offset: w.written, Size: uint64(len(names))}
+	if err := w.writeOutput(names); err != nil {
+		return err
+	}
+	sections[3] = wuaSection{Offset: w.written, Size: uint64(len(tree))}
+	if err := w.writeOutput(tree); err != nil {
+		return err
+	}
+	// No meta directory or meta data
+	sections[4] = wuaSection{Offset: w.written, Size: 0}
+	sections[5] = wuaSection{Offset: w.written, Size: 0}
+
+	footer := make([]byte, WUA_FOOTER_SIZE)
+	for i, section := range sections {
+		binary.BigEndian.PutUint64(footer[i*16:], section.Offset)
+		binary.BigEndian.PutUint64(footer[i*16+8:], section.Size)
+	}
+	binary.BigEndian.PutUint64(footer[wuaHashOffset+sha256.Size:], w.written+WUA_FOOTER_SIZE)
+	binary.BigEndian.PutUint32(footer[wuaHashOffset+sha256.Size+8:], WUA_VERSION)
+	binary.BigEndian.PutUint32(footer[wuaHashOffset+sha256.Size+12:], WUA_MAGIC)
+
+	// The integrity hash covers the whole file with the hash field zeroed
+	w.hash.Write(footer)
+	copy(footer[wuaHashOffset:], w.hash.Sum(nil))
+	if _, err := w.output.Write(footer); err != nil {
+		return err
+	}
+	return w.output.Flush()
+}
+
+func (w *WUAWriter) buildFileTree() ([]byte, []byte) {
+	names := &bytes.Buffer{}
+	nameOffsets := make(map[string]uint32)
+	nameOffset := func(name string) uint32 {
+		if offset, ok := nameOffsets[name]; ok {
+			return offset
+		}
+		offset := uint32(names.Len())
+		if len(name) < 0x80 {
+			names.WriteByte(byte(len(name)))
+		} else {
+			names.WriteByte(0x80 | byte(len(name)&0x7F))
+			names.WriteByte(byte(len(name) >> 7))
+		}
+		names.WriteString(name)
+		nameOffsets[name] = offset
+		return offset
+	}
+
+	// Children of a directory are stored contiguously and sorted case-insensitively
+	nodes := []*wuaNode{w.root}
+	startIndices := make(map[*wuaNode]uint32)
+	for i := 0; i < len(nodes); i++ {
+		node := nodes[i]
+		if node.isFile {
+			continue
+		}
+		sort.Slice(node.children, func(a, b int) bool {
+			return strings.ToLower(node.children[a].name) < strings.ToLower(node.children[b].name)
+		})
+		startIndices[node] = uint32(len(nodes))
+		nodes = append(nodes, node.children...)
+	}
+
+	tree := make([]byte, len(nodes)*WUA_FILE_TREE_ENTRY_SIZE)
+	for i, node := range nodes {
+		entry := tree[i*WUA_FILE_TREE_ENTRY_SIZE : (i+1)*WUA_FILE_TREE_ENTRY_SIZE]
+		typeAndNameOffset := uint32(wuaRootNameOffset)
+		if node != w.root {
+			typeAndNameOffset = nameOffset(node.name)
+		}
+		if node.isFile {
+			binary.BigEndian.PutUint32(entry[0:], typeAndNameOffset|wuaFileFlag)
+			binary.BigEndian.PutUint32(entry[4:], uint32(node.offset))
+			binary.BigEndian.PutUint32(entry[8:], uint32(node.size))
+			binary.BigEndian.PutUint16(entry[12:], uint16(node.size>>32))
+			binary.BigEndian.PutUint16(entry[14:], uint16(node.offset>>32))
+		} else {
+			binary.BigEndian.PutUint32(entry[0:], typeAndNameOffset)
+			binary.BigEndian.PutUint32(entry[4:], startIndices[node])
+			binary.BigEndian.PutUint32(entry[8:], uint32(len(node.children)))
+		}
+	}
+	return names.Bytes(), tree
+}
+
+type wuaEntry struct {
+	nameOffset uint32
+	isFile     bool
+	offset     uint64 // file offset or index of the first child
+	size       uint64 // file size or number of children
+}
+
+// WUAReader reads files from a ZArchive.
+type WUAReader struct {
+	r              io.ReaderAt
+	size           int64
+	sections       [6]wuaSection
+	integrityHash  []byte
+	offsetRecords  []byte
+	names          []byte
+	entries        []wuaEntry
+	decoder        *zstd.Decoder
+	blockBuffer    []byte
+	cachedBlock    []byte
+	cachedBlockIdx int64
+}
+
+func OpenWUA(r io.ReaderAt, size int64) (*WUAReader, error) {
+	if size < WUA_FOOTER_SIZE {
+		return nil, errors.New("wua is too small")
+	}
+	footer := make([]byte, WUA_FOOTER_SIZE)
+	if _, err := r.ReadAt(footer, size-WUA_FOOTER_SIZE); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(footer[wuaHashOffset+sha256.Size+12:]) != WUA_MAGIC {
+		return nil, errors.New("invalid wua magic")
+	}
+	if version := binary.BigEndian.Uint32(footer[wuaHashOffset+sha256.Size+8:]); version != WUA_VERSION {
+		return nil, fmt.Errorf("unsupported wua version %08x", version)
+	}
+	if binary.BigEndian.Uint64(footer[wuaHashOffset+sha256.Size:]) != uint64(size) {
+		return nil, errors.New("wua size mismatch")
+	}
+
+	reader := &WUAReader{r: r, size: size, integrityHash: footer[wuaHashOffset : wuaHashOffset+sha256.Size], cachedBlockIdx: -1}
+	for i := range reader.sections {
+		reader.sections[i].Offset = binary.BigEndian.Uint64(footer[i*16:])
+		reader.sections[i].Size = binary.BigEndian.Uint64(footer[i*16+8:])
+		if reader.sections[i].Offset+reader.sections[i].Size > uint64(size)-WUA_FOOTER_SIZE {
+			return nil, errors.New("wua section out of bounds")
+		}
+	}
+
+	readSection := func(section wuaSection) ([]byte, error) {
+		data := make([]byte, section.Size)
+		if _, err := r.ReadAt(data, int64(section.Offset)); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	var err error
+	if reader.offsetRecords, err = readSection(reader.sections[1]); err != nil {
+		return nil, err
+	}
+	if reader.names, err = readSection(reader.sections[2]); err != nil {
+		return nil, err
+	}
+	tree, err := readSection(reader.sections[3])
+	if err != nil {
+		return nil, err
+	}
+	if len(tree) == 0 || len(tree)%WUA_FILE_TREE_ENTRY_SIZE != 0 {
+		return nil, errors.New("invalid wua file tree")
+	}
+	reader.entries = make([]wuaEntry, len(tree)/WUA_FILE_TREE_ENTRY_SIZE)
+	for i := range reader.entries {
+		entry := tree[i*WUA_FILE_TREE_ENTRY_SIZE:]
+		typeAndNameOffset := binary.BigEndian.Uint32(entry[0:])
+		reader.entries[i].nameOffset = typeAndNameOffset &^ wuaFileFlag
+		reader.entries[i].isFile = typeAndNameOffset&wuaFileFlag != 0
+		if reader.entries[i].isFile {
+			reader.entries[i].offset = uint64(binary.BigEndian.Uint32(entry[4:])) | uint64(binary.BigEndian.Uint16(entry[14:]))<<32
+			reader.entries[i].size = uint64(binary.BigEndian.Uint32(entry[8:])) | uint64(binary.BigEndian.Uint16(entry[12:]))<<32
+		} else {
+			reader.entries[i].offset = uint64(binary.BigEndian.Uint32(entry[4:]))
+			reader.entries[i].size = uint64(binary.BigEndian.Uint32(entry[8:]))
+			if reader.entries[i].offset+reader.entries[i].size > uint64(len(reader.entries)) {
+				return nil, errors.New("invalid wua directory entry")
+			}
+		}
+	}
+	if reader.entries[0].isFile {
+		return nil, errors.New("wua root is not a directory")
+	}
+
+	if reader.decoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1)); err != nil {
+		return nil, err
+	}
+	return reader, nil
+}
+
+func (r *WUAReader) Close() {
+	r.decoder.Close()
+}
+
+func (r *WUAReader) entryName(entry wuaEntry) (string, error) {
+	offset := int(entry.nameOffset)
+	if offset >= len(r.names) {
+		return "", errors.New("wua name out of bounds")
+	}
+	length := int(r.names[offset])
+	offset++
+	if length&0x80 != 0 {
+		if offset >= len(r.names) {
+			return "", errors.New("wua name out of bounds")
+		}
+		length = length&0x7F | int(r.names[offset])<<7
+		offset++
+	}
+	if offset+length > len(r.names) {
+		return "", errors.New("wua name out of bounds")
+	}
+	return string(r.names[offset : offset+length]), nil
+}
+
+func (r *WUAReader) lookup(path string) (wuaEntry, error) {
+	parts, err := splitWUAPath(path)
+	if err != nil {
+		return wuaEntry{}, err
+	}
+	entry := r.entries[0]
+	for _, part := range parts {
+		if entry.isFile {
+			return wuaEntry{}, ErrWUAFileNotFound
+		}
+		found := false
+		for i := entry.offset; i < entry.offset+entry.size; i++ {
+			name, err := r.entryName(r.entries[i])
+			if err != nil {
+				return wuaEntry{}, err
+			}
+			if strings.EqualFold(name, part) {
+				entry = r.entries[i]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return wuaEntry{}, ErrWUAFileNotFound
+		}
+	}
+	return entry, nil
+}
+
+// Walk calls fn for every file and directory in the archive, parents first.
+func (r *WUAReader) Walk(fn func(path string, isDir bool, size uint64) error) error {
+	var walk func(entry wuaEntry, path string) error
+	walk = func(entry wuaEntry, path string) error {
+		for i := entry.offset; i < entry.offset+entry.size; i++ {
+			child := r.entries[i]
+			name, err := r.entryName(child)
+			if err != nil {
+				return err
+			}
+			childPath := name
+			if path != "" {
+				childPath = path + "/" + name
+			}
+			if child.isFile {
+				if err := fn(childPath, false, child.size); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := fn(childPath, true, 0); err != nil {
+				return err
+			}
+			if err := walk(child, childPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(r.entries[0], "")
+}
+
+func (r *WUAReader) readBlock(index int64) ([]byte, error) {
+	if index == r.cachedBlockIdx {
+		return r.cachedBlock, nil
+	}
+	recordOffset := index / WUA_ENTRIES_PER_OFFSET_RECORD * WUA_OFFSET_RECORD_SIZE
+	if recordOffset+WUA_OFFSET_RECORD_SIZE > int64(len(r.offsetRecords)) {
+		return nil, errors.New("wua block out of bounds")
+	}
+	record := r.offsetRecords[recordOffset : recordOffset+WUA_OFFSET_RECORD_SIZE]
+	blockOffset := binary.BigEndian.Uint64(record[:8])
+	for i := int64(0); i < index%WUA_ENTRIES_PER_OFFSET_RECORD; i++ {
+		blockOffset += uint64(binary.BigEndian.Uint16(record[8+i*2:])) + 1
+	}
+	blockSize := uint64(binary.BigEndian.Uint16(record[8+(index%WUA_ENTRIES_PER_OFFSET_RECORD)*2:])) + 1
+	if blockOffset+blockSize > r.sections[0].Size {
+		return nil, errors.New("wua block out of bounds")
+	}
+
+	if cap(r.blockBuffer) < int(blockSize) {
+		r.blockBuffer = make([]byte, WUA_BLOCK_SIZE)
+	}
+	data := r.blockBuffer[:blockSize]
+	if _, err := r.r.ReadAt(data, int64(r.sections[0].Offset+blockOffset)); err != nil {
+		return nil, err
+	}
+	if blockSize == WUA_BLOCK_SIZE {
+		r.cachedBlock = append(r.cachedBlock[:0], data...)
+	} else {
+		block, err := r.decoder.DecodeAll(data, r.cachedBlock[:0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress wua block %d: %w", index, err)
+		}
+		if len(block) != WUA_BLOCK_SIZE {
+			return nil, fmt.Errorf("wua block %d has invalid size", index)
+		}
+		r.cachedBlock = block
+	}
+	r.cachedBlockIdx = index
+	return r.cachedBlock, nil
+}
+
+// WriteFileTo decompresses a file from the archive into dst.
+func (r *WUAReader) WriteFileTo(path string, dst io.Writer) error {
+	entry, err := r.lookup(path)
+	if err != nil {
+		return err
+	}
+	if !entry.isFile {
+		return fmt.Errorf("'%s' is a directory", path)
+	}
+	offset := entry.offset
+	left := entry.size
+	for left > 0 {
+		block, err := r.readBlock(int64(offset / WUA_BLOCK_SIZE))
+		if err != nil {
+			return err
+		}
+		start := offset % WUA_BLOCK_SIZE
+		n := min(left, WUA_BLOCK_SIZE-start)
+		if _, err := dst.Write(block[start : start+n]); err != nil {
+			return err
+		}
+		offset += n
+		left -= n
+	}
+	return nil
+}
+
+func (r *WUAReader) ReadFile(path string) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	if err := r.WriteFileTo(path, buffer); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// VerifyIntegrity checks the SHA-256 hash stored in the footer.
+func (r *WUAReader) VerifyIntegrity() error {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(r.r, 0, r.size-WUA_FOOTER_SIZE+wuaHashOffset)); err != nil {
+		return err
+	}
+	hasher.Write(make([]byte, sha256.Size))
+	tail := make([]byte, WUA_FOOTER_SIZE-wuaHashOffset-sha256.Size)
+	if _, err := r.r.ReadAt(tail, r.size-int64(len(tail))); err != nil {
+		return err
+	}
+	hasher.Write(tail)
+	if !bytes.Equal(hasher.Sum(nil), r.integrityHash) {
+		return errors.New("wua integrity hash mismatch")
+	}
+	return nil
+}
+
+// wuaTitleSink lets DecryptContents stream a title straight into an archive.
+type wuaTitleSink struct {
+	writer *WUAWriter
+	root   string
+}
+
+type wuaFileWriter struct {
+	writer *WUAWriter
+}
+
+func (f wuaFileWriter) Write(p []byte) (int, error) {
+	return f.writer.Write(p)
+}
+
+func (f wuaFileWriter) Close() error {
+	f.writer.currentFile = nil
+	return nil
+}
+
+func (s wuaTitleSink) CreateFile(path string) (io.WriteCloser, error) {
+	if err := s.writer.StartFile(s.root + "/" + path); err != nil {
+		return nil, err
+	}
+	return wuaFileWriter{s.writer}, nil
+}
+
+// GetWUATitleFolder returns the folder name Cemu expects for a title inside a WUA.
+func GetWUATitleFolder(titleID uint64, titleVersion uint16) string {
+	return fmt.Sprintf("%016x_v%d", titleID, titleVersion)
+}
+
+func addDecryptedTitleToWUA(writer *WUAWriter, titlePath string, progressReporter ProgressReporter) error {
+	app, err := readAppXML(titlePath)
+	if err != nil {
+		return err
+	}
+	titleID, err := parseHexField(app.TitleID, 64)
+	if err != nil {
+		return fmt.Errorf("invalid title_id in app.xml: %w", err)
+	}
+	titleVersion, err := parseHexField(app.TitleVersion, 16)
+	if err != nil {
+		return fmt.Errorf("invalid title_version in app.xml: %w", err)
+	}
+	root := GetWUATitleFolder(titleID, uint16(titleVersion))
+
+	fileCount := 0
+	if err := filepath.WalkDir(titlePath, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			fileCount++
+		}
+		return err
+	}); err != nil {
+		return err
+	}
+
+	filesDone := 0
+	return filepath.WalkDir(titlePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if progressReporter.Cancelled() {
+			return context.Canceled
+		}
+		relativePath, err := filepath.Rel(titlePath, path)
+		if err != nil {
+			return err
+		}
+		archivePath := root + "/" + filepath.ToSlash(relativePath)
+		if d.IsDir() {
+			return writer.MakeDir(archivePath)
+		}
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		if err := writer.StartFile(archivePath); err != nil {
+			return err
+		}
+		if _, err := io.Copy(writer, src); err != nil {
+			return err
+		}
+		filesDone++
+		progressReporter.UpdateDecryptionProgress(float64(filesDone) / float64(fileCount))
+		return nil
+	})
+}
+
+func addEncryptedTitleToWUA(writer *WUAWriter, titlePath string, progressReporter ProgressReporter) error {
+	tmdData, err := os.ReadFile(filepath.Join(titlePath, "title.tmd"))
+	if err != nil {
+		return err
+	}
+	tmd, err := ParseTMD(tmdData)
+	if err != nil {
+		return err
+	}
+	sink := wuaTitleSink{writer: writer, root: GetWUATitleFolder(tmd.TitleID, tmd.TitleVersion)}
+	if err := writer.MakeDir(sink.root); err != nil {
+		return err
+	}
+	return decryptContentsToSink(titlePath, sink, progressReporter, false)
+}
+
+// ExportWUA bundles titles, usually a game with its update and DLC, into a
+// single .wua archive. Each path can be either a decrypted title or an
+// encrypted download, which gets decrypted straight into the archive.
+func ExportWUA(outputPath string, titlePaths []string, progressReporter ProgressReporter) error {
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+
+	err = func() error {
+		writer, err := NewWUAWriter(output)
+		if err != nil {
+			return err
+		}
+		for _, titlePath := range titlePaths {
+			if progressReporter.Cancelled() {
+				return context.Canceled
+			}
+			progressReporter.SetGameTitle(filepath.Base(titlePath))
+			if _, statErr := os.Stat(filepath.Join(titlePath, "title.tmd")); statErr == nil {
+				err = addEncryptedTitleToWUA(writer, titlePath, progressReporter)
+			} else {
+				err = addDecryptedTitleToWUA(writer, titlePath, progressReporter)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to add '%s' to wua: %w", titlePath, err)
+			}
+		}
+		return writer.Close()
+	}()
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(outputPath)
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTestWUA(t *testing.T, path string) *WUAReader {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	stat, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, err := OpenWUA(f, stat.Size())
+	if err != nil {
+		t.Fatalf("OpenWUA failed: %v", err)
+	}
+	t.Cleanup(reader.Close)
+	if err := reader.VerifyIntegrity(); err != nil {
+		t.Fatal(err)
+	}
+	return reader
+}
+
+func TestWUAWriterRoundTrip(t *testing.T) {
+	files := map[string][]byte{
+		"a/random.bin":                  randomBytes(1, WUA_BLOCK_SIZE*17+5),
+		"a/zeros.bin":                   make([]byte, WUA_BLOCK_SIZE*3),
+		"a/empty":                       {},
+		"B/" + strings.Repeat("n", 300): []byte("long name"),
+		"small.txt":                     []byte("hello"),
+	}
+	order := []string{"small.txt", "a/random.bin", "a/empty", "a/zeros.bin", "B/" + strings.Repeat("n", 300)}
+
+	outputPath := filepath.Join(t.TempDir(), "test.wua")
+	output, err := os.Create(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := NewWUAWriter(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.MakeDir("empty/dir"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range order {
+		if err := writer.StartFile(name); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.StartFile("A/RANDOM.BIN"); err == nil {
+		t.Error("expected duplicate file to be rejected")
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	output.Close()
+
+	reader := openTestWUA(t, outputPath)
+	for name, expected := range files {
+		actual, err := reader.ReadFile(strings.ToUpper(name))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("%s: contents differ (got %d bytes, want %d)", name, len(actual), len(expected))
+		}
+	}
+	if _, err := reader.ReadFile("missing"); err != ErrWUAFileNotFound {
+		t.Errorf("expected ErrWUAFileNotFound, got %v", err)
+	}
+
+	var walked []string
+	if err := reader.Walk(func(path string, isDir bool, size uint64) error {
+		walked = append(walked, path)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	expectedWalk := []string{"a", "a/empty", "a/random.bin", "a/zeros.bin", "B", "B/" + strings.Repeat("n", 300), "empty", "empty/dir", "small.txt"}
+	if strings.Join(walked, ",") != strings.Join(expectedWalk, ",") {
+		t.Errorf("unexpected walk order %v", walked)
+	}
+}
+
+func TestExportWUA(t *testing.T) {
+	decryptedDir := t.TempDir()
+	encryptedDir := t.TempDir()
+	files := testDecryptedTree()
+	writeTestTree(t, decryptedDir, files)
+
+	options := PackOptions{Certificate: make([]byte, TITLE_CERT_SIZE), TitleID: 0x0005000E10FFFF00, TitleVersion: 48}
+	if err := PackContents(decryptedDir, encryptedDir, options, testProgressReporter{}, nil); err != nil {
+		t.Fatalf("PackContents failed: %v", err)
+	}
+
+	outputPath := filepath.Join(t.TempDir(), "game.wua")
+	if err := ExportWUA(outputPath, []string{decryptedDir, encryptedDir}, testProgressReporter{}); err != nil {
+		t.Fatalf("ExportWUA failed: %v", err)
+	}
+
+	reader := openTestWUA(t, outputPath)
+	for _, root := range []string{"0005000010ffff00_v32", "0005000e10ffff00_v48"} {
+		for name, expected := range files {
+			actual, err := reader.ReadFile(root + "/" + name)
+			if err != nil {
+				t.Errorf("%s/%s: %v", root, name, err)
+				continue
+			}
+			if !bytes.Equal(actual, expected) {
+				t.Errorf("%s/%s: contents differ", root, name)
+			}
+		}
+	}
+}
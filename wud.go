@@ -0,0 +1,542 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A WUD is a raw dump of a Wii U disc. Its partition table is encrypted with
+// the disc key, the SI partition holds the tickets and TMDs of the titles on
+// the disc and every GM partition holds a title whose clusters are the same
+// as the .app files of its WUP package.
+const (
+	WUD_SECTOR_SIZE              = 0x8000
+	WUD_SIZE                     = 0x5D3A00000
+	WUD_PARTITION_TABLE_OFFSET   = 0x18000
+	WUD_PARTITION_TABLE_SIZE     = 0x8000
+	WUD_PARTITION_TABLE_MAGIC    = 0xCCA6E67B
+	WUD_PARTITION_ENTRIES_OFFSET = 0x800
+	WUD_PARTITION_ENTRY_SIZE     = 0x80
+	WUD_PARTITION_HEADER_MAGIC   = 0xCC93A4F5
+	WUD_SI_PARTITION             = "SI"
+	WUD_GM_PARTITION_PREFIX      = "GM"
+)
+
+// WUX is a WUD with duplicated sectors stored once. The little endian header
+// is followed by a sector index table and the sectors, aligned to the sector size.
+const (
+	WUX_MAGIC_0     = 0x30585557 // "WUX0"
+	WUX_MAGIC_1     = 0x1099D02E
+	WUX_HEADER_SIZE = 0x20
+)
+
+const (
+	fstClusterEntriesOffset = 0x20
+	fstClusterEntrySize     = 0x20
+)
+
+type WUXReader struct {
+	r                io.ReaderAt
+	sectorSize       uint64
+	uncompressedSize uint64
+	sectorIndex      []uint32
+	dataOffset       uint64
+}
+
+func isWUX(r io.ReaderAt) bool {
+	var magic [8]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil {
+		return false
+	}
+	return binary.LittleEndian.Uint32(magic[0:]) == WUX_MAGIC_0 && binary.LittleEndian.Uint32(magic[4:]) == WUX_MAGIC_1
+}
+
+func NewWUXReader(r io.ReaderAt) (*WUXReader, error) {
+	header := make([]byte, WUX_HEADER_SIZE)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, fmt.Errorf("failed to read wux header: %w", err)
+	}
+	if binary.LittleEndian.Uint32(header[0:]) != WUX_MAGIC_0 || binary.LittleEndian.Uint32(header[4:]) != WUX_MAGIC_1 {
+		return nil, errors.New("invalid wux magic")
+	}
+	sectorSize := uint64(binary.LittleEndian.Uint32(header[0x08:]))
+	if sectorSize < 0x100 || sectorSize&(sectorSize-1) != 0 {
+		return nil, fmt.Errorf("invalid wux sector size %#x", sectorSize)
+	}
+	uncompressedSize := binary.LittleEndian.Uint64(header[0x10:])
+	sectorCount := (uncompressedSize + sectorSize - 1) / sectorSize
+
+	indexData := make([]byte, sectorCount*4)
+	if _, err := r.ReadAt(indexData, WUX_HEADER_SIZE); err != nil {
+		return nil, fmt.Errorf("failed to read wux sector index: %w", err)
+	}
+	sectorIndex := make([]uint32, sectorCount)
+	for i := range sectorIndex {
+		sectorIndex[i] = binary.LittleEndian.Uint32(indexData[i*4:])
+	}
+
+	return &WUXReader{
+		r:                r,
+		sectorSize:       sectorSize,
+		uncompressedSize: uncompressedSize,
+		sectorIndex:      sectorIndex,
+		dataOffset:       (WUX_HEADER_SIZE + sectorCount*4 + sectorSize - 1) &^ (sectorSize - 1),
+	}, nil
+}
+
+func (w *WUXReader) Size() int64 {
+	return int64(w.uncompressedSize)
+}
+
+func (w *WUXReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	read := 0
+	for read < len(p) {
+		position := uint64(off) + uint64(read)
+		if position >= w.uncompressedSize {
+			return read, io.EOF
+		}
+		sector := position / w.sectorSize
+		sectorOffset := position % w.sectorSize
+		n := min(uint64(len(p)-read), min(w.sectorSize-sectorOffset, w.uncompressedSize-position))
+		storedOffset := w.dataOffset + uint64(w.sectorIndex[sector])*w.sectorSize + sectorOffset
+		if _, err := w.r.ReadAt(p[read:read+int(n)], int64(storedOffset)); err != nil {
+			return read, err
+		}
+		read += int(n)
+	}
+	return read, nil
+}
+
+// DiscImage is an opened .wud or .wux file, reads always return the
+// uncompressed disc contents.
+type DiscImage struct {
+	io.ReaderAt
+	size int64
+	file *os.File
+}
+
+func OpenDiscImage(path string) (*DiscImage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if isWUX(file) {
+		wux, err := NewWUXReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &DiscImage{ReaderAt: wux, size: wux.Size(), file: file}, nil
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &DiscImage{ReaderAt: file, size: stat.Size(), file: file}, nil
+}
+
+func (d *DiscImage) Size() int64 {
+	return d.size
+}
+
+func (d *DiscImage) Close() error {
+	return d.file.Close()
+}
+
+// ReadDiscKey reads a disc key stored either as 16 raw bytes or as hex.
+func ReadDiscKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == aes.BlockSize {
+		return data, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != aes.BlockSize {
+		return nil, errors.New("invalid disc key")
+	}
+	return key, nil
+}
+
+type DiscPartition struct {
+	Name       string
+	Offset     uint64
+	DataOffset uint64 // end of the partition header, where the FST starts
+}
+
+type DiscTitle struct {
+	TitleID   uint64
+	Partition *DiscPartition
+	Ticket    []byte
+	TMD       []byte
+	Cert      []byte
+}
+
+type discCluster struct {
+	offset uint64
+	size   uint64
+	hashed bool
+}
+
+type Disc struct {
+	image      io.ReaderAt
+	size       int64
+	discCipher cipher.Block
+	Partitions []DiscPartition
+}
+
+func OpenDisc(image io.ReaderAt, size int64, discKey []byte) (*Disc, error) {
+	discCipher, err := aes.NewCipher(discKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid disc key: %w", err)
+	}
+	disc := &Disc{image: image, size: size, discCipher: discCipher}
+
+	table := make([]byte, WUD_PARTITION_TABLE_SIZE)
+	if _, err := image.ReadAt(table, WUD_PARTITION_TABLE_OFFSET); err != nil {
+		return nil, fmt.Errorf("failed to read partition table: %w", err)
+	}
+	var zeroIV [aes.BlockSize]byte
+	cipher.NewCBCDecrypter(discCipher, zeroIV[:]).CryptBlocks(table, table)
+	if binary.BigEndian.Uint32(table) != WUD_PARTITION_TABLE_MAGIC {
+		return nil, errors.New("invalid partition table, the disc key is probably wrong")
+	}
+
+	partitionCount := binary.BigEndian.Uint32(table[0x1C:])
+	if WUD_PARTITION_ENTRIES_OFFSET+uint64(partitionCount)*WUD_PARTITION_ENTRY_SIZE > WUD_PARTITION_TABLE_SIZE {
+		return nil, fmt.Errorf("invalid partition count %d", partitionCount)
+	}
+	for i := uint32(0); i < partitionCount; i++ {
+		entry := table[WUD_PARTITION_ENTRIES_OFFSET+i*WUD_PARTITION_ENTRY_SIZE:]
+		name := string(entry[:0x1F])
+		if end := strings.IndexByte(name, 0); end >= 0 {
+			name = name[:end]
+		}
+		offset := uint64(binary.BigEndian.Uint32(entry[0x20:])) * WUD_SECTOR_SIZE
+
+		var header [8]byte
+		if _, err := image.ReadAt(header[:], int64(offset)); err != nil {
+			return nil, fmt.Errorf("failed to read header of partition %s: %w", name, err)
+		}
+		if binary.BigEndian.Uint32(header[0:]) != WUD_PARTITION_HEADER_MAGIC {
+			return nil, fmt.Errorf("invalid header for partition %s", name)
+		}
+		disc.Partitions = append(disc.Partitions, DiscPartition{
+			Name:       name,
+			Offset:     offset,
+			DataOffset: offset + uint64(binary.BigEndian.Uint32(header[4:])),
+		})
+	}
+	return disc, nil
+}
+
+func (d *Disc) Partition(name string) (*DiscPartition, error) {
+	for i := range d.Partitions {
+		if d.Partitions[i].Name == name {
+			return &d.Partitions[i], nil
+		}
+	}
+	return nil, fmt.Errorf("partition %s not found", name)
+}
+
+// readFST decrypts the FST at the start of a partition, its first cluster
+// entry describes the FST itself so the first sector tells how much to read.
+func (d *Disc) readFST(partition *DiscPartition, partitionCipher cipher.Block) (*FSTData, []discCluster, error) {
+	var zeroIV [aes.BlockSize]byte
+	decrypter := cipher.NewCBCDecrypter(partitionCipher, zeroIV[:])
+
+	data := make([]byte, WUD_SECTOR_SIZE)
+	if _, err := d.image.ReadAt(data, int64(partition.DataOffset)); err != nil {
+		return nil, nil, fmt.Errorf("failed to read FST of partition %s: %w", partition.Name, err)
+	}
+	decrypter.CryptBlocks(data, data)
+	if !bytes.Equal(data[:4], []byte("FST\x00")) {
+		return nil, nil, fmt.Errorf("invalid FST in partition %s", partition.Name)
+	}
+
+	clusterCount := binary.BigEndian.Uint32(data[0x08:])
+	fstSize := uint64(binary.BigEndian.Uint32(data[fstClusterEntriesOffset+4:])) * WUD_SECTOR_SIZE
+	if fstSize > uint64(d.size)-partition.DataOffset {
+		return nil, nil, fmt.Errorf("invalid FST size in partition %s", partition.Name)
+	}
+	if fstSize > WUD_SECTOR_SIZE {
+		rest := make([]byte, fstSize-WUD_SECTOR_SIZE)
+		if _, err := d.image.ReadAt(rest, int64(partition.DataOffset+WUD_SECTOR_SIZE)); err != nil {
+			return nil, nil, fmt.Errorf("failed to read FST of partition %s: %w", partition.Name, err)
+		}
+		decrypter.CryptBlocks(rest, rest)
+		data = append(data, rest...)
+	}
+	if uint64(fstClusterEntriesOffset)+uint64(clusterCount)*fstClusterEntrySize > uint64(len(data)) {
+		return nil, nil, fmt.Errorf("invalid cluster count in partition %s", partition.Name)
+	}
+
+	clusters := make([]discCluster, clusterCount)
+	for i := range clusters {
+		entry := data[fstClusterEntriesOffset+i*fstClusterEntrySize:]
+		clusters[i] = discCluster{
+			offset: partition.DataOffset + uint64(binary.BigEndian.Uint32(entry[0:]))*WUD_SECTOR_SIZE,
+			size:   uint64(binary.BigEndian.Uint32(entry[4:])) * WUD_SECTOR_SIZE,
+			hashed: entry[0x14] == FST_CLUSTER_HASH_MODE_HASHED,
+		}
+	}
+
+	fst := &FSTData{FSTReader: bytes.NewReader(data), FSTEntries: make([]FEntry, 0)}
+	if err := fst.Parse(); err != nil {
+		return nil, nil, err
+	}
+	return fst, clusters, nil
+}
+
+func (d *Disc) extractPartition(partition *DiscPartition, partitionCipher cipher.Block, sink decryptedSink, progressReporter ProgressReporter) error {
+	fst, clusters, err := d.readFST(partition, partitionCipher)
+	if err != nil {
+		return err
+	}
+	// Only the SI partition is encrypted with the disc key, its raw clusters use offset based IVs
+	offsetIV := partitionCipher == d.discCipher
+	src := io.NewSectionReader(d.image, 0, d.size)
+	return extractFSTFiles(fst, sink, progressReporter, partitionCipher, func(contentID uint16) (fstCluster, error) {
+		if int(contentID) >= len(clusters) {
+			return fstCluster{}, fmt.Errorf("cluster %d not found in partition %s", contentID, partition.Name)
+		}
+		cluster := clusters[contentID]
+		return fstCluster{src: src, offset: cluster.offset, hashed: cluster.hashed, offsetIV: offsetIV && !cluster.hashed}, nil
+	})
+}
+
+// memorySink keeps decrypted files in memory, used for the small SI partition.
+type memorySink map[string]*bytes.Buffer
+
+type memoryFile struct {
+	*bytes.Buffer
+}
+
+func (memoryFile) Close() error {
+	return nil
+}
+
+func (m memorySink) CreateFile(path string) (io.WriteCloser, error) {
+	buffer := &bytes.Buffer{}
+	m[path] = buffer
+	return memoryFile{buffer}, nil
+}
+
+// ignoreProgressReporter is used for internal reads that shouldn't move the progress bar.
+type ignoreProgressReporter struct{}
+
+func (ignoreProgressReporter) SetGameTitle(title string)                                   {}
+func (ignoreProgressReporter) UpdateDownloadProgress(downloaded int64, filename string)    {}
+func (ignoreProgressReporter) UpdateDecryptionProgress(progress float64)                   {}
+func (ignoreProgressReporter) Cancelled() bool                                             { return false }
+func (ignoreProgressReporter) SetCancelled()                                               {}
+func (ignoreProgressReporter) SetDownloadSize(size int64)                                  {}
+func (ignoreProgressReporter) ResetTotals()                                                {}
+func (ignoreProgressReporter) MarkFileAsDone(filename string)                              {}
+func (ignoreProgressReporter) SetTotalDownloadedForFile(filename string, downloaded int64) {}
+func (ignoreProgressReporter) SetStartTime(startTime time.Time)                            {}
+
+// Titles lists the titles installable from the disc, read from the SI partition.
+func (d *Disc) Titles() ([]DiscTitle, error) {
+	si, err := d.Partition(WUD_SI_PARTITION)
+	if err != nil {
+		return nil, err
+	}
+	files := make(memorySink)
+	if err := d.extractPartition(si, d.discCipher, files, ignoreProgressReporter{}); err != nil {
+		return nil, fmt.Errorf("failed to read SI partition: %w", err)
+	}
+
+	titles := make([]DiscTitle, 0)
+	for path, tmdData := range files {
+		if filepath.Base(path) != "title.tmd" {
+			continue
+		}
+		dir := strings.TrimSuffix(path, "title.tmd")
+		tmd, err := ParseTMD(tmdData.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		ticket, ok := files[dir+"title.tik"]
+		if !ok {
+			return nil, fmt.Errorf("ticket for %016x not found", tmd.TitleID)
+		}
+		partition, err := d.Partition(fmt.Sprintf("%s%016X", WUD_GM_PARTITION_PREFIX, tmd.TitleID))
+		if err != nil {
+			return nil, err
+		}
+		title := DiscTitle{TitleID: tmd.TitleID, Partition: partition, Ticket: ticket.Bytes(), TMD: tmdData.Bytes()}
+		if cert, ok := files[dir+"title.cert"]; ok {
+			title.Cert = cert.Bytes()
+		}
+		titles = append(titles, title)
+	}
+	if len(titles) == 0 {
+		return nil, errors.New("no titles found on the disc")
+	}
+	sort.Slice(titles, func(i, j int) bool {
+		return titles[i].TitleID < titles[j].TitleID
+	})
+	return titles, nil
+}
+
+func (t *DiscTitle) cipher() (cipher.Block, error) {
+	if len(t.Ticket) < 0x1BF+0x10 {
+		return nil, errors.New("invalid ticket")
+	}
+	return newTitleCipher(commonKey, t.Ticket[0x1BF:0x1BF+0x10], t.TitleID)
+}
+
+// ExtractTitle decrypts the files of a title straight from its partition.
+func (d *Disc) ExtractTitle(title *DiscTitle, outputPath string, progressReporter ProgressReporter) error {
+	titleCipher, err := title.cipher()
+	if err != nil {
+		return err
+	}
+	return d.extractPartition(title.Partition, titleCipher, directorySink(outputPath), progressReporter)
+}
+
+// ExportWUP writes a title as an installable WUP package, the encrypted
+// clusters are copied as is and the H3 hashes are rebuilt from the hash tree.
+func (d *Disc) ExportWUP(title *DiscTitle, outputPath string, progressReporter ProgressReporter) error {
+	titleCipher, err := title.cipher()
+	if err != nil {
+		return err
+	}
+	tmd, err := ParseTMD(title.TMD)
+	if err != nil {
+		return err
+	}
+	_, clusters, err := d.readFST(title.Partition, titleCipher)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(outputPath, 0755); err != nil {
+		return err
+	}
+	for name, data := range map[string][]byte{"title.tik": title.Ticket, "title.tmd": title.TMD, "title.cert": title.Cert} {
+		if data == nil {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(outputPath, name), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	totalSize := uint64(0)
+	for _, content := range tmd.Contents {
+		totalSize += content.Size
+	}
+	doneSize := uint64(0)
+	for _, content := range tmd.Contents {
+		if progressReporter.Cancelled() {
+			return nil
+		}
+		index := binary.BigEndian.Uint16(content.Index)
+		if int(index) >= len(clusters) {
+			return fmt.Errorf("content %08X has no cluster on the disc", content.ID)
+		}
+		cluster := clusters[index]
+		if err := d.copyCluster(cluster, content.Size, filepath.Join(outputPath, fmt.Sprintf("%08X.app", content.ID))); err != nil {
+			return err
+		}
+		if content.Type&CONTENT_TYPE_HASHED != 0 {
+			h3Data, err := d.buildH3(cluster, content.Size, titleCipher)
+			if err != nil {
+				return err
+			}
+			h3Hash := sha1.Sum(h3Data)
+			if !bytes.Equal(h3Hash[:], content.Hash[:sha1.Size]) {
+				return fmt.Errorf("H3 hash mismatch for content %08X", content.ID)
+			}
+			if err := os.WriteFile(filepath.Join(outputPath, fmt.Sprintf("%08X.h3", content.ID)), h3Data, 0644); err != nil {
+				return err
+			}
+		}
+		doneSize += content.Size
+		progressReporter.UpdateDecryptionProgress(float64(doneSize) / float64(totalSize))
+	}
+	return nil
+}
+
+func (d *Disc) copyCluster(cluster discCluster, size uint64, path string) error {
+	dst, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, io.NewSectionReader(d.image, int64(cluster.offset), int64(size)))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// buildH3 hashes the H2 table of the first block of every group of 16^3 blocks.
+func (d *Disc) buildH3(cluster discCluster, size uint64, titleCipher cipher.Block) ([]byte, error) {
+	const h3GroupSize = BLOCK_SIZE_HASHED * 16 * 16 * 16
+	h3Data := make([]byte, 0)
+	hashArea := make([]byte, HASHES_SIZE)
+	for offset := uint64(0); offset < size; offset += h3GroupSize {
+		if _, err := d.image.ReadAt(hashArea, int64(cluster.offset+offset)); err != nil {
+			return nil, err
+		}
+		var zeroIV [aes.BlockSize]byte
+		cipher.NewCBCDecrypter(titleCipher, zeroIV[:]).CryptBlocks(hashArea, hashArea)
+		h2Hash := sha1.Sum(hashArea[0x280:0x3C0])
+		h3Data = append(h3Data, h2Hash[:]...)
+	}
+	return h3Data, nil
+}
+
+// ExtractDiscImage extracts every title of a .wud or .wux image into its own
+// folder below outputPath, either decrypted or as a WUP package.
+func ExtractDiscImage(imagePath string, discKey []byte, outputPath string, decrypt bool, progressReporter ProgressReporter) error {
+	image, err := OpenDiscImage(imagePath)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	disc, err := OpenDisc(image, image.Size(), discKey)
+	if err != nil {
+		return err
+	}
+	titles, err := disc.Titles()
+	if err != nil {
+		return err
+	}
+	for i := range titles {
+		if progressReporter.Cancelled() {
+			break
+		}
+		progressReporter.SetGameTitle(fmt.Sprintf("%016x", titles[i].TitleID))
+		titlePath := filepath.Join(outputPath, fmt.Sprintf("%016x", titles[i].TitleID))
+		if decrypt {
+			err = disc.ExtractTitle(&titles[i], titlePath, progressReporter)
+		} else {
+			err = disc.ExportWUP(&titles[i], titlePath, progressReporter)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract %016x: %w", titles[i].TitleID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testDiscKey = bytes.Repeat([]byte{0x24}, 16)
+
+func alignTo(value, alignment uint64) uint64 {
+	return (value + alignment - 1) &^ (alignment - 1)
+}
+
+func encryptCBC(t *testing.T, key, iv, data []byte) {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+}
+
+// buildSIFST builds the FST of an SI partition with the files of one title
+// in folder 01, stored one per block in cluster 1.
+func buildSIFST(files []string, sizes []uint64) []byte {
+	fst := &bytes.Buffer{}
+	fst.WriteString("FST\x00")
+	binary.Write(fst, binary.BigEndian, uint32(0x20))
+	binary.Write(fst, binary.BigEndian, uint32(2))
+	fst.Write(make([]byte, 0x14))
+	clusters := [][2]uint32{{0, 1}, {1, uint32(len(files))}}
+	for _, cluster := range clusters {
+		binary.Write(fst, binary.BigEndian, cluster[0])
+		binary.Write(fst, binary.BigEndian, cluster[1])
+		fst.Write(make([]byte, 0xC))
+		fst.WriteByte(FST_CLUSTER_HASH_MODE_RAW)
+		fst.Write(make([]byte, 0xB))
+	}
+
+	names := &bytes.Buffer{}
+	names.WriteByte(0)
+	addName := func(name string) uint32 {
+		offset := uint32(names.Len())
+		names.WriteString(name)
+		names.WriteByte(0)
+		return offset
+	}
+	entryCount := uint32(2 + len(files))
+	writeEntry := func(entryType byte, nameOffset, offset, length uint32, contentID uint16) {
+		binary.Write(fst, binary.BigEndian, uint32(entryType)<<24|nameOffset)
+		binary.Write(fst, binary.BigEndian, offset)
+		binary.Write(fst, binary.BigEndian, length)
+		binary.Write(fst, binary.BigEndian, uint16(0))
+		binary.Write(fst, binary.BigEndian, contentID)
+	}
+	writeEntry(1, 0, 0, entryCount, 0)
+	writeEntry(1, addName("01"), 0, entryCount, 0)
+	for i, name := range files {
+		writeEntry(0, addName(name), uint32(uint64(i)*WUD_SECTOR_SIZE>>5), uint32(sizes[i]), 1)
+	}
+	fst.Write(names.Bytes())
+	return fst.Bytes()
+}
+
+// buildTestWUD lays out a packed title as a disc: an SI partition holding
+// its ticket, TMD and cert and a GM partition holding its contents.
+func buildTestWUD(t *testing.T, wupPath string, titleKey []byte) []byte {
+	t.Helper()
+	tmdData, err := os.ReadFile(filepath.Join(wupPath, "title.tmd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmd, err := ParseTMD(tmdData)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := make([]byte, 0x20000)
+	appendSectors := func(data []byte) uint64 {
+		offset := uint64(len(image))
+		image = append(image, data...)
+		image = append(image, make([]byte, alignTo(uint64(len(data)), WUD_SECTOR_SIZE)-uint64(len(data)))...)
+		return offset
+	}
+	partitionHeader := make([]byte, WUD_SECTOR_SIZE)
+	binary.BigEndian.PutUint32(partitionHeader[0:], WUD_PARTITION_HEADER_MAGIC)
+	binary.BigEndian.PutUint32(partitionHeader[4:], WUD_SECTOR_SIZE)
+
+	// GM partition: the FST needs the disc offsets of the clusters, which
+	// changes content 0 and therefore its hash in the TMD
+	contents := make([][]byte, len(tmd.Contents))
+	for i, content := range tmd.Contents {
+		if contents[i], err = os.ReadFile(filepath.Join(wupPath, fmt.Sprintf("%08X.app", content.ID))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fst := make([]byte, len(contents[0]))
+	copy(fst, contents[0])
+	var zeroIV [aes.BlockSize]byte
+	titleCipher, err := aes.NewCipher(titleKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cipher.NewCBCDecrypter(titleCipher, zeroIV[:]).CryptBlocks(fst, fst)
+	clusterOffset := alignTo(uint64(len(fst)), WUD_SECTOR_SIZE) / WUD_SECTOR_SIZE
+	for i := 1; i < len(contents); i++ {
+		binary.BigEndian.PutUint32(fst[0x20+i*0x20:], uint32(clusterOffset))
+		clusterOffset += alignTo(uint64(len(contents[i])), WUD_SECTOR_SIZE) / WUD_SECTOR_SIZE
+	}
+	fstHash := sha1.Sum(fst[:tmd.Contents[0].Size])
+	copy(tmdData[TMD_CONTENT_RECORDS_OFFSET+0x10:], fstHash[:])
+	cipher.NewCBCEncrypter(titleCipher, zeroIV[:]).CryptBlocks(fst, fst)
+	contents[0] = fst
+
+	ticketData, err := os.ReadFile(filepath.Join(wupPath, "title.tik"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certData, err := os.ReadFile(filepath.Join(wupPath, "title.cert"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SI partition
+	siNames := []string{"title.tik", "title.tmd", "title.cert"}
+	siFiles := [][]byte{ticketData, tmdData, certData}
+	siSizes := make([]uint64, len(siFiles))
+	siCluster := make([]byte, 0)
+	for i, data := range siFiles {
+		siSizes[i] = uint64(len(data))
+		block := make([]byte, WUD_SECTOR_SIZE)
+		copy(block, data)
+		var iv [aes.BlockSize]byte
+		binary.BigEndian.PutUint64(iv[8:], uint64(i)*WUD_SECTOR_SIZE>>16)
+		encryptCBC(t, testDiscKey, iv[:], block)
+		siCluster = append(siCluster, block...)
+	}
+	siFST := buildSIFST(siNames, siSizes)
+	siFST = append(siFST, make([]byte, alignTo(uint64(len(siFST)), WUD_SECTOR_SIZE)-uint64(len(siFST)))...)
+	encryptCBC(t, testDiscKey, zeroIV[:], siFST)
+
+	siOffset := appendSectors(partitionHeader)
+	appendSectors(siFST)
+	appendSectors(siCluster)
+
+	gmOffset := appendSectors(partitionHeader)
+	for _, content := range contents {
+		appendSectors(content)
+	}
+
+	table := make([]byte, WUD_PARTITION_TABLE_SIZE)
+	binary.BigEndian.PutUint32(table[0:], WUD_PARTITION_TABLE_MAGIC)
+	binary.BigEndian.PutUint32(table[0x1C:], 2)
+	for i, partition := range []struct {
+		name   string
+		offset uint64
+	}{{WUD_SI_PARTITION, siOffset}, {fmt.Sprintf("GM%016X", tmd.TitleID), gmOffset}} {
+		entry := table[WUD_PARTITION_ENTRIES_OFFSET+i*WUD_PARTITION_ENTRY_SIZE:]
+		copy(entry, partition.name)
+		binary.BigEndian.PutUint32(entry[0x20:], uint32(partition.offset/WUD_SECTOR_SIZE))
+	}
+	encryptCBC(t, testDiscKey, zeroIV[:], table)
+	copy(image[WUD_PARTITION_TABLE_OFFSET:], table)
+	return image
+}
+
+func packTestDiscTitle(t *testing.T) (map[string][]byte, string, []byte) {
+	t.Helper()
+	inputDir := t.TempDir()
+	wupDir := t.TempDir()
+	files := testDecryptedTree()
+	writeTestTree(t, inputDir, files)
+	titleKey := bytes.Repeat([]byte{0x42}, 16)
+	options := PackOptions{TitleKey: titleKey, Certificate: bytes.Repeat([]byte{0x55}, TITLE_CERT_SIZE), MaxContentSize: 0x20000}
+	if err := PackContents(inputDir, wupDir, options, testProgressReporter{}, nil); err != nil {
+		t.Fatalf("PackContents failed: %v", err)
+	}
+	return files, wupDir, titleKey
+}
+
+func checkTestTree(t *testing.T, root string, files map[string][]byte) {
+	t.Helper()
+	for name, expected := range files {
+		actual, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("%s: contents differ (got %d bytes, want %d)", name, len(actual), len(expected))
+		}
+	}
+}
+
+func TestDiscExportWUP(t *testing.T) {
+	files, wupDir, titleKey := packTestDiscTitle(t)
+	wud := buildTestWUD(t, wupDir, titleKey)
+
+	if _, err := OpenDisc(bytes.NewReader(wud), int64(len(wud)), make([]byte, 16)); err == nil {
+		t.Error("expected a wrong disc key to be rejected")
+	}
+	disc, err := OpenDisc(bytes.NewReader(wud), int64(len(wud)), testDiscKey)
+	if err != nil {
+		t.Fatalf("OpenDisc failed: %v", err)
+	}
+	titles, err := disc.Titles()
+	if err != nil {
+		t.Fatalf("Titles failed: %v", err)
+	}
+	if len(titles) != 1 || titles[0].TitleID != 0x0005000010FFFF00 {
+		t.Fatalf("unexpected titles %+v", titles)
+	}
+
+	outputDir := t.TempDir()
+	if err := disc.ExportWUP(&titles[0], outputDir, testProgressReporter{}); err != nil {
+		t.Fatalf("ExportWUP failed: %v", err)
+	}
+	entries, err := os.ReadDir(wupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == "00000000.app" || entry.Name() == "title.tmd" {
+			continue
+		}
+		expected, _ := os.ReadFile(filepath.Join(wupDir, entry.Name()))
+		actual, err := os.ReadFile(filepath.Join(outputDir, entry.Name()))
+		if err != nil {
+			t.Errorf("%s: %v", entry.Name(), err)
+			continue
+		}
+		if !bytes.Equal(actual, expected) {
+			t.Errorf("%s differs from the packed title", entry.Name())
+		}
+	}
+
+	if err := DecryptContents(outputDir, testProgressReporter{}, false); err != nil {
+		t.Fatalf("DecryptContents failed: %v", err)
+	}
+	checkTestTree(t, outputDir, files)
+}
+
+func TestExtractDiscImage(t *testing.T) {
+	files, wupDir, titleKey := packTestDiscTitle(t)
+	wud := buildTestWUD(t, wupDir, titleKey)
+
+	wudPath := filepath.Join(t.TempDir(), "game.wud")
+	if err := os.WriteFile(wudPath, wud, 0644); err != nil {
+		t.Fatal(err)
+	}
+	wuxPath := filepath.Join(t.TempDir(), "game.wux")
+	if err := CompressWUD(wudPath, wuxPath, false, testProgressReporter{}); err != nil {
+		t.Fatalf("CompressWUD failed: %v", err)
+	}
+
+	for _, imagePath := range []string{wudPath, wuxPath} {
+		name := filepath.Base(imagePath)
+		outputDir := t.TempDir()
+		if err := ExtractDiscImage(imagePath, testDiscKey, outputDir, true, testProgressReporter{}); err != nil {
+			t.Fatalf("%s: ExtractDiscImage failed: %v", name, err)
+		}
+		checkTestTree(t, filepath.Join(outputDir, "0005000010ffff00"), files)
+	}
+}
@@ -0,0 +1,191 @@
+package wiiudownloader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Only the sector hashes and the index table are kept in memory, around 40MB
+// for a full 25GB disc.
+func writeWUX(src io.Reader, size uint64, dst io.WriteSeeker, progressReporter ProgressReporter) ([]byte, error) {
+	sectorCount := (size + WUD_SECTOR_SIZE - 1) / WUD_SECTOR_SIZE
+	dataOffset := (WUX_HEADER_SIZE + sectorCount*4 + WUD_SECTOR_SIZE - 1) &^ (WUD_SECTOR_SIZE - 1)
+
+	header := make([]byte, dataOffset)
+	binary.LittleEndian.PutUint32(header[0x00:], WUX_MAGIC_0)
+	binary.LittleEndian.PutUint32(header[0x04:], WUX_MAGIC_1)
+	binary.LittleEndian.PutUint32(header[0x08:], WUD_SECTOR_SIZE)
+	binary.LittleEndian.PutUint64(header[0x10:], size)
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+
+	inputHash := sha256.New()
+	bw := bufio.NewWriterSize(dst, READ_SIZE)
+	sector := make([]byte, WUD_SECTOR_SIZE)
+	sectorIndex := header[WUX_HEADER_SIZE : WUX_HEADER_SIZE+sectorCount*4]
+	storedSectors := make(map[[sha256.Size]byte]uint32)
+	for i := uint64(0); i < sectorCount; i++ {
+		if progressReporter.Cancelled() {
+			return nil, context.Canceled
+		}
+		n, err := io.ReadFull(src, sector)
+		if err != nil && !(err == io.ErrUnexpectedEOF && i == sectorCount-1) {
+			return nil, fmt.Errorf("failed to read sector %d: %w", i, err)
+		}
+		inputHash.Write(sector[:n])
+		clear(sector[n:])
+
+		sectorHash := sha256.Sum256(sector)
+		index, ok := storedSectors[sectorHash]
+		if !ok {
+			index = uint32(len(storedSectors))
+			storedSectors[sectorHash] = index
+			if _, err := bw.Write(sector); err != nil {
+				return nil, err
+			}
+		}
+		binary.LittleEndian.PutUint32(sectorIndex[i*4:], index)
+
+		if i%0x100 == 0 {
+			progressReporter.UpdateDecryptionProgress(float64(i) / float64(sectorCount))
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	if _, err := dst.Seek(WUX_HEADER_SIZE, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := dst.Write(sectorIndex); err != nil {
+		return nil, err
+	}
+	progressReporter.UpdateDecryptionProgress(1.0)
+	return inputHash.Sum(nil), nil
+}
+
+func hashImage(r io.ReaderAt, size int64) ([]byte, error) {
+	hasher := sha256.New()
+	if _, err := io.CopyBuffer(hasher, io.NewSectionReader(r, 0, size), make([]byte, READ_SIZE)); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
+
+// hashDiscImage hashes the logical contents of a .wud or .wux.
+func hashDiscImage(path string) ([]byte, error) {
+	image, err := OpenDiscImage(path)
+	if err != nil {
+		return nil, err
+	}
+	defer image.Close()
+	return hashImage(image, image.Size())
+}
+
+func verifyImageHash(path string, expectedHash []byte) error {
+	actualHash, err := hashDiscImage(path)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(actualHash, expectedHash) {
+		return fmt.Errorf("verification of '%s' failed: hash mismatch", path)
+	}
+	return nil
+}
+
+// CompressWUD converts a .wud into a .wux, storing every distinct sector once.
+// With verify set the result is read back and compared against the input hash.
+func CompressWUD(inputPath, outputPath string, verify bool, progressReporter ProgressReporter) error {
+	input, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	if isWUX(input) {
+		return errors.New("input is already a wux")
+	}
+	stat, err := input.Stat()
+	if err != nil {
+		return err
+	}
+
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	inputHash, err := writeWUX(bufio.NewReaderSize(input, READ_SIZE), uint64(stat.Size()), output, progressReporter)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && verify {
+		err = verifyImageHash(outputPath, inputHash)
+	}
+	if err != nil {
+		os.Remove(outputPath)
+	}
+	return err
+}
+
+// ExpandWUX converts a .wux back into a plain .wud. With verify set the .wux
+// is read again on its own and its contents compared with the result.
+func ExpandWUX(inputPath, outputPath string, verify bool, progressReporter ProgressReporter) error {
+	input, err := os.Open(inputPath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	wux, err := NewWUXReader(input)
+	if err != nil {
+		return err
+	}
+
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		bw := bufio.NewWriterSize(output, READ_SIZE)
+		sector := make([]byte, WUD_SECTOR_SIZE)
+		for offset := int64(0); offset < wux.Size(); offset += WUD_SECTOR_SIZE {
+			if progressReporter.Cancelled() {
+				return context.Canceled
+			}
+			n, err := wux.ReadAt(sector, offset)
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if _, err := bw.Write(sector[:n]); err != nil {
+				return err
+			}
+			if (offset/WUD_SECTOR_SIZE)%0x100 == 0 {
+				progressReporter.UpdateDecryptionProgress(float64(offset) / float64(wux.Size()))
+			}
+		}
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		progressReporter.UpdateDecryptionProgress(1.0)
+		return nil
+	}()
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && verify {
+		var inputHash []byte
+		if inputHash, err = hashDiscImage(inputPath); err == nil {
+			err = verifyImageHash(outputPath, inputHash)
+		}
+	}
+	if err != nil {
+		os.Remove(outputPath)
+	}
+	return err
+}
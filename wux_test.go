@@ -0,0 +1,53 @@
+package wiiudownloader
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWUXRoundTrip(t *testing.T) {
+	// Repeated sectors, an unaligned tail and some unique data
+	wud := make([]byte, 0)
+	for i := 0; i < 8; i++ {
+		wud = append(wud, bytes.Repeat([]byte{0xAB}, WUD_SECTOR_SIZE)...)
+	}
+	wud = append(wud, randomBytes(4, WUD_SECTOR_SIZE*3)...)
+	wud = append(wud, make([]byte, WUD_SECTOR_SIZE*4)...)
+	wud = append(wud, randomBytes(5, 0x1234)...)
+
+	dir := t.TempDir()
+	wudPath := filepath.Join(dir, "game.wud")
+	wuxPath := filepath.Join(dir, "game.wux")
+	expandedPath := filepath.Join(dir, "expanded.wud")
+	if err := os.WriteFile(wudPath, wud, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CompressWUD(wudPath, wuxPath, true, testProgressReporter{}); err != nil {
+		t.Fatalf("CompressWUD failed: %v", err)
+	}
+	stat, err := os.Stat(wuxPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Header sector, 1 repeated, 3 unique, 1 zero and the tail
+	if expected := int64(WUD_SECTOR_SIZE * 7); stat.Size() != expected {
+		t.Errorf("unexpected wux size %#x, want %#x", stat.Size(), expected)
+	}
+	if err := CompressWUD(wuxPath, filepath.Join(dir, "again.wux"), false, testProgressReporter{}); err == nil {
+		t.Error("expected compressing a wux to fail")
+	}
+
+	if err := ExpandWUX(wuxPath, expandedPath, true, testProgressReporter{}); err != nil {
+		t.Fatalf("ExpandWUX failed: %v", err)
+	}
+	expanded, err := os.ReadFile(expandedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expanded, wud) {
+		t.Errorf("expanded image differs (got %d bytes, want %d)", len(expanded), len(wud))
+	}
+}